@@ -0,0 +1,191 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "dedb"
+)
+
+const (
+	defaultPageSize    = 500
+	defaultMaxAttempts = 3
+	wrongVersionReason = "WRONG_EXPECTED_VERSION"
+)
+
+// ApplyFunc folds an event into the state of an aggregate
+type ApplyFunc[S any] func(state *S, event *api.Event) error
+
+/*
+Aggregate is the state of a domain instance built from its events, along with the new
+events raised on it that are not saved yet.
+*/
+type Aggregate[S any] struct {
+	Domain   string
+	DomainId string
+	Version  int64 // version of the last saved event applied to State
+	State    S
+
+	handlers map[string]ApplyFunc[S]
+	changes  []*api.Event
+}
+
+/*
+Raise applies a new event to the state and records it to be saved. The event's domain and
+domain id are set to the aggregate's.
+*/
+func (a *Aggregate[S]) Raise(event *api.Event) error {
+	event.Domain = a.Domain
+	event.DomainId = a.DomainId
+	err := a.apply(event)
+	if err != nil {
+		return err
+	}
+	a.changes = append(a.changes, event)
+	return nil
+}
+
+// Changes are the events raised since the aggregate was loaded or saved
+func (a *Aggregate[S]) Changes() []*api.Event {
+	return a.changes
+}
+
+// apply folds the event into the state, events without a handler do not change it
+func (a *Aggregate[S]) apply(event *api.Event) error {
+	handler, ok := a.handlers[event.Name]
+	if !ok {
+		return nil
+	}
+	err := handler(&a.State, event)
+	if err != nil {
+		return fmt.Errorf("could not apply %s event %s: %w", event.Name, event.Id, err)
+	}
+	return nil
+}
+
+/*
+AggregateRepository loads aggregates by folding their events into state with the apply
+functions registered for each event name, and saves the events raised on them guarded by
+the version they were loaded at.
+*/
+type AggregateRepository[S any] struct {
+	client      *Client
+	handlers    map[string]ApplyFunc[S]
+	PageSize    int64 // events read per GetDomain call while loading, defaults to 500
+	MaxAttempts int   // times Update runs when concurrent writers conflict, defaults to 3
+}
+
+func NewAggregateRepository[S any](client *Client) *AggregateRepository[S] {
+	return &AggregateRepository[S]{
+		client:      client,
+		handlers:    make(map[string]ApplyFunc[S]),
+		PageSize:    defaultPageSize,
+		MaxAttempts: defaultMaxAttempts,
+	}
+}
+
+// On registers the apply function of the named event
+func (r *AggregateRepository[S]) On(name string, apply ApplyFunc[S]) *AggregateRepository[S] {
+	r.handlers[name] = apply
+	return r
+}
+
+// Load reads every event of the domain instance, a page at a time, and folds them into state
+func (r *AggregateRepository[S]) Load(ctx context.Context, domain string, id string) (*Aggregate[S], error) {
+	a := &Aggregate[S]{
+		Domain:   domain,
+		DomainId: id,
+		handlers: r.handlers,
+	}
+	for {
+		response, err := r.client.GetDomain(ctx, &api.GetDomainRequest{
+			Domain:   domain,
+			DomainId: id,
+			Offset:   a.Version,
+			Limit:    r.PageSize,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range response.Events {
+			err = a.apply(e)
+			if err != nil {
+				return nil, err
+			}
+			a.Version = e.Version
+		}
+		if r.PageSize <= 0 || int64(len(response.Events)) < r.PageSize {
+			return a, nil
+		}
+	}
+}
+
+/*
+Save saves the events raised on the aggregate, as long as no other events were saved for
+it since it was loaded. IsConflict reports whether that is why it failed.
+*/
+func (r *AggregateRepository[S]) Save(ctx context.Context, a *Aggregate[S]) error {
+	if len(a.changes) == 0 {
+		return nil
+	}
+	response, err := r.client.Save(ctx, &api.SaveRequest{
+		Events:          a.changes,
+		ExpectedVersion: &api.ExpectedVersion{Kind: api.ExpectedVersion_EXACT, Version: a.Version},
+	})
+	if err != nil {
+		return err
+	}
+	a.Version = response.Version
+	a.changes = nil
+	return nil
+}
+
+/*
+Update loads the aggregate, runs the command on it and saves the events it raised. When
+another writer saved events in between, it starts over with the aggregate reloaded, so
+the command always decides on the latest state.
+*/
+func (r *AggregateRepository[S]) Update(ctx context.Context, domain string, id string, command func(a *Aggregate[S]) error) (*Aggregate[S], error) {
+	attempts := r.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		var a *Aggregate[S]
+		a, err = r.Load(ctx, domain, id)
+		if err != nil {
+			return nil, err
+		}
+		err = command(a)
+		if err != nil {
+			return nil, err
+		}
+		err = r.Save(ctx, a)
+		if err == nil {
+			return a, nil
+		}
+		if !IsConflict(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// IsConflict reports whether a save failed because the expected version did not match
+func IsConflict(err error) bool {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.Aborted {
+		return false
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Reason == wrongVersionReason {
+			return true
+		}
+	}
+	return false
+}
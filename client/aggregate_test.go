@@ -0,0 +1,116 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	api "dedb"
+	"dedb/dedbtest"
+)
+
+type account struct {
+	opened  bool
+	balance int
+}
+
+func newTestAccounts(t *testing.T) *AggregateRepository[account] {
+	server, err := dedbtest.NewServer()
+	if err != nil {
+		panic(err)
+	}
+	t.Cleanup(server.Close)
+	c, _ := NewClient(ClientConfig{Server: server.Addr})
+	err = c.Connect(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	t.Cleanup(c.Close)
+
+	return NewAggregateRepository[account](c).
+		On("AccountOpened", func(s *account, e *api.Event) error {
+			s.opened = true
+			return nil
+		}).
+		On("Deposited", func(s *account, e *api.Event) error {
+			amount, err := strconv.Atoi(string(e.Data))
+			s.balance += amount
+			return err
+		})
+}
+
+func deposit(amount int) func(a *Aggregate[account]) error {
+	return func(a *Aggregate[account]) error {
+		if !a.State.opened {
+			return fmt.Errorf("account is not open")
+		}
+		return a.Raise(&api.Event{Name: "Deposited", Data: []byte(strconv.Itoa(amount))})
+	}
+}
+
+func TestAggregateRepository(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	accounts := newTestAccounts(t)
+	accounts.PageSize = 2
+
+	// when
+	a, err := accounts.Load(ctx, "ACCOUNT", "a1")
+	assert.Nil(t, err)
+	assert.Nil(t, a.Raise(&api.Event{Name: "AccountOpened"}))
+	for i := 1; i <= 4; i++ {
+		assert.Nil(t, a.Raise(&api.Event{Name: "Deposited", Data: []byte(strconv.Itoa(i))}))
+	}
+	assert.Nil(t, a.Raise(&api.Event{Name: "Audited"}))
+	err = accounts.Save(ctx, a)
+
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), a.Version)
+	assert.Equal(t, 0, len(a.Changes()))
+	loaded, err := accounts.Load(ctx, "ACCOUNT", "a1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), loaded.Version)
+	assert.Equal(t, account{opened: true, balance: 10}, loaded.State)
+}
+
+func TestAggregateRepositoryConflicts(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	accounts := newTestAccounts(t)
+	_, err := accounts.Update(ctx, "ACCOUNT", "a1", func(a *Aggregate[account]) error {
+		return a.Raise(&api.Event{Name: "AccountOpened"})
+	})
+	assert.Nil(t, err)
+	stale, _ := accounts.Load(ctx, "ACCOUNT", "a1")
+	_, err = accounts.Update(ctx, "ACCOUNT", "a1", deposit(5))
+	assert.Nil(t, err)
+
+	// when / then a save from a stale load conflicts
+	assert.Nil(t, deposit(1)(stale))
+	err = accounts.Save(ctx, stale)
+	assert.True(t, IsConflict(err))
+
+	// when / then update retries on the latest state
+	runs := 0
+	a, err := accounts.Update(ctx, "ACCOUNT", "a1", func(a *Aggregate[account]) error {
+		runs++
+		if runs == 1 {
+			// another writer gets in between the load and the save
+			_, err := accounts.Update(ctx, "ACCOUNT", "a1", deposit(10))
+			assert.Nil(t, err)
+		}
+		return deposit(1)(a)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, runs)
+	assert.Equal(t, 16, a.State.balance)
+	assert.Equal(t, int64(4), a.Version)
+
+	// when / then command errors are not retried
+	_, err = accounts.Update(ctx, "ACCOUNT", "a2", deposit(1))
+	assert.Equal(t, "account is not open", err.Error())
+}
@@ -2,56 +2,524 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 
 	api "dedb"
 )
 
+const (
+	defaultDialTimeout  = 10 * time.Second
+	defaultRetryBackoff = 100 * time.Millisecond
+	maxRetryBackoff     = 5 * time.Second
+)
+
 type ClientConfig struct {
-	Server        string
-	Streams       []string
-	ConsumerGroup string
-	EventChannel  chan<- *api.Event
-	ErrorChannel  chan<- error
+	Server         string
+	Streams        []string          // domains to subscribe to, required with EventChannel
+	EventNames     []string          // events to subscribe to, required with EventChannel
+	ConsumerGroup  string            // required with EventChannel
+	EventChannel   chan<- *api.Event // subscribed events are sent here, no subscription is made when nil
+	ErrorChannel   chan<- error      // subscription errors are sent here when set
+	ManualAck      bool              // when set events must be acked with Ack, otherwise they are acked once sent on EventChannel
+	TLS            *tls.Config       // connects in plaintext when nil
+	APIKey         string            // sent with every call in the x-api-key header when set
+	Token          string            // sent with every call as a bearer token when set
+	DialTimeout    time.Duration     // defaults to 10 seconds
+	RequestTimeout time.Duration     // timeout of each attempt of a call, none when 0
+	MaxRetries     int               // times a call failing with Unavailable is retried
+	RetryBackoff   time.Duration     // wait before the first retry, doubled for each one after, defaults to 100ms
+
+	// AllowPlaintextCredentials sends APIKey and Token without TLS, for a server reached through
+	// a TLS terminating proxy on a trusted network. Otherwise they require TLS to be set.
+	AllowPlaintextCredentials bool
 }
 
 type Client struct {
 	config ClientConfig
+
+	mu      sync.Mutex
+	addr    string // server currently connected to, the leader after a redirect
+	conn    *grpc.ClientConn
+	server  api.DeDBClient
+	stream  api.DeDB_SubscribeClient
+	closing bool
+
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
 func NewClient(config ClientConfig) (*Client, error) {
 	if config.Server == "" {
 		return nil, fmt.Errorf("Server config entry required")
 	}
-	if len(config.Streams) == 0 {
-		return nil, fmt.Errorf("Streams config entry required")
+	if config.EventChannel != nil {
+		if len(config.Streams) == 0 {
+			return nil, fmt.Errorf("Streams config entry needs at least one domain to subscribe to")
+		}
+		if len(config.EventNames) == 0 {
+			return nil, fmt.Errorf("EventNames config entry needs at least one event to subscribe to")
+		}
+		if config.ConsumerGroup == "" {
+			return nil, fmt.Errorf("ConsumerGroup config entry required")
+		}
+	}
+	if (config.APIKey != "" || config.Token != "") && config.TLS == nil && !config.AllowPlaintextCredentials {
+		return nil, fmt.Errorf("TLS config entry required with APIKey or Token, unless AllowPlaintextCredentials is set")
 	}
-	if config.ConsumerGroup == "" {
-		return nil, fmt.Errorf("ConsumerGroup config entry required")
+	if config.DialTimeout == 0 {
+		config.DialTimeout = defaultDialTimeout
 	}
-	if len(domains) == 0 {
-		return nil, fmt.Errorf("Streams config entry needs at least one domain to subscribe to")
+	if config.RetryBackoff == 0 {
+		config.RetryBackoff = defaultRetryBackoff
 	}
 
 	c := &Client{config: config}
 	return c, nil
 }
 
+/*
+Save saves the events. When retries are configured and the request has no idempotency key
+one is generated, so a retry of a save that went through is not saved twice. The key is
+set on a copy, the request of the caller is left as is and can be sent again as a new save.
+*/
 func (c *Client) Save(ctx context.Context, request *api.SaveRequest) (*api.SaveResponse, error) {
-	return c.server.Save(ctx, request)
+	if c.config.MaxRetries > 0 && request.IdempotencyKey == "" {
+		request = proto.Clone(request).(*api.SaveRequest)
+		request.IdempotencyKey = ulid.Make().String()
+	}
+	var response *api.SaveResponse
+	err := c.invoke(ctx, func(ctx context.Context, server api.DeDBClient) (err error) {
+		response, err = server.Save(ctx, request)
+		return err
+	})
+	return response, err
 }
 
 func (c *Client) GetDomain(ctx context.Context, request *api.GetDomainRequest) (*api.GetResponse, error) {
-	return c.server.GetDomain(ctx, request)
+	var response *api.GetResponse
+	err := c.invoke(ctx, func(ctx context.Context, server api.DeDBClient) (err error) {
+		response, err = server.GetDomain(ctx, request)
+		return err
+	})
+	return response, err
+}
+
+func (c *Client) GetDomainByTimeRange(ctx context.Context, request *api.GetDomainByTimeRangeRequest) (*api.GetResponse, error) {
+	var response *api.GetResponse
+	err := c.invoke(ctx, func(ctx context.Context, server api.DeDBClient) (err error) {
+		response, err = server.GetDomainByTimeRange(ctx, request)
+		return err
+	})
+	return response, err
 }
 
 func (c *Client) GetDomainIds(ctx context.Context, request *api.GetDomainIdsRequest) (*api.GetDomainIdsResponse, error) {
-	return c.server.GetDomainIds(ctx, request)
+	var response *api.GetDomainIdsResponse
+	err := c.invoke(ctx, func(ctx context.Context, server api.DeDBClient) (err error) {
+		response, err = server.GetDomainIds(ctx, request)
+		return err
+	})
+	return response, err
+}
+
+func (c *Client) ReadAll(ctx context.Context, request *api.ReadAllRequest) (*api.ReadAllResponse, error) {
+	var response *api.ReadAllResponse
+	err := c.invoke(ctx, func(ctx context.Context, server api.DeDBClient) (err error) {
+		response, err = server.ReadAll(ctx, request)
+		return err
+	})
+	return response, err
+}
+
+func (c *Client) SaveSnapshot(ctx context.Context, request *api.SaveSnapshotRequest) (*api.SaveSnapshotResponse, error) {
+	var response *api.SaveSnapshotResponse
+	err := c.invoke(ctx, func(ctx context.Context, server api.DeDBClient) (err error) {
+		response, err = server.SaveSnapshot(ctx, request)
+		return err
+	})
+	return response, err
+}
+
+func (c *Client) GetSnapshot(ctx context.Context, request *api.GetSnapshotRequest) (*api.GetSnapshotResponse, error) {
+	var response *api.GetSnapshotResponse
+	err := c.invoke(ctx, func(ctx context.Context, server api.DeDBClient) (err error) {
+		response, err = server.GetSnapshot(ctx, request)
+		return err
+	})
+	return response, err
+}
+
+func (c *Client) RegisterSchema(ctx context.Context, request *api.RegisterSchemaRequest) (*api.RegisterSchemaResponse, error) {
+	var response *api.RegisterSchemaResponse
+	err := c.invoke(ctx, func(ctx context.Context, server api.DeDBClient) (err error) {
+		response, err = server.RegisterSchema(ctx, request)
+		return err
+	})
+	return response, err
+}
+
+func (c *Client) GetSchema(ctx context.Context, request *api.GetSchemaRequest) (*api.GetSchemaResponse, error) {
+	var response *api.GetSchemaResponse
+	err := c.invoke(ctx, func(ctx context.Context, server api.DeDBClient) (err error) {
+		response, err = server.GetSchema(ctx, request)
+		return err
+	})
+	return response, err
 }
 
+func (c *Client) ListSchemas(ctx context.Context, request *api.ListSchemasRequest) (*api.ListSchemasResponse, error) {
+	var response *api.ListSchemasResponse
+	err := c.invoke(ctx, func(ctx context.Context, server api.DeDBClient) (err error) {
+		response, err = server.ListSchemas(ctx, request)
+		return err
+	})
+	return response, err
+}
+
+/*
+SubscribeFrom opens a stream of the stored events after the requested position, then the
+live ones. Unlike the consumer group subscription it is not reconnected, a caller picks up
+after a failure by subscribing again from the position of the last event it got.
+*/
+func (c *Client) SubscribeFrom(ctx context.Context, request *api.SubscribeFromRequest) (api.DeDB_SubscribeFromClient, error) {
+	c.mu.Lock()
+	server := c.server
+	c.mu.Unlock()
+	if server == nil {
+		return nil, fmt.Errorf("client is not connected")
+	}
+	return server.SubscribeFrom(ctx, request)
+}
+
+// invoke runs call with the configured timeout, retrying while the server is unavailable
+func (c *Client) invoke(ctx context.Context, call func(ctx context.Context, server api.DeDBClient) error) error {
+	backoff := c.config.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := c.attempt(ctx, call)
+		if status.Code(err) != codes.Unavailable || attempt >= c.config.MaxRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// attempt makes the call once, against the server currently connected to
+func (c *Client) attempt(ctx context.Context, call func(ctx context.Context, server api.DeDBClient) error) error {
+	c.mu.Lock()
+	server := c.server
+	c.mu.Unlock()
+	if server == nil {
+		return fmt.Errorf("client is not connected")
+	}
+	if c.config.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.RequestTimeout)
+		defer cancel()
+	}
+	return call(ctx, server)
+}
+
+/*
+Connect dials the server and, when an EventChannel is configured, subscribes to the
+configured streams. Events are delivered until Close is called. A failed subscription is
+reconnected with backoff, following the leader when the server is not the leader, and
+picks up where the consumer group left off. Events that were not acked before a reconnect
+are delivered again.
+*/
 func (c *Client) Connect(ctx context.Context) error {
+	conn, err := c.dial(ctx, c.config.Server)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.addr = c.config.Server
+	c.conn = conn
+	c.server = api.NewDeDBClient(conn)
+	c.mu.Unlock()
+
+	if c.config.EventChannel == nil {
+		return nil
+	}
+	subCtx, cancel := context.WithCancel(context.Background())
+	stream, err := c.subscribe(subCtx)
+	if err != nil {
+		cancel()
+		conn.Close()
+		return err
+	}
+	c.cancel = cancel
+	c.done = make(chan struct{})
+	go c.run(subCtx, stream)
+	return nil
+}
+
+func (c *Client) dial(ctx context.Context, addr string) (*grpc.ClientConn, error) {
+	creds := insecure.NewCredentials()
+	if c.config.TLS != nil {
+		creds = credentials.NewTLS(c.config.TLS)
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.config.DialTimeout)
+	defer cancel()
+	options := []grpc.DialOption{grpc.WithTransportCredentials(creds), grpc.WithBlock()}
+	if c.config.APIKey != "" || c.config.Token != "" {
+		options = append(options, grpc.WithPerRPCCredentials(callCredentials{apiKey: c.config.APIKey, token: c.config.Token, plaintext: c.config.AllowPlaintextCredentials}))
+	}
+	conn, err := grpc.DialContext(ctx, addr, options...)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %w", addr, err)
+	}
+	return conn, nil
+}
+
+// callCredentials adds the API key and bearer token to the metadata of each call
+type callCredentials struct {
+	apiKey    string
+	token     string
+	plaintext bool // sent without TLS, see AllowPlaintextCredentials
+}
+
+func (c callCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	md := map[string]string{}
+	if c.apiKey != "" {
+		md["x-api-key"] = c.apiKey
+	}
+	if c.token != "" {
+		md["authorization"] = "Bearer " + c.token
+	}
+	return md, nil
+}
+
+/*
+RequireTransportSecurity keeps the credentials off plaintext connections, unless they were
+allowed for a server behind a TLS terminating proxy, where the hop to the proxy is the one
+that is encrypted.
+*/
+func (c callCredentials) RequireTransportSecurity() bool {
+	return !c.plaintext
+}
+
+// subscribe opens a subscription stream and sends the CONNECT for it
+func (c *Client) subscribe(ctx context.Context) (api.DeDB_SubscribeClient, error) {
+	c.mu.Lock()
+	server := c.server
+	c.mu.Unlock()
+	stream, err := server.Subscribe(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = stream.Send(&api.SubscribeRequest{
+		ConsumerGroup: c.config.ConsumerGroup,
+		RequestType:   api.SubscribeRequest_CONNECT,
+		EventNames:    c.config.EventNames,
+		Domains:       c.config.Streams,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.stream = stream
+	c.mu.Unlock()
+	return stream, nil
+}
+
+// run keeps the subscription going, reconnecting whenever a stream ends, until Close
+func (c *Client) run(ctx context.Context, stream api.DeDB_SubscribeClient) {
+	defer close(c.done)
+	backoff := c.config.RetryBackoff
+	for {
+		leader, err := c.receive(ctx, stream)
+		if ctx.Err() != nil || c.isClosing() {
+			return
+		}
+		if err != nil {
+			c.error(err)
+		}
+		wait := true
+		if leader != "" {
+			err = c.redirect(ctx, leader)
+			if err != nil {
+				c.error(err)
+			} else {
+				wait = false
+			}
+		}
+
+		for {
+			if wait {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				backoff *= 2
+				if backoff > maxRetryBackoff {
+					backoff = maxRetryBackoff
+				}
+			}
+			wait = true
+			stream, err = c.subscribe(ctx)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			c.error(err)
+		}
+		backoff = c.config.RetryBackoff
+	}
+}
+
+/*
+receive delivers the subscribed events until the stream ends. When the server is not the
+leader it returns the leader's address, which the proto sends as the message of a
+FAILED_PRECONDITION error.
+*/
+func (c *Client) receive(ctx context.Context, stream api.DeDB_SubscribeClient) (string, error) {
+	for {
+		response, err := stream.Recv()
+		if err == io.EOF {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if e := response.GetError(); e != nil {
+			if codes.Code(e.Code) == codes.FailedPrecondition && e.Message != "" {
+				return e.Message, nil
+			}
+			c.error(status.ErrorProto(e))
+			continue
+		}
+		event := response.GetEvent()
+		if event == nil {
+			continue
+		}
+		select {
+		case c.config.EventChannel <- event:
+		case <-ctx.Done():
+			return "", nil
+		}
+		if !c.config.ManualAck {
+			err = c.Ack(event)
+			if err != nil {
+				c.error(err)
+			}
+		}
+	}
+}
+
+/*
+redirect switches the connection to the leader. The leader may be sent without a port, in
+which case the port of the current server is used.
+*/
+func (c *Client) redirect(ctx context.Context, leader string) error {
+	c.mu.Lock()
+	current := c.addr
+	c.mu.Unlock()
+	if _, _, err := net.SplitHostPort(leader); err != nil {
+		_, port, err := net.SplitHostPort(current)
+		if err != nil {
+			return fmt.Errorf("invalid leader address %s", leader)
+		}
+		leader = net.JoinHostPort(leader, port)
+	}
+	conn, err := c.dial(ctx, leader)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	old := c.conn
+	c.addr = leader
+	c.conn = conn
+	c.server = api.NewDeDBClient(conn)
+	c.mu.Unlock()
+	old.Close()
 	return nil
 }
 
+func (c *Client) isClosing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closing
+}
+
+// error reports a subscription error without blocking the subscription on it
+func (c *Client) error(err error) {
+	if c.config.ErrorChannel == nil {
+		return
+	}
+	select {
+	case c.config.ErrorChannel <- err:
+	default:
+	}
+}
+
+// Ack tells the server the event was handled, only needed with ManualAck
+func (c *Client) Ack(event *api.Event) error {
+	return c.send(&api.SubscribeRequest{
+		ConsumerGroup: c.config.ConsumerGroup,
+		RequestType:   api.SubscribeRequest_ACK,
+		Domain:        event.Domain,
+		Timestamp:     event.Timestamp,
+		EventId:       event.Id,
+	})
+}
+
+// send serializes sends on the subscription stream, which is not safe for concurrent use
+func (c *Client) send(request *api.SubscribeRequest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stream == nil {
+		return fmt.Errorf("client is not subscribed")
+	}
+	return c.stream.Send(request)
+}
+
+// Close disconnects the subscription, if any, and closes the connection
 func (c *Client) Close() {
+	if c.done != nil {
+		c.mu.Lock()
+		c.closing = true
+		c.mu.Unlock()
+		c.send(&api.SubscribeRequest{
+			ConsumerGroup: c.config.ConsumerGroup,
+			RequestType:   api.SubscribeRequest_DISCONNECT,
+		})
+		c.mu.Lock()
+		c.stream.CloseSend()
+		c.mu.Unlock()
+		select {
+		case <-c.done:
+		case <-time.After(c.config.DialTimeout):
+		}
+		c.cancel()
+		<-c.done
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
 }
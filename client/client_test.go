@@ -0,0 +1,285 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	api "dedb"
+	"dedb/dedbtest"
+)
+
+func TestNewClient(t *testing.T) {
+	events := make(chan *api.Event)
+	cases := []struct {
+		name   string
+		config ClientConfig
+		err    error
+	}{
+		{
+			name:   "Server required",
+			config: ClientConfig{},
+			err:    fmt.Errorf("Server config entry required"),
+		},
+		{
+			name:   "No subscription without an event channel",
+			config: ClientConfig{Server: "localhost:3000"},
+		},
+		{
+			name:   "Subscription needs streams",
+			config: ClientConfig{Server: "localhost:3000", EventChannel: events},
+			err:    fmt.Errorf("Streams config entry needs at least one domain to subscribe to"),
+		},
+		{
+			name:   "Subscription needs event names",
+			config: ClientConfig{Server: "localhost:3000", EventChannel: events, Streams: []string{"CUSTOMER"}},
+			err:    fmt.Errorf("EventNames config entry needs at least one event to subscribe to"),
+		},
+		{
+			name:   "Subscription needs a consumer group",
+			config: ClientConfig{Server: "localhost:3000", EventChannel: events, Streams: []string{"CUSTOMER"}, EventNames: []string{"CustomerCreated"}},
+			err:    fmt.Errorf("ConsumerGroup config entry required"),
+		},
+	}
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewClient(tc.config)
+			if tc.err == nil {
+				assert.Nil(t, err)
+			} else {
+				assert.Equal(t, tc.err.Error(), err.Error())
+			}
+		})
+	}
+}
+
+func TestClient(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	server, err := dedbtest.NewServer()
+	if err != nil {
+		panic(err)
+	}
+	defer server.Close()
+	events := make(chan *api.Event, 10)
+	c, err := NewClient(ClientConfig{
+		Server:        server.Addr,
+		Streams:       []string{"CUSTOMER"},
+		EventNames:    []string{"CustomerCreated"},
+		ConsumerGroup: "test",
+		EventChannel:  events,
+		MaxRetries:    2,
+	})
+	if err != nil {
+		panic(err)
+	}
+	err = c.Connect(ctx)
+	if err != nil {
+		panic(err)
+	}
+	defer c.Close()
+	// the consumer group is joined asynchronously, at the end of the stream
+	time.Sleep(100 * time.Millisecond)
+
+	// when
+	request := &api.SaveRequest{
+		Events: []*api.Event{
+			{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "testid"},
+			{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "testid"},
+		},
+	}
+	saved, err := c.Save(ctx, request)
+
+	// then
+	assert.Nil(t, err)
+	assert.Empty(t, request.IdempotencyKey)
+	assert.Equal(t, int64(2), saved.Version)
+	response, err := c.GetDomain(ctx, &api.GetDomainRequest{Domain: "CUSTOMER", DomainId: "testid"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(response.Events))
+	ids, err := c.GetDomainIds(ctx, &api.GetDomainIdsRequest{Domain: "CUSTOMER"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"testid"}, ids.DomainIds)
+
+	select {
+	case e := <-events:
+		assert.Equal(t, saved.Events[0].Id, e.Id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscribed event was not delivered")
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("unsubscribed event %s was delivered", e.Name)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestClientNotConnected(t *testing.T) {
+	c, _ := NewClient(ClientConfig{Server: "localhost:3000"})
+	_, err := c.GetDomain(context.Background(), &api.GetDomainRequest{})
+	assert.Equal(t, "client is not connected", err.Error())
+}
+
+func TestClientReconnects(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	server, err := dedbtest.NewServer()
+	if err != nil {
+		panic(err)
+	}
+	events := make(chan *api.Event, 10)
+	c, _ := NewClient(ClientConfig{
+		Server:        server.Addr,
+		Streams:       []string{"CUSTOMER"},
+		EventNames:    []string{"CustomerCreated"},
+		ConsumerGroup: "test",
+		EventChannel:  events,
+		RetryBackoff:  10 * time.Millisecond,
+	})
+	err = c.Connect(ctx)
+	if err != nil {
+		panic(err)
+	}
+	defer c.Close()
+
+	// when the server goes away and comes back
+	server.Close()
+	server, err = dedbtest.NewServerAt(server.Addr)
+	if err != nil {
+		panic(err)
+	}
+	defer server.Close()
+
+	// then the subscription picks up events saved on it
+	deadline := time.After(5 * time.Second)
+	for {
+		_, err = c.Save(ctx, &api.SaveRequest{
+			Events: []*api.Event{{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "testid"}},
+		})
+		if err == nil {
+			select {
+			case e := <-events:
+				assert.Equal(t, "testid", e.DomainId)
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+		select {
+		case <-deadline:
+			t.Fatal("subscription did not reconnect")
+		default:
+		}
+	}
+}
+
+// followerServer answers every subscription with a redirect to the leader
+type followerServer struct {
+	api.UnimplementedDeDBServer
+	leader string
+}
+
+func (f *followerServer) Subscribe(src api.DeDB_SubscribeServer) error {
+	return src.Send(&api.SubscribeResponse{
+		Message: &api.SubscribeResponse_Error{
+			Error: status.New(codes.FailedPrecondition, f.leader).Proto(),
+		},
+	})
+}
+
+func TestClientFollowsLeader(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	leader, err := dedbtest.NewServer()
+	if err != nil {
+		panic(err)
+	}
+	defer leader.Close()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	follower := grpc.NewServer()
+	api.RegisterDeDBServer(follower, &followerServer{leader: leader.Addr})
+	go follower.Serve(lis)
+	defer follower.Stop()
+
+	events := make(chan *api.Event, 10)
+	c, _ := NewClient(ClientConfig{
+		Server:        lis.Addr().String(),
+		Streams:       []string{"CUSTOMER"},
+		EventNames:    []string{"CustomerCreated"},
+		ConsumerGroup: "test",
+		EventChannel:  events,
+	})
+	err = c.Connect(ctx)
+	if err != nil {
+		panic(err)
+	}
+	defer c.Close()
+
+	// when / then, saves fail on the follower until the client was redirected
+	deadline := time.After(5 * time.Second)
+	for {
+		_, err = c.Save(ctx, &api.SaveRequest{
+			Events: []*api.Event{{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "testid"}},
+		})
+		if err == nil {
+			select {
+			case e := <-events:
+				assert.Equal(t, "testid", e.DomainId)
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+		select {
+		case <-deadline:
+			t.Fatal("client did not follow the leader")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestClientCredentials(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	received := make(chan metadata.MD, 1)
+	server := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		received <- md
+		return nil, status.Error(codes.Unauthenticated, "checked")
+	}))
+	api.RegisterDeDBServer(server, &followerServer{})
+	go server.Serve(lis)
+	defer server.Stop()
+	_, err = NewClient(ClientConfig{Server: lis.Addr().String(), APIKey: "secret", Token: "token"})
+	assert.NotNil(t, err)
+	c, _ := NewClient(ClientConfig{Server: lis.Addr().String(), APIKey: "secret", Token: "token", AllowPlaintextCredentials: true})
+	err = c.Connect(ctx)
+	if err != nil {
+		panic(err)
+	}
+	defer c.Close()
+
+	// when
+	_, err = c.Save(ctx, &api.SaveRequest{})
+
+	// then
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	md := <-received
+	assert.Equal(t, []string{"secret"}, md.Get("x-api-key"))
+	assert.Equal(t, []string{"Bearer token"}, md.Get("authorization"))
+}
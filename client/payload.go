@@ -0,0 +1,104 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	api "dedb"
+)
+
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/protobuf"
+	anyTypeUrlPrefix    = "type.googleapis.com/"
+)
+
+// NewJSONEvent returns a named event with v encoded as its json payload
+func NewJSONEvent(name string, v interface{}) (*api.Event, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &api.Event{Name: name, ContentType: ContentTypeJSON, Data: data}, nil
+}
+
+// NewProtoEvent returns a named event with m as its payload, the message name is its schema
+func NewProtoEvent(name string, m proto.Message) (*api.Event, error) {
+	data, err := proto.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return &api.Event{
+		Name:        name,
+		ContentType: ContentTypeProtobuf,
+		Schema:      string(m.ProtoReflect().Descriptor().FullName()),
+		Data:        data,
+	}, nil
+}
+
+// NewAnyEvent returns a named event with the message packed in a as its payload
+func NewAnyEvent(name string, a *anypb.Any) *api.Event {
+	return &api.Event{
+		Name:        name,
+		ContentType: ContentTypeProtobuf,
+		Schema:      string(a.MessageName()),
+		Data:        a.Value,
+	}
+}
+
+// DecodeJSON decodes the json payload of the event into v
+func DecodeJSON(e *api.Event, v interface{}) error {
+	if e.ContentType != ContentTypeJSON {
+		return fmt.Errorf("%s event %s has %s data, not json", e.Name, e.Id, contentType(e))
+	}
+	return json.Unmarshal(e.Data, v)
+}
+
+// DecodeProto decodes the protobuf payload of the event into m, which must be of its schema
+func DecodeProto(e *api.Event, m proto.Message) error {
+	if e.ContentType != ContentTypeProtobuf {
+		return fmt.Errorf("%s event %s has %s data, not protobuf", e.Name, e.Id, contentType(e))
+	}
+	name := string(m.ProtoReflect().Descriptor().FullName())
+	if e.Schema != name {
+		return fmt.Errorf("%s event %s holds a %s, not a %s", e.Name, e.Id, e.Schema, name)
+	}
+	return proto.Unmarshal(e.Data, m)
+}
+
+// DecodeMessage decodes the protobuf payload of the event as the registered message of its schema
+func DecodeMessage(e *api.Event) (proto.Message, error) {
+	if e.ContentType != ContentTypeProtobuf {
+		return nil, fmt.Errorf("%s event %s has %s data, not protobuf", e.Name, e.Id, contentType(e))
+	}
+	mt, err := protoregistry.GlobalTypes.FindMessageByName(protoreflect.FullName(e.Schema))
+	if err != nil {
+		return nil, fmt.Errorf("%s event %s holds an unknown message %s: %w", e.Name, e.Id, e.Schema, err)
+	}
+	m := mt.New().Interface()
+	err = proto.Unmarshal(e.Data, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ToAny returns the protobuf payload of the event as an Any
+func ToAny(e *api.Event) (*anypb.Any, error) {
+	if e.ContentType != ContentTypeProtobuf || e.Schema == "" {
+		return nil, fmt.Errorf("%s event %s has %s data, not protobuf", e.Name, e.Id, contentType(e))
+	}
+	return &anypb.Any{TypeUrl: anyTypeUrlPrefix + e.Schema, Value: e.Data}, nil
+}
+
+func contentType(e *api.Event) string {
+	if e.ContentType == "" {
+		return "opaque"
+	}
+	return e.ContentType
+}
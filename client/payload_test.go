@@ -0,0 +1,54 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestJSONPayload(t *testing.T) {
+	// setup
+	type customer struct {
+		Name string `json:"name"`
+	}
+
+	// when
+	e, err := NewJSONEvent("CustomerCreated", customer{Name: "test"})
+	assert.Nil(t, err)
+	decoded := customer{}
+	err = DecodeJSON(e, &decoded)
+
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, "application/json", e.ContentType)
+	assert.Equal(t, "test", decoded.Name)
+	assert.NotNil(t, DecodeProto(e, &wrapperspb.StringValue{}))
+}
+
+func TestProtoPayload(t *testing.T) {
+	// when
+	e, err := NewProtoEvent("CustomerCreated", wrapperspb.String("test"))
+	assert.Nil(t, err)
+
+	// then
+	assert.Equal(t, "application/protobuf", e.ContentType)
+	assert.Equal(t, "google.protobuf.StringValue", e.Schema)
+
+	decoded := &wrapperspb.StringValue{}
+	assert.Nil(t, DecodeProto(e, decoded))
+	assert.Equal(t, "test", decoded.Value)
+	assert.NotNil(t, DecodeProto(e, &wrapperspb.Int64Value{}))
+
+	m, err := DecodeMessage(e)
+	assert.Nil(t, err)
+	assert.True(t, proto.Equal(wrapperspb.String("test"), m))
+
+	a, err := ToAny(e)
+	assert.Nil(t, err)
+	assert.Equal(t, "type.googleapis.com/google.protobuf.StringValue", a.TypeUrl)
+	packed, _ := anypb.New(wrapperspb.String("test"))
+	assert.Equal(t, e.String(), NewAnyEvent("CustomerCreated", packed).String())
+}
@@ -37,22 +37,26 @@ func main() {
 	// Setup the service and grpc server
 	log := log.With().Str("logger", "dedb").Logger()
 
+	config := internal.Config{}
+	err := envconfig.Process("", &config)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to process config")
+	}
+
 	g, ctx := errgroup.WithContext(ctx)
-	grpcServer := createGrpcServer()
+	grpcServer, err := createGrpcServer(config.ServerConfig)
+	if err != nil {
+		log.Error().Err(err).Msg("could not create the GRPC server")
+		os.Exit(2)
+	}
 
 	service := &internal.Service{}
 	g.Go(func() error {
-		config := internal.Config{}
-		err := envconfig.Process("", &config)
-		if err != nil {
-			log.Error().Err(err).Msg("failed to process config")
-		}
-
 		log.Info().Msg("registering services with GRPC server")
 		api.RegisterDeDBServer(grpcServer, service)
 
 		log.Info().Msgf("starting service at: %s", config.ServiceGrpcPort)
-		err = service.Start(config)
+		err := service.Start(config)
 		if err != nil {
 			log.Error().Err(err).Msg("could not start service")
 			return err
@@ -101,16 +105,34 @@ func main() {
 	}
 }
 
-func createGrpcServer(interceptors ...grpc.UnaryServerInterceptor) *grpc.Server {
-	s := grpc.NewServer(
+func createGrpcServer(config internal.ServerConfig, interceptors ...grpc.UnaryServerInterceptor) (*grpc.Server, error) {
+	streamInterceptors := []grpc.StreamServerInterceptor{}
+	authenticator, err := internal.NewAuthenticator(config)
+	if err != nil {
+		return nil, err
+	}
+	if authenticator != nil {
+		interceptors = append([]grpc.UnaryServerInterceptor{internal.UnaryAuthInterceptor(authenticator)}, interceptors...)
+		streamInterceptors = append(streamInterceptors, internal.StreamAuthInterceptor(authenticator))
+	}
+	options := []grpc.ServerOption{
 		grpc.UnaryInterceptor(
 			grpc_middleware.ChainUnaryServer(
 				interceptors...,
 			),
 		),
 		grpc.StreamInterceptor(
-			grpc_middleware.ChainStreamServer(),
+			grpc_middleware.ChainStreamServer(
+				streamInterceptors...,
+			),
 		),
-	)
-	return s
+	}
+	creds, err := internal.NewServerCredentials(config)
+	if err != nil {
+		return nil, err
+	}
+	if creds != nil {
+		options = append(options, grpc.Creds(creds))
+	}
+	return grpc.NewServer(options...), nil
 }
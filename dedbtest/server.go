@@ -0,0 +1,56 @@
+/*
+Package dedbtest runs a DeDB server in process, backed by the memory repository and
+broker, so services using DeDB can unit test against the real gRPC api without Redis.
+*/
+package dedbtest
+
+import (
+	"net"
+
+	"google.golang.org/grpc"
+
+	api "dedb"
+	"dedb/internal"
+)
+
+type Server struct {
+	Addr    string // host:port the server listens on
+	service *internal.Service
+	server  *grpc.Server
+}
+
+// NewServer starts a server on a random local port, it must be closed when done
+func NewServer() (*Server, error) {
+	return NewServerAt("127.0.0.1:0")
+}
+
+// NewServerAt starts a server listening on addr, it must be closed when done
+func NewServerAt(addr string) (*Server, error) {
+	service := &internal.Service{}
+	err := service.Start(internal.Config{
+		RepoImpl:   "memory",
+		BrokerImpl: "memory",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		service.Shutdown()
+		return nil, err
+	}
+	s := &Server{
+		Addr:    lis.Addr().String(),
+		service: service,
+		server:  grpc.NewServer(),
+	}
+	api.RegisterDeDBServer(s.server, service)
+	go s.server.Serve(lis)
+	return s, nil
+}
+
+func (s *Server) Close() {
+	s.server.Stop()
+	s.service.Shutdown()
+}
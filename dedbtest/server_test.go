@@ -0,0 +1,40 @@
+package dedbtest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	api "dedb"
+)
+
+func TestServer(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	server, err := NewServer()
+	if err != nil {
+		panic(err)
+	}
+	defer server.Close()
+	conn, err := grpc.Dial(server.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+	client := api.NewDeDBClient(conn)
+
+	// when
+	_, err = client.Save(ctx, &api.SaveRequest{
+		Events: []*api.Event{{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "testid"}},
+	})
+	assert.Nil(t, err)
+	response, err := client.GetDomain(ctx, &api.GetDomainRequest{Domain: "CUSTOMER", DomainId: "testid"})
+
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(response.Events))
+	assert.Equal(t, int64(1), response.Events[0].Version)
+}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const apiKeyHeader = "x-api-key"
+
+// Principal is who a call was made by, as established by an Authenticator
+type Principal struct {
+	Name   string
+	Method string // how the principal was authenticated, api-key, jwt or certificate
+}
+
+type principalKey struct{}
+
+// PrincipalFrom returns the principal the call was authenticated as, nil when there was no authentication
+func PrincipalFrom(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
+
+func withPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+/*
+Authenticator establishes who made a call from its metadata or connection. It returns a
+nil principal without an error when the call does not carry its kind of credentials, so
+the next one can be tried, and an Unauthenticated error when they are there but invalid.
+*/
+type Authenticator interface {
+	Authenticate(ctx context.Context) (*Principal, error)
+}
+
+// AuthenticatorFunc lets a plain function be used as an Authenticator
+type AuthenticatorFunc func(ctx context.Context) (*Principal, error)
+
+func (f AuthenticatorFunc) Authenticate(ctx context.Context) (*Principal, error) {
+	return f(ctx)
+}
+
+// authenticators tries each authenticator in turn, the call is rejected when none applies
+type authenticators []Authenticator
+
+func (a authenticators) Authenticate(ctx context.Context) (*Principal, error) {
+	for _, authenticator := range a {
+		principal, err := authenticator.Authenticate(ctx)
+		if err != nil || principal != nil {
+			return principal, err
+		}
+	}
+	return nil, status.Error(codes.Unauthenticated, "no credentials were supplied")
+}
+
+/*
+NewAuthenticator builds the authenticators enabled by the config, API keys first, then
+bearer tokens, then client certificates. It returns nil when none is, leaving the server
+open to anyone that can reach it.
+*/
+func NewAuthenticator(config ServerConfig) (Authenticator, error) {
+	chain := authenticators{}
+	if len(config.APIKeys) > 0 {
+		keys, err := newAPIKeys(config.APIKeys)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, keys)
+	}
+	if config.JWKSFile != "" {
+		tokens, err := newJWTAuthenticator(config)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, tokens)
+	}
+	if config.ClientCa != "" {
+		chain = append(chain, AuthenticatorFunc(certificatePrincipal))
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	return chain, nil
+}
+
+// apiKeys maps the sha256 of each key to its principal, so keys are not kept in memory as is
+type apiKeys map[[sha256.Size]byte]string
+
+func newAPIKeys(pairs []string) (apiKeys, error) {
+	keys := make(apiKeys)
+	for _, pair := range pairs {
+		split := strings.Index(pair, ":")
+		if split < 1 || split == len(pair)-1 {
+			return nil, fmt.Errorf("AUTH_API_KEYS entries must be principal:key")
+		}
+		keys[sha256.Sum256([]byte(pair[split+1:]))] = pair[:split]
+	}
+	return keys, nil
+}
+
+func (k apiKeys) Authenticate(ctx context.Context) (*Principal, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(apiKeyHeader)
+	if len(values) == 0 {
+		return nil, nil
+	}
+	name, ok := k[sha256.Sum256([]byte(values[0]))]
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "the api key is not valid")
+	}
+	return &Principal{Name: name, Method: "api-key"}, nil
+}
+
+// certificatePrincipal names the principal after the common name of the verified client certificate
+func certificatePrincipal(ctx context.Context) (*Principal, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+	return &Principal{Name: info.State.VerifiedChains[0][0].Subject.CommonName, Method: "certificate"}, nil
+}
+
+// UnaryAuthInterceptor authenticates each call, making the principal available to the service with PrincipalFrom
+func UnaryAuthInterceptor(authenticator Authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		principal, err := authenticator.Authenticate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return handler(withPrincipal(ctx, principal), req)
+	}
+}
+
+// StreamAuthInterceptor authenticates each stream once, when it is opened
+func StreamAuthInterceptor(authenticator Authenticator) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		principal, err := authenticator.Authenticate(stream.Context())
+		if err != nil {
+			return err
+		}
+		wrapped := grpc_middleware.WrapServerStream(stream)
+		wrapped.WrappedContext = withPrincipal(stream.Context(), principal)
+		return handler(srv, wrapped)
+	}
+}
@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"dedb"
+)
+
+func TestAuthenticator(t *testing.T) {
+	// setup
+	signingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwksFile := testJWKS(t, map[string]*ecdsa.PublicKey{"first": &signingKey.PublicKey})
+	authenticator, err := NewAuthenticator(ServerConfig{
+		APIKeys:     []string{"billing:secret-one", "orders:secret-two"},
+		JWKSFile:    jwksFile,
+		JWTIssuer:   "https://issuer",
+		JWTAudience: "dedb",
+	})
+	assert.Nil(t, err)
+	valid := jwt.MapClaims{"sub": "shipping", "iss": "https://issuer", "aud": "dedb", "exp": time.Now().Add(time.Minute).Unix()}
+	cases := []struct {
+		name      string
+		md        metadata.MD
+		principal string
+		code      codes.Code
+	}{
+		{name: "API key", md: metadata.Pairs("x-api-key", "secret-two"), principal: "orders"},
+		{name: "Unknown API key", md: metadata.Pairs("x-api-key", "secret-three"), code: codes.Unauthenticated},
+		{name: "Bearer token", md: metadata.Pairs("authorization", "Bearer "+testToken(t, signingKey, "first", valid)), principal: "shipping"},
+		{name: "Token without a kid", md: metadata.Pairs("authorization", "Bearer "+testToken(t, signingKey, "", valid)), principal: "shipping"},
+		{name: "Token signed by another key", md: metadata.Pairs("authorization", "Bearer "+testToken(t, otherKey, "first", valid)), code: codes.Unauthenticated},
+		{name: "Expired token", md: metadata.Pairs("authorization", "Bearer "+testToken(t, signingKey, "first", jwt.MapClaims{"sub": "shipping", "iss": "https://issuer", "aud": "dedb", "exp": time.Now().Add(-time.Minute).Unix()})), code: codes.Unauthenticated},
+		{name: "Token for another audience", md: metadata.Pairs("authorization", "Bearer "+testToken(t, signingKey, "first", jwt.MapClaims{"sub": "shipping", "iss": "https://issuer", "aud": "other", "exp": time.Now().Add(time.Minute).Unix()})), code: codes.Unauthenticated},
+		{name: "No credentials", md: metadata.MD{}, code: codes.Unauthenticated},
+	}
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), tc.md)
+			var principal *Principal
+			_, err := UnaryAuthInterceptor(authenticator)(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+				principal = PrincipalFrom(ctx)
+				return nil, nil
+			})
+			assert.Equal(t, tc.code, status.Code(err))
+			if tc.principal != "" {
+				assert.Equal(t, tc.principal, principal.Name)
+			}
+		})
+	}
+
+	t.Run("Rotated keys are picked up", func(t *testing.T) {
+		rotated, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		data, _ := os.ReadFile(testJWKS(t, map[string]*ecdsa.PublicKey{"first": &signingKey.PublicKey, "second": &rotated.PublicKey}))
+		assert.Nil(t, os.WriteFile(jwksFile, data, 0600))
+		later := time.Now().Add(time.Minute)
+		assert.Nil(t, os.Chtimes(jwksFile, later, later))
+		time.Sleep(time.Second)
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+testToken(t, rotated, "second", valid)))
+		principal, err := authenticator.Authenticate(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, "shipping", principal.Name)
+	})
+
+	t.Run("Nothing configured", func(t *testing.T) {
+		authenticator, err := NewAuthenticator(ServerConfig{})
+		assert.Nil(t, err)
+		assert.Nil(t, authenticator)
+		_, err = NewAuthenticator(ServerConfig{APIKeys: []string{"no-principal"}})
+		assert.NotNil(t, err)
+	})
+}
+
+func TestServerTLS(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	ca, caKey := testCertificate(t, nil, nil, x509.ExtKeyUsageAny)
+	serverCert, serverKey := testCertificate(t, ca, caKey, x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := testCertificate(t, ca, caKey, x509.ExtKeyUsageClientAuth)
+	config := ServerConfig{
+		TLSCert:  string(testPEM("CERTIFICATE", serverCert.Raw)),
+		TLSKey:   string(testPEM("EC PRIVATE KEY", testMarshalKey(t, serverKey))),
+		ClientCa: string(testPEM("CERTIFICATE", ca.Raw)),
+		APIKeys:  []string{"orders:secret"},
+	}
+	creds, err := NewServerCredentials(config)
+	assert.Nil(t, err)
+	authenticator, err := NewAuthenticator(config)
+	assert.Nil(t, err)
+	service := &Service{}
+	err = service.Start(Config{RepoImpl: "memory", BrokerImpl: "memory"})
+	assert.Nil(t, err)
+	defer service.Shutdown()
+	server := grpc.NewServer(grpc.Creds(creds), grpc.UnaryInterceptor(UnaryAuthInterceptor(authenticator)), grpc.StreamInterceptor(StreamAuthInterceptor(authenticator)))
+	dedb.RegisterDeDBServer(server, service)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go server.Serve(lis)
+	defer server.Stop()
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	pair := tls.Certificate{Certificate: [][]byte{clientCert.Raw}, PrivateKey: clientKey}
+	dial := func(tlscfg *tls.Config) dedb.DeDBClient {
+		conn, err := grpc.Dial("localhost:"+port, grpc.WithTransportCredentials(credentials.NewTLS(tlscfg)))
+		assert.Nil(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return dedb.NewDeDBClient(conn)
+	}
+	request := &dedb.SaveRequest{Events: []*dedb.Event{{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "tlsid"}}}
+
+	// when / then
+	t.Run("Client certificate and API key", func(t *testing.T) {
+		client := dial(&tls.Config{RootCAs: roots, Certificates: []tls.Certificate{pair}})
+		_, err := client.Save(metadata.AppendToOutgoingContext(ctx, "x-api-key", "secret"), request)
+		assert.Nil(t, err)
+	})
+	t.Run("Client certificate alone", func(t *testing.T) {
+		client := dial(&tls.Config{RootCAs: roots, Certificates: []tls.Certificate{pair}})
+		_, err := client.GetDomainIds(ctx, &dedb.GetDomainIdsRequest{Domain: "CUSTOMER"})
+		assert.Nil(t, err)
+	})
+	t.Run("Bad API key on a stream", func(t *testing.T) {
+		client := dial(&tls.Config{RootCAs: roots, Certificates: []tls.Certificate{pair}})
+		stream, err := client.Subscribe(metadata.AppendToOutgoingContext(ctx, "x-api-key", "wrong"))
+		assert.Nil(t, err)
+		_, err = stream.Recv()
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+	t.Run("No client certificate", func(t *testing.T) {
+		client := dial(&tls.Config{RootCAs: roots})
+		_, err := client.Save(metadata.AppendToOutgoingContext(ctx, "x-api-key", "secret"), request)
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	})
+}
+
+// testJWKS writes the keys to a JWKS file, returning its path
+func testJWKS(t *testing.T, keys map[string]*ecdsa.PublicKey) string {
+	set := map[string][]map[string]string{"keys": {}}
+	for kid, key := range keys {
+		set["keys"] = append(set["keys"], map[string]string{
+			"kid": kid,
+			"kty": "EC",
+			"crv": "P-256",
+			"use": "sig",
+			"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		})
+	}
+	data, err := json.Marshal(set)
+	assert.Nil(t, err)
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	assert.Nil(t, os.WriteFile(file, data, 0600))
+	return file
+}
+
+func testToken(t *testing.T, key *ecdsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	assert.Nil(t, err)
+	return signed
+}
@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "dedb"
+)
+
+const catchUpBatch = 500 // events read from the repository at a time while catching up
+
+/*
+catchUp sends the stored events after a position and then the live ones, for rebuilding
+projections. It joins a consumer group of its own before reading anything, so every event
+saved while the stored ones are sent is waiting in the group once they are done. Live
+messages are only used to learn how far the events go: the events themselves are read
+from the repository after the last position sent, which keeps them in position order
+with no gap and no duplicate at the handover, whatever order the broker delivers them in.
+*/
+type catchUp struct {
+	log     zerolog.Logger
+	repo    repository
+	sub     subscriber
+	upcasts *upcasterChain
+	src     api.DeDB_SubscribeFromServer
+
+	filter   eventFilter
+	since    int64 // events saved before this timestamp are skipped
+	last     int64 // position of the last event gone through
+	group    string
+	consumer string
+	domains  []string
+}
+
+func newCatchUp(repo repository, sub subscriber, upcasts *upcasterChain, src api.DeDB_SubscribeFromServer, r *api.SubscribeFromRequest, log zerolog.Logger) (*catchUp, error) {
+	if r.FromPosition < 0 || r.FromTimestamp < 0 {
+		return nil, status.Error(codes.InvalidArgument, "from position and timestamp can not be negative")
+	}
+	id, err := generateId()
+	if err != nil {
+		return nil, err
+	}
+	c := &catchUp{
+		repo:    repo,
+		sub:     sub,
+		upcasts: upcasts,
+		src:     src,
+		filter:  newEventFilter(r.Domain, r.EventNames),
+		since:   r.FromTimestamp,
+		last:    r.FromPosition,
+		group:   "catchup-" + id.String(),
+		domains: []string{allDomains},
+	}
+	c.consumer = c.group
+	if r.Domain != "" {
+		c.domains = []string{r.Domain}
+	}
+	c.log = log.With().Str("consumer", c.consumer).Logger()
+	return c, nil
+}
+
+func (c *catchUp) run(ctx context.Context) error {
+	for _, domain := range c.domains {
+		err := c.sub.join(ctx, c.group, domain)
+		if err != nil {
+			return status.Errorf(codes.Internal, "could not join consumer group %s", c.group)
+		}
+	}
+	defer c.drop()
+
+	err := c.replay(ctx, 0)
+	if err != nil {
+		return err
+	}
+	c.log.Debug().Msgf("caught up at position %d", c.last)
+	err = c.src.Send(&api.SubscribeFromResponse{Message: &api.SubscribeFromResponse_CaughtUp{CaughtUp: true}})
+	if err != nil {
+		return err
+	}
+
+	for ctx.Err() == nil {
+		messages, err := c.sub.read(ctx, c.group, c.consumer, c.domains)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			c.log.Error().Err(err).Msg("could not read from the broker")
+			return status.Error(codes.Unavailable, "could not read from the broker")
+		}
+		until := c.last
+		for _, m := range messages {
+			err = c.sub.ack(ctx, c.group, m.domain, m.id)
+			if err != nil {
+				c.log.Error().Err(err).Msgf("could not ack message %s", m.id)
+			}
+			if m.event != nil && m.event.Position > until {
+				until = m.event.Position
+			}
+		}
+		if until > c.last {
+			err = c.replay(ctx, until)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+replay sends the stored events after the last position gone through, until the position
+is reached or, when it is 0, there are no more.
+*/
+func (c *catchUp) replay(ctx context.Context, until int64) error {
+	for {
+		events, next, err := c.repo.readAll(ctx, c.last, catchUpBatch, c.filter)
+		if err != nil {
+			return err
+		}
+		events, err = c.upcasts.upcast(events)
+		if err != nil {
+			return err
+		}
+		for _, e := range events {
+			if e.Timestamp < c.since {
+				continue
+			}
+			err = c.src.Send(&api.SubscribeFromResponse{Message: &api.SubscribeFromResponse_Event{Event: e}})
+			if err != nil {
+				c.log.Error().Err(err).Msg("could not send event to client")
+				return err
+			}
+		}
+		if next <= c.last {
+			return nil
+		}
+		c.last = next
+		if until > 0 && c.last >= until {
+			return nil
+		}
+	}
+}
+
+// drop removes the group, with its own context as the stream's is usually gone by now
+func (c *catchUp) drop() {
+	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+	err := c.sub.drop(ctx, c.group, c.domains)
+	if err != nil {
+		c.log.Error().Err(err).Msg("could not drop consumer group")
+	}
+}
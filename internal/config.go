@@ -7,11 +7,40 @@ type RedisDbConfig struct {
 	RedisCa       string `envconfig:"REDIS_DB_CA"`
 	RedisUserCert string `envconfig:"REDIS_DB_USER_CERT"`
 	RedisUserKey  string `envconfig:"REDIS_DB_USER_KEY"`
+	TLS           bool   `envconfig:"REDIS_DB_TLS"`         // connect over TLS, on as well when a CA or client cert is set
+	ServerName    string `envconfig:"REDIS_DB_SERVER_NAME"` // name the server certificate is verified against, defaults to the host
 	Index         string `envconfig:"REDIS_DB_INDEX"`
 	MinIdle       int    `envconfig:"REDIS_DB_MINIDLE"`
 	MaxActive     int    `envconfig:"REDIS_DB_MAXACTIVE"`
 	IdleTimeout   int64  `envconfig:"REDIS_DB_IDLE_TIMEOUT"`
 	DbIndex       int    `envconfig:"REDIS_DB_INDEX"`
+
+	Shards         int      `envconfig:"REDIS_DB_SHARDS"`          // number of shards domain ids are spread over, defaults to 1, or 16 in cluster mode
+	ShardAddresses []string `envconfig:"REDIS_DB_SHARD_ADDRESSES"` // instances the shards are spread over, defaults to REDIS_DB_ADDRESS
+	HashTags       bool     `envconfig:"REDIS_DB_HASH_TAGS"`       // keep the keys of a shard in one Redis Cluster slot, always on in cluster mode
+
+	Mode             string   `envconfig:"REDIS_DB_MODE"`              // standalone, sentinel or cluster, defaults to standalone
+	Addresses        []string `envconfig:"REDIS_DB_ADDRESSES"`         // cluster nodes or sentinels, defaults to REDIS_DB_ADDRESS
+	MasterName       string   `envconfig:"REDIS_DB_MASTER_NAME"`       // name of the master the sentinels watch
+	SentinelPassword string   `envconfig:"REDIS_DB_SENTINEL_PASSWORD"` // password of the sentinels, if they have their own
+}
+
+const (
+	redisStandalone = "standalone"
+	redisSentinel   = "sentinel"
+	redisCluster    = "cluster"
+)
+
+func (c RedisDbConfig) cluster() bool {
+	return c.Mode == redisCluster
+}
+
+// addresses are the cluster nodes or sentinels to connect to
+func (c RedisDbConfig) addresses() []string {
+	if len(c.Addresses) > 0 {
+		return c.Addresses
+	}
+	return []string{c.DbAddress}
 }
 
 type RedisSearchConfig struct {
@@ -21,6 +50,8 @@ type RedisSearchConfig struct {
 	RedisCa       string `envconfig:"REDIS_SEARCH_CA"`
 	RedisUserCert string `envconfig:"REDIS_SEARCH_USER_CERT"`
 	RedisUserKey  string `envconfig:"REDIS_SEARCH_USER_KEY"`
+	TLS           bool   `envconfig:"REDIS_SEARCH_TLS"`
+	ServerName    string `envconfig:"REDIS_SEARCH_SERVER_NAME"`
 	Index         string `envconfig:"REDIS_SEARCH_INDEX"`
 	MinIdle       int    `envconfig:"REDIS_SEARCH_MINIDLE"`
 	MaxActive     int    `envconfig:"REDIS_SEARCH_MAXACTIVE"`
@@ -31,13 +62,36 @@ type RedisSearchConfig struct {
 type Config struct {
 	RedisDbConfig     RedisDbConfig
 	SqliteDbConfig    SqliteDbConfig
+	PostgresDbConfig  PostgresDbConfig
 	RedisSearchConfig RedisSearchConfig
+	ServerConfig      ServerConfig
 	RepoImpl          string `envconfig:"REPO_IMPL" required:"true"`
 	BrokerImpl        string `envconfig:"BROKER_IMPL" required:"true"`
 	UseRedisSearch    string `envconfig:"USE_REDIS_SEARCH"`
 	ServiceGrpcPort   string `envconfig:"SERVICE_PORT" required:"true"`
+	DedupWindow       int64  `envconfig:"DEDUP_WINDOW"`    // seconds a save is remembered for retries, defaults to a day
+	OutboxInterval    int64  `envconfig:"OUTBOX_INTERVAL"` // milliseconds between outbox polls, defaults to a second
+	UpcastersFile     string `envconfig:"UPCASTERS_FILE"`  // upcasters of JSON payloads registered at start, see upcasterRule
+}
+
+type ServerConfig struct {
+	TLSCert           string   `envconfig:"SERVER_TLS_CERT"`          // PEM or file of the server certificate, the server is plaintext without one
+	TLSKey            string   `envconfig:"SERVER_TLS_KEY"`           // PEM or file of the server key
+	ClientCa          string   `envconfig:"SERVER_CLIENT_CA"`         // clients must present a certificate issued by this CA when set
+	APIKeys           []string `envconfig:"AUTH_API_KEYS"`            // principal:key pairs accepted in the x-api-key header
+	JWKSFile          string   `envconfig:"AUTH_JWKS_FILE"`           // keys bearer tokens are verified with
+	JWTIssuer         string   `envconfig:"AUTH_JWT_ISSUER"`          // issuer bearer tokens must have, any when empty
+	JWTAudience       string   `envconfig:"AUTH_JWT_AUDIENCE"`        // audience bearer tokens must have, any when empty
+	JWTPrincipalClaim string   `envconfig:"AUTH_JWT_PRINCIPAL_CLAIM"` // claim naming the principal, defaults to sub
+	PolicyFile        string   `envconfig:"AUTH_POLICY_FILE"`         // rules of which principals may access which domains, everything is allowed without one
 }
 
 type SqliteDbConfig struct {
 	DbUrl string `envconfig:"SQLITE_DB_URL"`
 }
+
+type PostgresDbConfig struct {
+	DbUrl        string `envconfig:"POSTGRES_DB_URL"`
+	MaxOpenConns int    `envconfig:"POSTGRES_DB_MAX_OPEN_CONNS"`
+	MaxIdleConns int    `envconfig:"POSTGRES_DB_MAX_IDLE_CONNS"`
+}
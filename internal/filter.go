@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"math"
+
+	"dedb"
+)
+
+// eventFilter narrows a read across all events to a domain and a set of event names
+type eventFilter struct {
+	domain string          // all domains when empty
+	names  map[string]bool // all names when empty
+}
+
+func newEventFilter(domain string, names []string) eventFilter {
+	f := eventFilter{domain: domain}
+	if len(names) > 0 {
+		f.names = make(map[string]bool, len(names))
+		for _, name := range names {
+			f.names[name] = true
+		}
+	}
+	return f
+}
+
+func (f eventFilter) matches(e *dedb.Event) bool {
+	if f.domain != "" && e.Domain != f.domain {
+		return false
+	}
+	return len(f.names) == 0 || f.names[e.Name]
+}
+
+// nameList returns the names filtered on, nil when every name matches
+func (f eventFilter) nameList() []string {
+	if len(f.names) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(f.names))
+	for name := range f.names {
+		names = append(names, name)
+	}
+	return names
+}
+
+// timeRangeEnd is the last timestamp of a range, where 0 leaves it open
+func timeRangeEnd(to int64) int64 {
+	if to == 0 {
+		return math.MaxInt64
+	}
+	return to
+}
+
+// reverseEvents puts the events in the opposite order, in place
+func reverseEvents(events []*dedb.Event) {
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+}
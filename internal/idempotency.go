@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"dedb"
+)
+
+const defaultDedupWindow = 24 * time.Hour
+
+/*
+idempotencyKey returns the key a save is deduplicated by. A key supplied with the request
+wins, otherwise a key is derived from the event ids when the client supplied all of them.
+An empty key means the save can not be recognised when retried.
+*/
+func idempotencyKey(request *dedb.SaveRequest) string {
+	if request.IdempotencyKey != "" {
+		return "key:" + request.IdempotencyKey
+	}
+	ids := make([]string, 0, len(request.Events))
+	for _, e := range request.Events {
+		if e.Id == "" {
+			return ""
+		}
+		ids = append(ids, e.Id)
+	}
+	if len(ids) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.Join(ids, "\n")))
+	return "ids:" + hex.EncodeToString(sum[:])
+}
+
+/*
+saveKey is what a save is remembered by to answer its retries. The idempotency key is scoped
+to the principal saving and the domain id of the first event, so callers or domain ids using
+the same key never get each other's results. The hash of the request tells a retry from
+another save reusing the key, which is refused rather than answered with the wrong result.
+*/
+type saveKey struct {
+	key  string // empty when the save can not be recognised when retried
+	hash string // of the events and expected version of the request, as sent
+}
+
+// newSaveKey has to be called before anything is assigned to the events of the request
+func newSaveKey(ctx context.Context, request *dedb.SaveRequest) (saveKey, error) {
+	key := idempotencyKey(request)
+	if key == "" {
+		return saveKey{}, nil
+	}
+	principal := ""
+	if p := PrincipalFrom(ctx); p != nil {
+		principal = p.Method + ":" + p.Name
+	}
+	first := request.Events[0]
+	request = &dedb.SaveRequest{Events: request.Events, ExpectedVersion: request.ExpectedVersion}
+	encoded, err := proto.MarshalOptions{Deterministic: true}.Marshal(request)
+	if err != nil {
+		return saveKey{}, err
+	}
+	return saveKey{
+		key:  hashOf(principal, first.Domain, first.DomainId, key),
+		hash: hashOf(string(encoded)),
+	}, nil
+}
+
+// hashOf is the hex sha256 of the values, each prefixed with its length so they can not run into each other
+func hashOf(values ...string) string {
+	h := sha256.New()
+	for _, v := range values {
+		h.Write([]byte(strconv.Itoa(len(v)) + ":" + v))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// keyReused is the error of a save reusing the idempotency key of a different one
+func keyReused() error {
+	return status.Error(codes.FailedPrecondition, "the idempotency key was already used for a different save")
+}
+
+// dedupWindow is how long the result of a save is kept to answer retries of it
+func dedupWindow(config Config) time.Duration {
+	if config.DedupWindow <= 0 {
+		return defaultDedupWindow
+	}
+	return time.Duration(config.DedupWindow) * time.Second
+}
@@ -6,13 +6,46 @@ import (
 )
 
 type repository interface {
-	save(ctx context.Context, events []*dedb.Event) error
+	save(ctx context.Context, events []*dedb.Event, expected *dedb.ExpectedVersion, key saveKey) ([]*dedb.Event, error)
 	shutdown()
 	getDomain(ctx context.Context, domain string, domainId string, offset int64, limit int64) ([]*dedb.Event, error)
+	// getDomainBackward returns up to limit events of the domain id with a version below before, newest first, from the latest when before is 0
+	getDomainBackward(ctx context.Context, domain string, domainId string, before int64, limit int64) ([]*dedb.Event, error)
+	// getDomainByTimeRange returns up to limit events of the domain id saved from the timestamp to the other, both included
+	getDomainByTimeRange(ctx context.Context, domain string, domainId string, from int64, to int64, limit int64, direction dedb.Direction) ([]*dedb.Event, error)
 	getDomainIds(ctx context.Context, domain string, offset int64, limit int64) ([]string, error)
+	// readAll returns up to limit events after the position, in position order, along with the last position it went through
+	readAll(ctx context.Context, from int64, limit int64, filter eventFilter) ([]*dedb.Event, int64, error)
+	saveSnapshot(ctx context.Context, snapshot *dedb.Snapshot) error
+	getSnapshot(ctx context.Context, domain string, domainId string) (*dedb.Snapshot, error)
+	pending(ctx context.Context, limit int64) ([]*dedb.Event, error)
+	published(ctx context.Context, events []*dedb.Event) error
+	saveSchema(ctx context.Context, schema *dedb.Schema) (*dedb.Schema, error)
+	getSchema(ctx context.Context, domain string, eventName string, version int32) (*dedb.Schema, error)
+	listSchemas(ctx context.Context, domain string, eventName string) ([]*dedb.Schema, error)
 }
 
 type publisher interface {
-	publish(ctx context.Context, events []*dedb.Event)
+	publish(ctx context.Context, events []*dedb.Event) error
 	shutdown()
 }
+
+// message is an event delivered from the broker, along with the broker
+// specific id needed to acknowledge it
+type message struct {
+	id     string
+	domain string
+	event  *dedb.Event
+}
+
+// allDomains is the stream every event is published to as well, whatever its domain
+const allDomains = "*"
+
+type subscriber interface {
+	join(ctx context.Context, group string, domain string) error
+	read(ctx context.Context, group string, consumer string, domains []string) ([]*message, error)
+	ack(ctx context.Context, group string, domain string, id string) error
+	release(ctx context.Context, group string, consumer string, domains []string) error
+	// drop deletes the group from the domain streams, along with anything still pending for it
+	drop(ctx context.Context, group string, domains []string) error
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// jsonSchemaURL is the name a definition is compiled under, it only shows in error messages
+const jsonSchemaURL = "schema.json"
+
+/*
+jsonSchema is a compiled JSON Schema, draft 2020-12 unless the definition names another
+one with $schema. References within the definition are resolved, but nothing outside it
+is ever loaded, so a registered schema can not make the service read files or fetch URLs.
+*/
+type jsonSchema struct {
+	schema *jsonschema.Schema
+}
+
+func compileJSONSchema(definition []byte) (*jsonSchema, error) {
+	if !json.Valid(definition) {
+		return nil, fmt.Errorf("schema is not valid json")
+	}
+	c := jsonschema.NewCompiler()
+	c.Draft = jsonschema.Draft2020
+	c.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("%s is not in the schema, references to other documents are not supported", url)
+	}
+	err := c.AddResource(jsonSchemaURL, bytes.NewReader(definition))
+	if err != nil {
+		return nil, err
+	}
+	schema, err := c.Compile(jsonSchemaURL)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonSchema{schema: schema}, nil
+}
+
+// validate returns a description of every way data does not conform to the schema
+func (s *jsonSchema) validate(data []byte) []string {
+	var doc interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	err := d.Decode(&doc)
+	if err == nil && d.More() {
+		err = fmt.Errorf("data continues after the value")
+	}
+	if err != nil {
+		return []string{fmt.Sprintf("data is not valid json: %v", err)}
+	}
+	err = s.schema.Validate(doc)
+	if err == nil {
+		return nil
+	}
+	ve, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return []string{err.Error()}
+	}
+	return validationProblems(ve)
+}
+
+// validationProblems flattens the tree of errors down to the keywords that actually failed
+func validationProblems(ve *jsonschema.ValidationError) []string {
+	if len(ve.Causes) == 0 {
+		return []string{fmt.Sprintf("$%s: %s", strings.ReplaceAll(ve.InstanceLocation, "/", "."), ve.Message)}
+	}
+	problems := []string{}
+	for _, cause := range ve.Causes {
+		problems = append(problems, validationProblems(cause)...)
+	}
+	return problems
+}
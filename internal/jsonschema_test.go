@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONSchema(t *testing.T) {
+	// setup
+	schema, err := compileJSONSchema([]byte(`{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title": "Customer",
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1, "maxLength": 20},
+			"email": {"type": "string", "pattern": "^[^@]+@[^@]+$"},
+			"age": {"type": "integer", "minimum": 0, "exclusiveMaximum": 150},
+			"status": {"enum": ["active", "closed"]},
+			"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2},
+			"contact": {"anyOf": [{"type": "string"}, {"type": "null"}]}
+		},
+		"required": ["name"],
+		"additionalProperties": false
+	}`))
+	assert.Nil(t, err)
+	cases := []struct {
+		name     string
+		data     string
+		problems int
+	}{
+		{
+			name:     "Valid",
+			data:     `{"name":"customer","email":"a@b.c","age":42,"status":"active","tags":["a"],"contact":null}`,
+			problems: 0,
+		},
+		{
+			name:     "Not json",
+			data:     `{"name":`,
+			problems: 1,
+		},
+		{
+			name:     "Missing required property",
+			data:     `{"age":42}`,
+			problems: 1,
+		},
+		{
+			name:     "Wrong types",
+			data:     `{"name":42,"age":4.2}`,
+			problems: 2,
+		},
+		{
+			name:     "Out of range",
+			data:     `{"name":"","age":150,"tags":["a","b","c"]}`,
+			problems: 3,
+		},
+		{
+			name:     "Pattern, enum and anyOf",
+			data:     `{"name":"customer","email":"nope","status":"open","contact":1}`,
+			problems: 4, // one for each branch of the anyOf
+		},
+		{
+			name:     "Additional property",
+			data:     `{"name":"customer","nickname":"cust"}`,
+			problems: 1,
+		},
+	}
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			problems := schema.validate([]byte(tc.data))
+			assert.Equal(t, tc.problems, len(problems), problems)
+		})
+	}
+}
+
+func TestJSONSchemaCompile(t *testing.T) {
+	cases := []struct {
+		name       string
+		definition string
+		valid      bool
+	}{
+		{name: "Empty schema", definition: `{}`, valid: true},
+		{name: "Not json", definition: `{"type":`, valid: false},
+		{name: "Unknown type", definition: `{"type":"date"}`, valid: false},
+		{name: "Bad pattern", definition: `{"pattern":"("}`, valid: false},
+		{name: "Unresolved reference", definition: `{"$ref":"#/$defs/customer"}`, valid: false},
+		{name: "Reference within the schema", definition: `{"$ref":"#/$defs/customer","$defs":{"customer":{"type":"object"}}}`, valid: true},
+		{name: "Reference to a file", definition: `{"$ref":"file:///etc/passwd"}`, valid: false},
+		{name: "Reference to a URL", definition: `{"$ref":"https://example.com/customer.json"}`, valid: false},
+		{name: "Invalid nested schema", definition: `{"properties":{"name":{"minLength":-1}}}`, valid: false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := compileJSONSchema([]byte(tc.definition))
+			assert.Equal(t, tc.valid, err == nil, err)
+		})
+	}
+}
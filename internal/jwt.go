@@ -0,0 +1,236 @@
+package internal
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+/*
+jwtAuthenticator verifies bearer tokens against the keys of a local JWKS file. The file is
+read again when a token names a key it does not hold and the file changed since, so keys
+can be rotated without a restart.
+*/
+type jwtAuthenticator struct {
+	file      string
+	claim     string
+	parser    *jwt.Parser
+	mu        sync.RWMutex
+	keys      map[string]crypto.PublicKey // kid => key
+	modified  time.Time
+	lastCheck time.Time
+}
+
+func newJWTAuthenticator(config ServerConfig) (*jwtAuthenticator, error) {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithExpirationRequired(),
+	}
+	if config.JWTIssuer != "" {
+		options = append(options, jwt.WithIssuer(config.JWTIssuer))
+	}
+	if config.JWTAudience != "" {
+		options = append(options, jwt.WithAudience(config.JWTAudience))
+	}
+	a := &jwtAuthenticator{
+		file:   config.JWKSFile,
+		claim:  config.JWTPrincipalClaim,
+		parser: jwt.NewParser(options...),
+	}
+	if a.claim == "" {
+		a.claim = "sub"
+	}
+	err := a.load()
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *jwtAuthenticator) Authenticate(ctx context.Context) (*Principal, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 || !strings.HasPrefix(strings.ToLower(values[0]), "bearer ") {
+		return nil, nil
+	}
+	claims := jwt.MapClaims{}
+	_, err := a.parser.ParseWithClaims(strings.TrimSpace(values[0][len("bearer "):]), claims, a.key)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "the bearer token is not valid: %v", err)
+	}
+	name, _ := claims[a.claim].(string)
+	if name == "" {
+		return nil, status.Errorf(codes.Unauthenticated, "the bearer token has no %s claim", a.claim)
+	}
+	return &Principal{Name: name, Method: "jwt"}, nil
+}
+
+// key finds the key the token was signed with, by its kid or as the only key there is
+func (a *jwtAuthenticator) key(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := a.find(kid)
+	if !ok {
+		a.reload()
+		key, ok = a.find(kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("no key %q in the key set", kid)
+	}
+	return key, nil
+}
+
+func (a *jwtAuthenticator) find(kid string) (crypto.PublicKey, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, true
+		}
+	}
+	key, ok := a.keys[kid]
+	return key, ok
+}
+
+// reload reads the key set again when the file changed, checking at most once a second
+func (a *jwtAuthenticator) reload() {
+	a.mu.RLock()
+	recent := time.Since(a.lastCheck) < time.Second
+	a.mu.RUnlock()
+	if recent {
+		return
+	}
+	_ = a.load()
+}
+
+func (a *jwtAuthenticator) load() error {
+	info, err := os.Stat(a.file)
+	if err != nil {
+		return fmt.Errorf("could not read the JWKS file: %w", err)
+	}
+	a.mu.Lock()
+	a.lastCheck = time.Now()
+	unchanged := a.keys != nil && info.ModTime().Equal(a.modified)
+	a.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+	data, err := os.ReadFile(a.file)
+	if err != nil {
+		return fmt.Errorf("could not read the JWKS file: %w", err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.keys = keys
+	a.modified = info.ModTime()
+	a.mu.Unlock()
+	return nil
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS returns the signing keys of the set, keys of other uses or types are left out
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the JWKS file: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("could not parse key %q of the JWKS file: %w", k.Kid, err)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("the JWKS file has no signing keys")
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := jwkInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := jwkInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("curve %s is not supported", k.Crv)
+		}
+		x, err := jwkInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := jwkInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("the point is not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("curve %s is not supported", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("the Ed25519 key is not valid")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+func jwkInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("the key parameters are not valid")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
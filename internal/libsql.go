@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/libsql/go-libsql"
+)
+
+/*
+openLibsql opens a database with the libsql driver, which takes local paths, file: and
+libsql:// or http(s):// URLs of a remote server. The driver does not bind query arguments,
+it runs the query text as is, so its connections are wrapped to bind the arguments into the
+text as SQL literals first.
+*/
+func openLibsql(url string) (*sqlx.DB, error) {
+	db, err := sql.Open("libsql", url)
+	if err != nil {
+		return nil, err
+	}
+	d := db.Driver()
+	db.Close()
+	conn := sqlx.NewDb(sql.OpenDB(libsqlConnector{driver: d, url: url}), "libsql")
+	err = conn.Ping()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+type libsqlConnector struct {
+	driver driver.Driver
+	url    string
+}
+
+func (c libsqlConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.url)
+	if err != nil {
+		return nil, err
+	}
+	execer, ok := conn.(driver.ExecerContext)
+	queryer, ok2 := conn.(driver.QueryerContext)
+	if !ok || !ok2 {
+		conn.Close()
+		return nil, fmt.Errorf("the libsql driver does not run queries directly")
+	}
+	return &libsqlConn{Conn: conn, execer: execer, queryer: queryer}, nil
+}
+
+func (c libsqlConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type libsqlConn struct {
+	driver.Conn
+	execer  driver.ExecerContext
+	queryer driver.QueryerContext
+}
+
+func (c *libsqlConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	query, err := bindLiterals(query, args)
+	if err != nil {
+		return nil, err
+	}
+	result, err := c.execer.ExecContext(ctx, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		// the driver does not report rows affected or ids, which nothing here relies on
+		result = driver.ResultNoRows
+	}
+	return result, nil
+}
+
+func (c *libsqlConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	query, err := bindLiterals(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return c.queryer.QueryContext(ctx, query, nil)
+}
+
+/*
+bindLiterals replaces each ? placeholder of the query, outside of quoted strings and
+identifiers, with its argument written as a SQL literal. Text is quoted with embedded quotes
+doubled and bytes are written as a blob literal, so values can not change the statement.
+*/
+func bindLiterals(query string, args []driver.NamedValue) (string, error) {
+	if len(args) == 0 {
+		return query, nil
+	}
+	var b strings.Builder
+	next := 0
+	var quote rune
+	for _, c := range query {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '?':
+			if next >= len(args) {
+				return "", fmt.Errorf("the query has more placeholders than the %d arguments", len(args))
+			}
+			literal, err := sqlLiteral(args[next].Value)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(literal)
+			next++
+			continue
+		}
+		b.WriteRune(c)
+	}
+	if next != len(args) {
+		return "", fmt.Errorf("the query has %d placeholders for %d arguments", next, len(args))
+	}
+	return b.String(), nil
+}
+
+func sqlLiteral(value driver.Value) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "NULL", nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case bool:
+		if v {
+			return "1", nil
+		}
+		return "0", nil
+	case []byte:
+		return "X'" + hex.EncodeToString(v) + "'", nil
+	case string:
+		if strings.ContainsRune(v, 0) {
+			// the query is handed over as a C string, which would end at the NUL
+			return "CAST(X'" + hex.EncodeToString([]byte(v)) + "' AS TEXT)", nil
+		}
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'", nil
+	case time.Time:
+		return "'" + v.Format(time.RFC3339Nano) + "'", nil
+	}
+	return "", fmt.Errorf("can not bind a %T to a libsql query", value)
+}
@@ -0,0 +1,213 @@
+package internal
+
+import (
+	"context"
+	"dedb"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+memoryPublisher is an in process broker with the same consumer group semantics as the
+redis publisher: every group gets every event of a domain published after it joined,
+and every event also goes to the allDomains stream,
+each event goes to one consumer of the group and stays pending until acked. Pending
+events left idle too long are handed to the next consumer reading. Messages every group
+has read are trimmed from the stream, pending ones being held by the groups themselves.
+*/
+type memoryPublisher struct {
+	log    zerolog.Logger
+	config Config
+
+	mu      sync.Mutex
+	streams map[string]*memoryStream
+	wake    chan struct{} // closed and replaced on every publish to wake up blocked readers
+}
+
+type memoryStream struct {
+	messages []*message
+	trimmed  int // number of messages trimmed from the start of the stream
+	groups   map[string]*memoryGroup
+}
+
+type memoryGroup struct {
+	next    int // index in the whole stream, trimmed messages included, of the next message never delivered to the group
+	pending map[string]*memoryPending
+}
+
+type memoryPending struct {
+	message   *message
+	consumer  string
+	delivered time.Time
+}
+
+func NewMemoryPublisher(config Config) (*memoryPublisher, error) {
+	return &memoryPublisher{
+		log:     log.With().Str("logger", "memoryPublisher").Logger(),
+		config:  config,
+		streams: make(map[string]*memoryStream),
+		wake:    make(chan struct{}),
+	}, nil
+}
+
+func (p *memoryPublisher) stream(domain string) *memoryStream {
+	stream, ok := p.streams[domain]
+	if !ok {
+		stream = &memoryStream{groups: make(map[string]*memoryGroup)}
+		p.streams[domain] = stream
+	}
+	return stream
+}
+
+func (p *memoryPublisher) publish(ctx context.Context, events []*dedb.Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, event := range events {
+		for _, domain := range []string{event.Domain, allDomains} {
+			stream := p.stream(domain)
+			stream.messages = append(stream.messages, &message{
+				id:     strconv.Itoa(stream.trimmed + len(stream.messages) + 1),
+				domain: domain,
+				event:  proto.Clone(event).(*dedb.Event),
+			})
+			stream.trim()
+		}
+	}
+	close(p.wake)
+	p.wake = make(chan struct{})
+	return nil
+}
+
+// join creates the consumer group at the end of the domain stream if it does not exist yet
+func (p *memoryPublisher) join(ctx context.Context, group string, domain string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stream := p.stream(domain)
+	if _, ok := stream.groups[group]; !ok {
+		stream.groups[group] = &memoryGroup{
+			next:    stream.trimmed + len(stream.messages),
+			pending: make(map[string]*memoryPending),
+		}
+	}
+	return nil
+}
+
+/*
+read returns the next batch of messages for the consumer, claiming idle pending messages
+first and otherwise waiting a short while for new ones to be published.
+*/
+func (p *memoryPublisher) read(ctx context.Context, group string, consumer string, domains []string) ([]*message, error) {
+	timeout := time.NewTimer(readBlock)
+	defer timeout.Stop()
+	for {
+		p.mu.Lock()
+		messages := p.take(group, consumer, domains)
+		wake := p.wake
+		p.mu.Unlock()
+		if len(messages) > 0 {
+			return messages, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timeout.C:
+			return messages, nil
+		case <-wake:
+		}
+	}
+}
+
+func (p *memoryPublisher) take(group string, consumer string, domains []string) []*message {
+	now := time.Now()
+	messages := make([]*message, 0)
+	for _, domain := range domains {
+		g, ok := p.stream(domain).groups[group]
+		if !ok {
+			continue
+		}
+		for _, pending := range g.pending {
+			if now.Sub(pending.delivered) >= claimIdle && len(messages) < readCount {
+				pending.consumer = consumer
+				pending.delivered = now
+				messages = append(messages, p.copy(pending.message))
+			}
+		}
+	}
+	if len(messages) > 0 {
+		return messages
+	}
+	for _, domain := range domains {
+		stream := p.stream(domain)
+		g, ok := stream.groups[group]
+		if !ok {
+			continue
+		}
+		for count := 0; g.next < stream.trimmed+len(stream.messages) && count < readCount; count++ {
+			m := stream.messages[g.next-stream.trimmed]
+			g.next++
+			g.pending[m.id] = &memoryPending{message: m, consumer: consumer, delivered: now}
+			messages = append(messages, p.copy(m))
+		}
+		stream.trim()
+	}
+	return messages
+}
+
+// trim drops the messages read by every group, all of them when there is none as new groups start at the end
+func (s *memoryStream) trim() {
+	read := s.trimmed + len(s.messages)
+	for _, g := range s.groups {
+		if g.next < read {
+			read = g.next
+		}
+	}
+	count := read - s.trimmed
+	if count == 0 {
+		return
+	}
+	for i := 0; i < count; i++ {
+		s.messages[i] = nil
+	}
+	s.messages = s.messages[count:]
+	s.trimmed = read
+}
+
+func (p *memoryPublisher) copy(m *message) *message {
+	return &message{id: m.id, domain: m.domain, event: proto.Clone(m.event).(*dedb.Event)}
+}
+
+func (p *memoryPublisher) ack(ctx context.Context, group string, domain string, id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if g, ok := p.stream(domain).groups[group]; ok {
+		delete(g.pending, id)
+	}
+	return nil
+}
+
+/*
+release has nothing to clean up as consumers are not registered, messages still pending
+for the consumer are claimed by another consumer of the group once they are idle.
+*/
+func (p *memoryPublisher) release(ctx context.Context, group string, consumer string, domains []string) error {
+	return nil
+}
+
+func (p *memoryPublisher) drop(ctx context.Context, group string, domains []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, domain := range domains {
+		stream := p.stream(domain)
+		delete(stream.groups, group)
+		stream.trim()
+	}
+	return nil
+}
+
+func (p *memoryPublisher) shutdown() {
+}
@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"context"
+	"dedb"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryPublisherTrim(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	pub, err := NewMemoryPublisher(Config{})
+	assert.Nil(t, err)
+	domains := []string{"CUSTOMER"}
+	assert.Nil(t, pub.join(ctx, "fast", "CUSTOMER"))
+	assert.Nil(t, pub.join(ctx, "slow", "CUSTOMER"))
+	publish := func(ids ...string) {
+		for _, id := range ids {
+			assert.Nil(t, pub.publish(ctx, []*dedb.Event{{Id: id, Name: "CustomerCreated", Domain: "CUSTOMER"}}))
+		}
+	}
+	stream := pub.streams["CUSTOMER"]
+
+	// when / then
+	publish("1", "2", "3")
+	assert.Equal(t, 3, len(stream.messages))
+	assert.Equal(t, 0, len(pub.streams[allDomains].messages), "nobody reads all domains")
+
+	read, _ := pub.read(ctx, "fast", "fast-1", domains)
+	assert.Equal(t, 3, len(read))
+	assert.Equal(t, 3, len(stream.messages), "the slow group has not read any")
+
+	read, _ = pub.read(ctx, "slow", "slow-1", domains)
+	assert.Equal(t, 3, len(read))
+	assert.Equal(t, 0, len(stream.messages))
+	assert.Equal(t, 3, len(pub.streams["CUSTOMER"].groups["slow"].pending), "read messages stay pending until acked")
+
+	publish("4", "5")
+	read, _ = pub.read(ctx, "fast", "fast-1", domains)
+	assert.Equal(t, []string{"4", "5"}, []string{read[0].id, read[1].id})
+	assert.Equal(t, "4", read[0].event.Id)
+	assert.Nil(t, pub.drop(ctx, "slow", domains))
+	assert.Equal(t, 0, len(stream.messages))
+}
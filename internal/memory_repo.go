@@ -0,0 +1,302 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"dedb"
+)
+
+/*
+memoryRepo keeps everything in process memory, for tests and embedded use. It follows
+the same rules as the other repositories: versions per domain id, global positions in
+commit order and domain ids listed in the order they were first seen. Events are copied
+on the way in and out so callers can't change what is stored.
+*/
+type memoryRepo struct {
+	log    zerolog.Logger
+	config Config
+
+	mu          sync.RWMutex
+	events      map[string][]*dedb.Event // domain:domain id => events
+	all         []*dedb.Event            // every event in position order
+	domainIds   map[string][]string      // domain => domain ids in first seen order
+	snapshots   map[string]*dedb.Snapshot
+	idempotency map[string]memorySave
+	outbox      []*dedb.Event
+	position    int64
+	schemas     map[string]*dedb.Schema // domain:event name:version => schema
+	latest      map[string]int32        // domain:event name => latest schema version
+}
+
+type memorySave struct {
+	hash    string
+	events  []*dedb.Event
+	expires time.Time
+}
+
+func NewMemoryRepo(config Config) (*memoryRepo, error) {
+	return &memoryRepo{
+		log:         log.With().Str("logger", "memoryRepo").Logger(),
+		config:      config,
+		events:      make(map[string][]*dedb.Event),
+		domainIds:   make(map[string][]string),
+		snapshots:   make(map[string]*dedb.Snapshot),
+		idempotency: make(map[string]memorySave),
+		schemas:     make(map[string]*dedb.Schema),
+		latest:      make(map[string]int32),
+	}, nil
+}
+
+func memoryKey(domain string, domainId string) string {
+	return domain + ":" + domainId
+}
+
+func (m *memoryRepo) save(ctx context.Context, events []*dedb.Event, expected *dedb.ExpectedVersion, key saveKey) ([]*dedb.Event, error) {
+	log := m.log.With().Str("op", "save").Logger()
+	if len(events) == 0 {
+		return nil, fmt.Errorf("no events were supplied to save")
+	}
+	log.Debug().Msgf("saving %d events", len(events))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// a retry of a save that already went through gets the original result back
+	if key.key != "" {
+		original, ok := m.idempotency[key.key]
+		if ok && time.Now().Before(original.expires) {
+			if original.hash != key.hash {
+				return nil, keyReused()
+			}
+			log.Debug().Msgf("save already done for idempotency key %s", key.key)
+			return cloneEvents(original.events), nil
+		}
+	}
+
+	first := memoryKey(events[0].Domain, events[0].DomainId)
+	err := checkExpectedVersion(events[0].DomainId, expected, int64(len(m.events[first])))
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := time.Now().UnixMicro()
+	for _, e := range events {
+		timestamp++
+		if e.Id == "" {
+			id, _ := generateId()
+			e.Id = id.String()
+		}
+		e.Timestamp = timestamp
+		key := memoryKey(e.Domain, e.DomainId)
+		if len(m.events[key]) == 0 {
+			m.domainIds[e.Domain] = append(m.domainIds[e.Domain], e.DomainId)
+		}
+		e.Version = int64(len(m.events[key])) + 1
+		m.position++
+		e.Position = m.position
+		stored := proto.Clone(e).(*dedb.Event)
+		m.events[key] = append(m.events[key], stored)
+		m.all = append(m.all, stored)
+		m.outbox = append(m.outbox, proto.Clone(e).(*dedb.Event))
+	}
+	if key.key != "" {
+		m.idempotency[key.key] = memorySave{
+			hash:    key.hash,
+			events:  cloneEvents(events),
+			expires: time.Now().Add(dedupWindow(m.config)),
+		}
+	}
+	return events, nil
+}
+
+func (m *memoryRepo) getDomain(ctx context.Context, domain string, domainId string, offset int64, limit int64) ([]*dedb.Event, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return cloneEvents(page(m.events[memoryKey(domain, domainId)], offset, limit)), nil
+}
+
+func (m *memoryRepo) getDomainBackward(ctx context.Context, domain string, domainId string, before int64, limit int64) ([]*dedb.Event, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	events := m.events[memoryKey(domain, domainId)]
+	if before > 0 && before-1 < int64(len(events)) {
+		events = events[:before-1]
+	}
+	events = cloneEvents(events)
+	reverseEvents(events)
+	return page(events, 0, limit), nil
+}
+
+func (m *memoryRepo) getDomainByTimeRange(ctx context.Context, domain string, domainId string, from int64, to int64, limit int64, direction dedb.Direction) ([]*dedb.Event, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	to = timeRangeEnd(to)
+	events := []*dedb.Event{}
+	for _, e := range m.events[memoryKey(domain, domainId)] {
+		if e.Timestamp >= from && e.Timestamp <= to {
+			events = append(events, e)
+		}
+	}
+	if direction == dedb.Direction_BACKWARD {
+		events = cloneEvents(events)
+		reverseEvents(events)
+		return page(events, 0, limit), nil
+	}
+	return cloneEvents(page(events, 0, limit)), nil
+}
+
+func (m *memoryRepo) getDomainIds(ctx context.Context, domain string, offset int64, limit int64) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := page(m.domainIds[domain], offset, limit)
+	return append([]string{}, ids...), nil
+}
+
+func (m *memoryRepo) readAll(ctx context.Context, from int64, limit int64, filter eventFilter) ([]*dedb.Event, int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	start := sort.Search(len(m.all), func(i int) bool { return m.all[i].Position > from })
+	events := []*dedb.Event{}
+	last := from
+	for _, e := range m.all[start:] {
+		if limit > 0 && int64(len(events)) == limit {
+			break
+		}
+		last = e.Position
+		if filter.matches(e) {
+			events = append(events, proto.Clone(e).(*dedb.Event))
+		}
+	}
+	return events, last, nil
+}
+
+func (m *memoryRepo) saveSnapshot(ctx context.Context, snapshot *dedb.Snapshot) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := memoryKey(snapshot.Domain, snapshot.DomainId)
+	current := int64(len(m.events[key]))
+	if snapshot.Version > current {
+		return status.Errorf(codes.FailedPrecondition, "snapshot version %d is ahead of domain id %s at version %d", snapshot.Version, snapshot.DomainId, current)
+	}
+	existing, ok := m.snapshots[key]
+	if ok && existing.Version >= snapshot.Version {
+		return nil
+	}
+	snapshot.Timestamp = time.Now().UnixMicro()
+	m.snapshots[key] = proto.Clone(snapshot).(*dedb.Snapshot)
+	return nil
+}
+
+func (m *memoryRepo) getSnapshot(ctx context.Context, domain string, domainId string) (*dedb.Snapshot, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	snapshot, ok := m.snapshots[memoryKey(domain, domainId)]
+	if !ok {
+		return nil, nil
+	}
+	return proto.Clone(snapshot).(*dedb.Snapshot), nil
+}
+
+func (m *memoryRepo) saveSchema(ctx context.Context, schema *dedb.Schema) (*dedb.Schema, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	schema = proto.Clone(schema).(*dedb.Schema)
+	latestKey := memoryKey(schema.Domain, schema.EventName)
+	if schema.Version == 0 {
+		schema.Version = m.latest[latestKey] + 1
+	}
+	key := schemaKey(schema.Domain, schema.EventName, schema.Version)
+	if existing, ok := m.schemas[key]; ok {
+		if !sameSchema(existing, schema) {
+			return nil, schemaExists(schema)
+		}
+		return proto.Clone(existing).(*dedb.Schema), nil
+	}
+	schema.Timestamp = time.Now().UnixMicro()
+	m.schemas[key] = schema
+	if schema.Version > m.latest[latestKey] {
+		m.latest[latestKey] = schema.Version
+	}
+	return proto.Clone(schema).(*dedb.Schema), nil
+}
+
+func (m *memoryRepo) getSchema(ctx context.Context, domain string, eventName string, version int32) (*dedb.Schema, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if version == 0 {
+		version = m.latest[memoryKey(domain, eventName)]
+	}
+	schema, ok := m.schemas[schemaKey(domain, eventName, version)]
+	if !ok {
+		return nil, nil
+	}
+	return proto.Clone(schema).(*dedb.Schema), nil
+}
+
+func (m *memoryRepo) listSchemas(ctx context.Context, domain string, eventName string) ([]*dedb.Schema, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	schemas := []*dedb.Schema{}
+	for _, schema := range m.schemas {
+		if (domain == "" || schema.Domain == domain) && (eventName == "" || schema.EventName == eventName) {
+			schemas = append(schemas, proto.Clone(schema).(*dedb.Schema))
+		}
+	}
+	sortSchemas(schemas)
+	return schemas, nil
+}
+
+func (m *memoryRepo) pending(ctx context.Context, limit int64) ([]*dedb.Event, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return cloneEvents(page(m.outbox, 0, limit)), nil
+}
+
+func (m *memoryRepo) published(ctx context.Context, events []*dedb.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	done := make(map[int64]bool)
+	for _, e := range events {
+		done[e.Position] = true
+	}
+	outbox := make([]*dedb.Event, 0, len(m.outbox))
+	for _, e := range m.outbox {
+		if !done[e.Position] {
+			outbox = append(outbox, e)
+		}
+	}
+	m.outbox = outbox
+	return nil
+}
+
+func (m *memoryRepo) shutdown() {
+}
+
+// page returns the part of the slice selected by offset and limit, a limit of 0 is no limit
+func page[T any](items []T, offset int64, limit int64) []T {
+	if offset < 0 || offset >= int64(len(items)) {
+		return []T{}
+	}
+	end := int64(len(items))
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+	return items[offset:end]
+}
+
+func cloneEvents(events []*dedb.Event) []*dedb.Event {
+	cloned := make([]*dedb.Event, 0, len(events))
+	for _, e := range events {
+		cloned = append(cloned, proto.Clone(e).(*dedb.Event))
+	}
+	return cloned
+}
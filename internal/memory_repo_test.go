@@ -0,0 +1,292 @@
+package internal
+
+import (
+	"context"
+	"dedb"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMemoryRepoSave(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	repo, _ := NewMemoryRepo(Config{})
+	cases := []struct {
+		name     string
+		events   []*dedb.Event
+		expected *dedb.ExpectedVersion
+		versions []int64
+		err      error
+	}{
+		{
+			name: "Simple happy path",
+			events: []*dedb.Event{
+				{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "testid"},
+			},
+			expected: &dedb.ExpectedVersion{Kind: dedb.ExpectedVersion_NO_STREAM},
+			versions: []int64{1},
+		},
+		{
+			name: "Versions continue per domain id",
+			events: []*dedb.Event{
+				{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "testid"},
+				{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "testid2"},
+			},
+			versions: []int64{2, 1},
+		},
+		{
+			name: "Stale expected version",
+			events: []*dedb.Event{
+				{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "testid"},
+			},
+			expected: &dedb.ExpectedVersion{Kind: dedb.ExpectedVersion_EXACT, Version: 1},
+			err:      versionConflict("testid", &dedb.ExpectedVersion{Kind: dedb.ExpectedVersion_EXACT, Version: 1}, 2),
+		},
+		{
+			name:   "Simple error for empty events list",
+			events: []*dedb.Event{},
+			err:    fmt.Errorf("no events were supplied to save"),
+		},
+	}
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			saved, err := repo.save(ctx, tc.events, tc.expected, saveKey{})
+			if tc.err == nil {
+				assert.Nil(t, err)
+				for i, e := range saved {
+					assert.NotEqual(t, "", e.Id)
+					assert.Equal(t, tc.versions[i], e.Version)
+				}
+			} else {
+				assert.Equal(t, tc.err.Error(), err.Error())
+			}
+		})
+	}
+
+	// positions are global and in commit order
+	pending, _ := repo.pending(ctx, 10)
+	assert.Equal(t, 3, len(pending))
+	for i, e := range pending {
+		assert.Equal(t, int64(i+1), e.Position)
+	}
+}
+
+func TestMemoryRepoGetDomain(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	repo, _ := NewMemoryRepo(Config{})
+	events := []*dedb.Event{
+		{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "testid"},
+		{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "testid"},
+		{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "testid"},
+		{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "testid2"},
+	}
+	_, err := repo.save(ctx, events, nil, saveKey{})
+	if err != nil {
+		panic(err)
+	}
+	cases := []struct {
+		name     string
+		offset   int64
+		limit    int64
+		versions []int64
+	}{
+		{name: "All events", offset: 0, limit: 0, versions: []int64{1, 2, 3}},
+		{name: "First page", offset: 0, limit: 2, versions: []int64{1, 2}},
+		{name: "After a version", offset: 2, limit: 2, versions: []int64{3}},
+		{name: "Past the end", offset: 3, limit: 2, versions: []int64{}},
+	}
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			events, err := repo.getDomain(ctx, "CUSTOMER", "testid", tc.offset, tc.limit)
+			assert.Nil(t, err)
+			assert.Equal(t, len(tc.versions), len(events))
+			for i, e := range events {
+				assert.Equal(t, tc.versions[i], e.Version)
+			}
+		})
+	}
+
+	// domain ids come back in the order they were first seen
+	ids, err := repo.getDomainIds(ctx, "CUSTOMER", 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"testid", "testid2"}, ids)
+	ids, err = repo.getDomainIds(ctx, "CUSTOMER", 1, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"testid2"}, ids)
+
+	// stored events can't be changed through what was returned
+	events[0].Name = "Changed"
+	stored, _ := repo.getDomain(ctx, "CUSTOMER", "testid", 0, 1)
+	assert.Equal(t, "CustomerCreated", stored[0].Name)
+}
+
+func TestMemoryRepoSaveIdempotent(t *testing.T) {
+	repo, _ := NewMemoryRepo(Config{})
+	testRepoSaveIdempotent(t, repo)
+}
+
+// testRepoSaveIdempotent checks a repository answers retries of a save with its result, and only them
+func testRepoSaveIdempotent(t *testing.T, repo repository) {
+	// setup
+	ctx := context.Background()
+	other := withPrincipal(ctx, &Principal{Name: "other", Method: "api-key"})
+	request := func(domainId string, name string, expected dedb.ExpectedVersion_Kind) *dedb.SaveRequest {
+		return &dedb.SaveRequest{
+			IdempotencyKey:  "retry-key",
+			ExpectedVersion: &dedb.ExpectedVersion{Kind: expected},
+			Events:          []*dedb.Event{{Name: name, Domain: "CUSTOMER", DomainId: domainId}},
+		}
+	}
+	save := func(ctx context.Context, request *dedb.SaveRequest) ([]*dedb.Event, error) {
+		key, err := newSaveKey(ctx, request)
+		assert.Nil(t, err)
+		return repo.save(ctx, request.Events, request.ExpectedVersion, key)
+	}
+	saved, err := save(ctx, request("idemid", "CustomerCreated", dedb.ExpectedVersion_NO_STREAM))
+	assert.Nil(t, err)
+
+	// when / then a retry gets the original result, without its expected version being checked again
+	replayed, err := save(ctx, request("idemid", "CustomerCreated", dedb.ExpectedVersion_NO_STREAM))
+	assert.Nil(t, err)
+	assert.Equal(t, saved[0].Id, replayed[0].Id)
+	assert.Equal(t, saved[0].Position, replayed[0].Position)
+	events, _ := repo.getDomain(ctx, "CUSTOMER", "idemid", 0, 0)
+	assert.Equal(t, 1, len(events))
+
+	// and another save reusing the key is refused
+	_, err = save(ctx, request("idemid", "CustomerDeleted", dedb.ExpectedVersion_NO_STREAM))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// and the key of another principal or domain id is another save
+	_, err = save(other, request("idemid", "CustomerCreated", dedb.ExpectedVersion_NO_STREAM))
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	elsewhere, err := save(ctx, request("idemid2", "CustomerCreated", dedb.ExpectedVersion_NO_STREAM))
+	assert.Nil(t, err)
+	assert.NotEqual(t, saved[0].Id, elsewhere[0].Id)
+}
+
+func TestMemoryRepoGetDomainBackward(t *testing.T) {
+	repo, _ := NewMemoryRepo(Config{})
+	testRepoGetDomainBackward(t, repo)
+}
+
+// testRepoGetDomainBackward checks a repository reads the events of a domain id newest first
+func testRepoGetDomainBackward(t *testing.T, repo repository) {
+	// setup
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		_, err := repo.save(ctx, []*dedb.Event{{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "tailid"}}, nil, saveKey{})
+		assert.Nil(t, err)
+	}
+	cases := []struct {
+		name     string
+		before   int64
+		limit    int64
+		versions []int64
+	}{
+		{name: "Everything", versions: []int64{5, 4, 3, 2, 1}},
+		{name: "Last events", limit: 2, versions: []int64{5, 4}},
+		{name: "Next page", before: 4, limit: 2, versions: []int64{3, 2}},
+		{name: "Last page", before: 2, limit: 2, versions: []int64{1}},
+		{name: "Before the first event", before: 1, limit: 2, versions: []int64{}},
+		{name: "Past the latest event", before: 9, limit: 1, versions: []int64{5}},
+	}
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			events, err := repo.getDomainBackward(ctx, "CUSTOMER", "tailid", tc.before, tc.limit)
+			assert.Nil(t, err)
+			versions := []int64{}
+			for _, e := range events {
+				versions = append(versions, e.Version)
+			}
+			assert.Equal(t, tc.versions, versions)
+		})
+	}
+}
+
+func TestMemoryRepoGetDomainByTimeRange(t *testing.T) {
+	repo, _ := NewMemoryRepo(Config{})
+	testRepoGetDomainByTimeRange(t, repo)
+}
+
+/*
+testRepoGetDomainByTimeRange checks a repository reads the events in a time range the way
+the memory repository does, the other repository tests run it against theirs.
+*/
+func testRepoGetDomainByTimeRange(t *testing.T, repo repository) {
+	// setup
+	ctx := context.Background()
+	timestamps := []int64{}
+	for i := 0; i < 5; i++ {
+		saved, err := repo.save(ctx, []*dedb.Event{{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "rangeid"}}, nil, saveKey{})
+		assert.Nil(t, err)
+		timestamps = append(timestamps, saved[0].Timestamp)
+	}
+	cases := []struct {
+		name      string
+		from      int64
+		to        int64
+		limit     int64
+		direction dedb.Direction
+		versions  []int64
+	}{
+		{name: "Everything", versions: []int64{1, 2, 3, 4, 5}},
+		{name: "Range", from: timestamps[1], to: timestamps[3], versions: []int64{2, 3, 4}},
+		{name: "Up to a point in time", to: timestamps[0], versions: []int64{1}},
+		{name: "First of a range", from: timestamps[1], limit: 2, versions: []int64{2, 3}},
+		{name: "Last of a range", to: timestamps[3], limit: 2, direction: dedb.Direction_BACKWARD, versions: []int64{4, 3}},
+		{name: "Backward", direction: dedb.Direction_BACKWARD, versions: []int64{5, 4, 3, 2, 1}},
+		{name: "After the last event", from: timestamps[4] + 1, versions: []int64{}},
+	}
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			events, err := repo.getDomainByTimeRange(ctx, "CUSTOMER", "rangeid", tc.from, tc.to, tc.limit, tc.direction)
+			assert.Nil(t, err)
+			versions := []int64{}
+			for _, e := range events {
+				versions = append(versions, e.Version)
+			}
+			assert.Equal(t, tc.versions, versions)
+		})
+	}
+}
+
+func TestMemoryRepoSaveSharedDomainId(t *testing.T) {
+	repo, _ := NewMemoryRepo(Config{})
+	testRepoSaveSharedDomainId(t, repo)
+}
+
+// testRepoSaveSharedDomainId checks a repository versions each domain of a domain id on its own
+func testRepoSaveSharedDomainId(t *testing.T, repo repository) {
+	// setup
+	ctx := context.Background()
+	_, err := repo.save(ctx, []*dedb.Event{
+		{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "sharedid"},
+		{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "sharedid"},
+	}, nil, saveKey{})
+	assert.Nil(t, err)
+
+	// when
+	saved, err := repo.save(ctx, []*dedb.Event{
+		{Name: "OrderCreated", Domain: "ORDER", DomainId: "sharedid"},
+		{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "sharedid"},
+	}, &dedb.ExpectedVersion{Kind: dedb.ExpectedVersion_NO_STREAM}, saveKey{})
+
+	// then the expected version is checked against the domain of the first event
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), saved[0].Version)
+	assert.Equal(t, int64(3), saved[1].Version)
+}
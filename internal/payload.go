@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+
+	api "dedb"
+)
+
+const (
+	contentTypeJSON     = "application/json"
+	contentTypeProtobuf = "application/protobuf"
+)
+
+/*
+validatePayloads checks the data of every event decodes as its content type says. Events
+without a content type, or with one the service does not know, are opaque bytes and are
+not checked. The InvalidArgument status carries a BadRequest with a violation per event.
+*/
+func validatePayloads(events []*api.Event) error {
+	violations := []*errdetails.BadRequest_FieldViolation{}
+	for i, e := range events {
+		err := validatePayload(e)
+		if err != nil {
+			violations = append(violations, &errdetails.BadRequest_FieldViolation{
+				Field:       fmt.Sprintf("events[%d].data", i),
+				Description: err.Error(),
+			})
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return invalidArgument("event payloads do not decode", violations)
+}
+
+func validatePayload(e *api.Event) error {
+	switch e.ContentType {
+	case contentTypeJSON:
+		if !json.Valid(e.Data) {
+			return fmt.Errorf("%s data of %s is not valid json", e.Name, e.Id)
+		}
+	case contentTypeProtobuf:
+		if e.Schema == "" {
+			return fmt.Errorf("%s protobuf data needs the message name as schema", e.Name)
+		}
+		if !validProtobuf(e.Data) {
+			return fmt.Errorf("%s data is not a valid %s message", e.Name, e.Schema)
+		}
+		// messages linked into the service are checked field by field
+		mt, err := protoregistry.GlobalTypes.FindMessageByName(protoreflect.FullName(e.Schema))
+		if err == nil {
+			err = proto.Unmarshal(e.Data, mt.New().Interface())
+			if err != nil {
+				return fmt.Errorf("%s data is not a valid %s message: %v", e.Name, e.Schema, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validProtobuf reports whether data is well formed protobuf wire format
+func validProtobuf(data []byte) bool {
+	for len(data) > 0 {
+		_, _, n := protowire.ConsumeField(data)
+		if n < 0 {
+			return false
+		}
+		data = data[n:]
+	}
+	return true
+}
+
+// invalidArgument builds an InvalidArgument status with the violations as BadRequest details
+func invalidArgument(msg string, violations []*errdetails.BadRequest_FieldViolation) error {
+	st, err := status.New(codes.InvalidArgument, msg).WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+	if err != nil {
+		return status.Error(codes.InvalidArgument, msg)
+	}
+	return st.Err()
+}
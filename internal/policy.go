@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	opSave      = "save"
+	opRead      = "read"
+	opSubscribe = "subscribe"
+)
+
+/*
+policyRule grants a principal, or every principal with "*", operations on the domains it
+names. Domains, event names and consumer groups are glob patterns, and a list left out
+matches anything. Event names limit what can be saved and subscribed to, reads are by
+domain. A call reading or subscribing to every domain needs a rule matching the "*" domain.
+Registering a schema takes save on its domain and event name, reading schemas takes read.
+
+	{"rules": [
+		{"principal": "billing", "domains": ["ORDER"], "operations": ["read", "subscribe"], "consumer_groups": ["billing-*"]},
+		{"principal": "orders", "domains": ["ORDER"], "event_names": ["Order*"], "operations": ["save", "read"]}
+	]}
+*/
+type policyRule struct {
+	Principal      string   `json:"principal"`
+	Domains        []string `json:"domains"`
+	EventNames     []string `json:"event_names"`
+	Operations     []string `json:"operations"`
+	ConsumerGroups []string `json:"consumer_groups"`
+}
+
+// access is what a call does, an event name or consumer group left empty is not checked
+type access struct {
+	operation string
+	domain    string
+	eventName string
+	group     string
+}
+
+func (r policyRule) allows(a access) bool {
+	return matchesAny(r.Operations, a.operation) &&
+		matchesAny(r.Domains, a.domain) &&
+		(a.eventName == "" || matchesAny(r.EventNames, a.eventName)) &&
+		(a.group == "" || matchesAny(r.ConsumerGroups, a.group))
+}
+
+func matchesAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+policy authorizes calls against the rules of a policy file. The file is checked for
+changes at most once a second and reloaded when it changed, a file that no longer parses
+is logged and the rules loaded before it are kept.
+*/
+type policy struct {
+	log       zerolog.Logger
+	file      string
+	mu        sync.RWMutex
+	rules     map[string][]policyRule // principal => rules
+	modified  time.Time
+	lastCheck time.Time
+}
+
+func newPolicy(file string) (*policy, error) {
+	p := &policy{log: log.With().Str("logger", "policy").Logger(), file: file}
+	err := p.load()
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+/*
+authorize returns PermissionDenied unless a rule of the principal of the call allows each
+access. A call without a principal is denied, as the policy can not tell who made it.
+*/
+func (p *policy) authorize(ctx context.Context, accesses ...access) error {
+	principal := PrincipalFrom(ctx)
+	if principal == nil {
+		return status.Error(codes.PermissionDenied, "the call is not authenticated")
+	}
+	p.reload()
+	p.mu.RLock()
+	rules := append(append([]policyRule{}, p.rules[principal.Name]...), p.rules["*"]...)
+	p.mu.RUnlock()
+	for _, a := range accesses {
+		allowed := false
+		for _, rule := range rules {
+			if rule.allows(a) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return status.Errorf(codes.PermissionDenied, "%s may not %s", principal.Name, a)
+		}
+	}
+	return nil
+}
+
+func (a access) String() string {
+	s := fmt.Sprintf("%s domain %s", a.operation, a.domain)
+	if a.eventName != "" {
+		s += " event " + a.eventName
+	}
+	if a.group != "" {
+		s += " as consumer group " + a.group
+	}
+	return s
+}
+
+func (p *policy) reload() {
+	p.mu.RLock()
+	recent := time.Since(p.lastCheck) < time.Second
+	p.mu.RUnlock()
+	if recent {
+		return
+	}
+	err := p.load()
+	if err != nil {
+		p.log.Error().Err(err).Msgf("could not reload the policy file, keeping the previous rules")
+	}
+}
+
+func (p *policy) load() error {
+	info, err := os.Stat(p.file)
+	p.mu.Lock()
+	p.lastCheck = time.Now()
+	unchanged := err == nil && p.rules != nil && info.ModTime().Equal(p.modified)
+	p.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("could not read the policy file: %w", err)
+	}
+	if unchanged {
+		return nil
+	}
+	data, err := os.ReadFile(p.file)
+	if err != nil {
+		return fmt.Errorf("could not read the policy file: %w", err)
+	}
+	file := struct {
+		Rules []policyRule `json:"rules"`
+	}{}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return fmt.Errorf("could not parse the policy file: %w", err)
+	}
+	rules := make(map[string][]policyRule)
+	for i, rule := range file.Rules {
+		if rule.Principal == "" {
+			return fmt.Errorf("rule %d of the policy file has no principal", i+1)
+		}
+		for _, patterns := range [][]string{rule.Domains, rule.EventNames, rule.ConsumerGroups} {
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("rule %d of the policy file has a bad pattern %q", i+1, pattern)
+				}
+			}
+		}
+		for _, operation := range rule.Operations {
+			if operation != opSave && operation != opRead && operation != opSubscribe && operation != "*" {
+				return fmt.Errorf("rule %d of the policy file has an unknown operation %s", i+1, operation)
+			}
+		}
+		rules[rule.Principal] = append(rules[rule.Principal], rule)
+	}
+	p.mu.Lock()
+	p.rules = rules
+	p.modified = info.ModTime()
+	p.mu.Unlock()
+	p.log.Info().Msgf("loaded %d policy rules", len(file.Rules))
+	return nil
+}
@@ -0,0 +1,717 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"dedb"
+)
+
+/*
+the schema is built up by the migrations below, in order. Applied migrations are recorded
+in schema_migrations, so new ones are only ever appended to the end of the list.
+
+Positions come from the single row in the positions table. Every save locks that row
+first, which serializes writers and keeps positions in commit order.
+*/
+var postgresMigrations = []string{
+	`
+    CREATE TABLE domain_events (
+        position BIGINT PRIMARY KEY,
+        id TEXT NOT NULL,
+        domain TEXT NOT NULL,
+        domain_id TEXT NOT NULL,
+        version BIGINT NOT NULL,
+        name TEXT NOT NULL,
+        timestamp BIGINT NOT NULL,
+        trace_id TEXT NOT NULL DEFAULT '',
+        stream_id TEXT NOT NULL DEFAULT '',
+        metadata JSONB,
+        data BYTEA,
+        CONSTRAINT domain_events_version_uq UNIQUE (domain, domain_id, version)
+    );
+    CREATE TABLE domains (
+        domain TEXT NOT NULL,
+        domain_id TEXT NOT NULL,
+        timestamp BIGINT NOT NULL,
+        PRIMARY KEY (domain, domain_id)
+    );
+    CREATE INDEX domains_timestamp_idx ON domains (domain, timestamp, domain_id);
+    CREATE TABLE positions (
+        id INTEGER PRIMARY KEY,
+        position BIGINT NOT NULL
+    );
+    INSERT INTO positions (id, position) VALUES (1, 0);
+    `,
+	`
+    CREATE TABLE snapshots (
+        domain TEXT NOT NULL,
+        domain_id TEXT NOT NULL,
+        version BIGINT NOT NULL,
+        timestamp BIGINT NOT NULL,
+        metadata JSONB,
+        data BYTEA,
+        PRIMARY KEY (domain, domain_id)
+    );
+    CREATE TABLE idempotency (
+        key TEXT PRIMARY KEY,
+        response TEXT NOT NULL,
+        expires BIGINT NOT NULL
+    );
+    CREATE INDEX idempotency_expires_idx ON idempotency (expires);
+    CREATE TABLE outbox (
+        position BIGINT PRIMARY KEY,
+        event TEXT NOT NULL
+    );
+    `,
+	`
+    ALTER TABLE domain_events ADD COLUMN content_type TEXT NOT NULL DEFAULT '';
+    ALTER TABLE domain_events ADD COLUMN schema TEXT NOT NULL DEFAULT '';
+    `,
+	`
+    CREATE TABLE schemas (
+        domain TEXT NOT NULL,
+        event_name TEXT NOT NULL,
+        version INTEGER NOT NULL,
+        type INTEGER NOT NULL,
+        definition BYTEA,
+        message_name TEXT NOT NULL DEFAULT '',
+        timestamp BIGINT NOT NULL,
+        PRIMARY KEY (domain, event_name, version)
+    );
+    `,
+	`
+    CREATE INDEX domain_events_domain_position_idx ON domain_events (domain, position);
+    `,
+	// idempotency keys are scoped and remember the request they were saved with
+	`
+    DELETE FROM idempotency;
+    ALTER TABLE idempotency ADD COLUMN request_hash TEXT NOT NULL DEFAULT '';
+    `,
+}
+
+type postgresRepo struct {
+	log    zerolog.Logger
+	db     *sqlx.DB
+	config Config
+}
+
+// idempotencyRow is a save remembered by the sql repositories to answer its retries
+type idempotencyRow struct {
+	RequestHash string `db:"request_hash"`
+	Response    string `db:"response"`
+}
+
+// eventRow is an event as stored in the sql repositories
+type eventRow struct {
+	Id          string `db:"id"`
+	Domain      string `db:"domain"`
+	DomainId    string `db:"domain_id"`
+	Version     int64  `db:"version"`
+	Position    int64  `db:"position"`
+	Name        string `db:"name"`
+	Timestamp   int64  `db:"timestamp"`
+	TraceId     string `db:"trace_id"`
+	StreamId    string `db:"stream_id"`
+	Metadata    []byte `db:"metadata"`
+	ContentType string `db:"content_type"`
+	Schema      string `db:"schema"`
+	Data        []byte `db:"data"`
+}
+
+func (r eventRow) event() (*dedb.Event, error) {
+	e := &dedb.Event{
+		Id:          r.Id,
+		Domain:      r.Domain,
+		DomainId:    r.DomainId,
+		Version:     r.Version,
+		Position:    r.Position,
+		Name:        r.Name,
+		Timestamp:   r.Timestamp,
+		TraceId:     r.TraceId,
+		StreamId:    r.StreamId,
+		ContentType: r.ContentType,
+		Schema:      r.Schema,
+		Data:        r.Data,
+	}
+	if len(r.Metadata) > 0 {
+		err := json.Unmarshal(r.Metadata, &e.Metadata)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// encodeMetadata returns NULL for events without metadata
+func encodeMetadata(metadata map[string]string) (sql.NullString, error) {
+	if len(metadata) == 0 {
+		return sql.NullString{}, nil
+	}
+	md, err := json.Marshal(metadata)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(md), Valid: true}, nil
+}
+
+func NewPostgresRepo(config Config) (*postgresRepo, error) {
+	r := &postgresRepo{
+		log:    log.With().Str("logger", "postgresRepo").Logger(),
+		config: config,
+	}
+	if config.PostgresDbConfig.DbUrl == "" {
+		return nil, fmt.Errorf("POSTGRES_DB_URL config entry required")
+	}
+
+	r.log.Info().Msgf("connecting to postgres")
+	db, err := sqlx.Connect("postgres", config.PostgresDbConfig.DbUrl)
+	if err != nil {
+		r.log.Error().Err(err).Msgf("could not connect to postgres")
+		return nil, err
+	}
+	if config.PostgresDbConfig.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(config.PostgresDbConfig.MaxOpenConns)
+	}
+	if config.PostgresDbConfig.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(config.PostgresDbConfig.MaxIdleConns)
+	}
+	r.db = db
+
+	err = r.migrate(context.Background())
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	r.log.Info().Msgf("connected to postgres")
+	return r, nil
+}
+
+/*
+migrate applies the migrations that were not applied yet. The advisory lock keeps several
+instances starting at the same time from running them twice.
+*/
+func (r *postgresRepo) migrate(ctx context.Context) error {
+	return r.transact(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(4242)")
+		if err != nil {
+			r.log.Error().Err(err).Msgf("could not lock for migrations")
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied BIGINT NOT NULL)")
+		if err != nil {
+			r.log.Error().Err(err).Msgf("could not create schema_migrations table")
+			return err
+		}
+		var current int
+		err = tx.GetContext(ctx, &current, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations")
+		if err != nil {
+			r.log.Error().Err(err).Msgf("could not get schema version")
+			return err
+		}
+		for i := current; i < len(postgresMigrations); i++ {
+			r.log.Info().Msgf("applying migration %d", i+1)
+			_, err = tx.ExecContext(ctx, postgresMigrations[i])
+			if err != nil {
+				r.log.Error().Err(err).Msgf("could not apply migration %d", i+1)
+				return err
+			}
+			_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, applied) VALUES ($1, $2)", i+1, time.Now().UnixMicro())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *postgresRepo) save(ctx context.Context, events []*dedb.Event, expected *dedb.ExpectedVersion, key saveKey) ([]*dedb.Event, error) {
+	log := r.log.With().Str("op", "save").Logger()
+	if len(events) == 0 {
+		return nil, fmt.Errorf("no events were supplied to save")
+	}
+	log.Debug().Msgf("saving %d events", len(events))
+	saved := events
+	err := r.transact(ctx, func(tx *sqlx.Tx) error {
+		var position int64
+		err := tx.GetContext(ctx, &position, "SELECT position FROM positions WHERE id = 1 FOR UPDATE")
+		if err != nil {
+			log.Error().Err(err).Msgf("could not lock the position")
+			return err
+		}
+
+		// a retry of a save that already went through gets the original result back
+		if key.key != "" {
+			_, err = tx.ExecContext(ctx, "DELETE FROM idempotency WHERE expires <= $1", time.Now().UnixMicro())
+			if err != nil {
+				log.Error().Err(err).Msgf("could not remove expired idempotency keys")
+				return err
+			}
+			original := []idempotencyRow{}
+			err = tx.SelectContext(ctx, &original, "SELECT request_hash, response FROM idempotency WHERE key = $1", key.key)
+			if err != nil {
+				log.Error().Err(err).Msgf("could not check for a previous save")
+				return err
+			}
+			if len(original) > 0 {
+				if original[0].RequestHash != key.hash {
+					return keyReused()
+				}
+				response := &dedb.SaveResponse{}
+				err = Decode(response, original[0].Response)
+				if err != nil {
+					log.Error().Err(err).Msgf("could not decode previous save")
+					return err
+				}
+				log.Debug().Msgf("save already done for idempotency key %s", key.key)
+				saved = response.Events
+				return nil
+			}
+		}
+
+		versions := make(map[string]int64)
+		for _, e := range events {
+			stream := memoryKey(e.Domain, e.DomainId)
+			if _, ok := versions[stream]; ok {
+				continue
+			}
+			var current int64
+			err = tx.GetContext(ctx, &current, "SELECT COALESCE(MAX(version), 0) FROM domain_events WHERE domain = $1 AND domain_id = $2", e.Domain, e.DomainId)
+			if err != nil {
+				log.Error().Err(err).Msgf("could not get current version of %s", e.DomainId)
+				return err
+			}
+			versions[stream] = current
+		}
+		err = checkExpectedVersion(events[0].DomainId, expected, versions[memoryKey(events[0].Domain, events[0].DomainId)])
+		if err != nil {
+			return err
+		}
+
+		insert := `
+        INSERT INTO domain_events (position, id, domain, domain_id, version, name, timestamp, trace_id, stream_id, metadata, content_type, schema, data)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+        `
+		timestamp := time.Now().UnixMicro()
+		for _, e := range events {
+			timestamp++
+			if e.Id == "" {
+				id, _ := generateId()
+				e.Id = id.String()
+			}
+			e.Timestamp = timestamp
+			stream := memoryKey(e.Domain, e.DomainId)
+			versions[stream]++
+			e.Version = versions[stream]
+			position++
+			e.Position = position
+
+			md, err := encodeMetadata(e.Metadata)
+			if err != nil {
+				log.Error().Err(err).Msgf("could not encode metadata of event %s", e.Id)
+				return err
+			}
+			_, err = tx.ExecContext(ctx, insert, e.Position, e.Id, e.Domain, e.DomainId, e.Version, e.Name, e.Timestamp, e.TraceId, e.StreamId, md, e.ContentType, e.Schema, e.Data)
+			if err != nil {
+				log.Error().Err(err).Msgf("could not save event %s", e.Id)
+				return err
+			}
+			_, err = tx.ExecContext(ctx, "INSERT INTO domains (domain, domain_id, timestamp) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", e.Domain, e.DomainId, e.Timestamp)
+			if err != nil {
+				log.Error().Err(err).Msgf("could not save domain id %s", e.DomainId)
+				return err
+			}
+			encoded, err := Encode(e)
+			if err != nil {
+				log.Error().Err(err).Msgf("could not encode event %s", e.Id)
+				return err
+			}
+			_, err = tx.ExecContext(ctx, "INSERT INTO outbox (position, event) VALUES ($1, $2)", e.Position, encoded)
+			if err != nil {
+				log.Error().Err(err).Msgf("could not add event %s to the outbox", e.Id)
+				return err
+			}
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE positions SET position = $1 WHERE id = 1", position)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not update the position")
+			return err
+		}
+
+		if key.key != "" {
+			encoded, err := Encode(&dedb.SaveResponse{Events: events})
+			if err != nil {
+				log.Error().Err(err).Msgf("could not encode save result")
+				return err
+			}
+			expires := time.Now().Add(dedupWindow(r.config)).UnixMicro()
+			_, err = tx.ExecContext(ctx, "INSERT INTO idempotency (key, request_hash, response, expires) VALUES ($1, $2, $3, $4)", key.key, key.hash, encoded, expires)
+			if err != nil {
+				log.Error().Err(err).Msgf("could not save idempotency key %s", key.key)
+				return err
+			}
+		}
+		return nil
+	})
+	if _, ok := status.FromError(err); !ok {
+		return nil, fmt.Errorf("Could not save event in dedb")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+func (r *postgresRepo) getDomain(ctx context.Context, domain string, domainId string, offset int64, limit int64) ([]*dedb.Event, error) {
+	log := r.log.With().Str("op", "getDomain").Logger()
+	log.Debug().Msgf("getting domain %s, id %s, offset %d, limit %d", domain, domainId, offset, limit)
+	sql := `
+    SELECT id, domain, domain_id, version, position, name, timestamp, trace_id, stream_id, metadata, content_type, schema, data
+    FROM domain_events
+    WHERE domain = $1 AND domain_id = $2 AND version > $3
+    ORDER BY version ASC
+    LIMIT NULLIF($4::BIGINT, 0)
+    `
+	rows := []eventRow{}
+	err := r.db.SelectContext(ctx, &rows, sql, domain, domainId, offset, limit)
+	if err != nil {
+		log.Error().Err(err).Msgf("could not query domain events for domain %s, id %s", domain, domainId)
+		return nil, err
+	}
+	return r.toEvents(rows)
+}
+
+func (r *postgresRepo) getDomainBackward(ctx context.Context, domain string, domainId string, before int64, limit int64) ([]*dedb.Event, error) {
+	log := r.log.With().Str("op", "getDomainBackward").Logger()
+	log.Debug().Msgf("getting domain %s, id %s backward, before %d, limit %d", domain, domainId, before, limit)
+	sql := `
+    SELECT id, domain, domain_id, version, position, name, timestamp, trace_id, stream_id, metadata, content_type, schema, data
+    FROM domain_events
+    WHERE domain = $1 AND domain_id = $2 AND ($3::BIGINT = 0 OR version < $3)
+    ORDER BY version DESC
+    LIMIT NULLIF($4::BIGINT, 0)
+    `
+	rows := []eventRow{}
+	err := r.db.SelectContext(ctx, &rows, sql, domain, domainId, before, limit)
+	if err != nil {
+		log.Error().Err(err).Msgf("could not query domain events for domain %s, id %s", domain, domainId)
+		return nil, err
+	}
+	return r.toEvents(rows)
+}
+
+func (r *postgresRepo) getDomainByTimeRange(ctx context.Context, domain string, domainId string, from int64, to int64, limit int64, direction dedb.Direction) ([]*dedb.Event, error) {
+	log := r.log.With().Str("op", "getDomainByTimeRange").Logger()
+	log.Debug().Msgf("getting domain %s, id %s, from %d to %d, limit %d", domain, domainId, from, to, limit)
+	sql := `
+    SELECT id, domain, domain_id, version, position, name, timestamp, trace_id, stream_id, metadata, content_type, schema, data
+    FROM domain_events
+    WHERE domain = $1 AND domain_id = $2 AND timestamp >= $3 AND timestamp <= $4
+    ORDER BY version ` + sqlOrder(direction) + `
+    LIMIT NULLIF($5::BIGINT, 0)
+    `
+	rows := []eventRow{}
+	err := r.db.SelectContext(ctx, &rows, sql, domain, domainId, from, timeRangeEnd(to), limit)
+	if err != nil {
+		log.Error().Err(err).Msgf("could not query domain events for domain %s, id %s", domain, domainId)
+		return nil, err
+	}
+	return r.toEvents(rows)
+}
+
+/*
+readAll pages through the events of every domain id by position. The filter is part of
+the query, so the last position gone through is that of the last event returned.
+*/
+func (r *postgresRepo) readAll(ctx context.Context, from int64, limit int64, filter eventFilter) ([]*dedb.Event, int64, error) {
+	log := r.log.With().Str("op", "readAll").Logger()
+	log.Debug().Msgf("reading all events from position %d, limit %d", from, limit)
+	sql := `
+    SELECT id, domain, domain_id, version, position, name, timestamp, trace_id, stream_id, metadata, content_type, schema, data
+    FROM domain_events
+    WHERE position > $1 AND ($2 = '' OR domain = $2) AND (CARDINALITY($3::TEXT[]) = 0 OR name = ANY($3))
+    ORDER BY position ASC
+    LIMIT NULLIF($4::BIGINT, 0)
+    `
+	rows := []eventRow{}
+	err := r.db.SelectContext(ctx, &rows, sql, from, filter.domain, pq.Array(filter.nameList()), limit)
+	if err != nil {
+		log.Error().Err(err).Msgf("could not query events from position %d", from)
+		return nil, 0, err
+	}
+	events, err := r.toEvents(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(events) == 0 {
+		return events, from, nil
+	}
+	return events, events[len(events)-1].Position, nil
+}
+
+func (r *postgresRepo) toEvents(rows []eventRow) ([]*dedb.Event, error) {
+	events := make([]*dedb.Event, 0, len(rows))
+	for _, row := range rows {
+		e, err := row.event()
+		if err != nil {
+			r.log.Error().Err(err).Msgf("could not decode event %s", row.Id)
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+func (r *postgresRepo) getDomainIds(ctx context.Context, domain string, offset int64, limit int64) ([]string, error) {
+	log := r.log.With().Str("op", "getDomainIds").Logger()
+	log.Debug().Msgf("getting domain ids for domain %s, offset %d, limit %d", domain, offset, limit)
+	sql := `
+    SELECT domain_id FROM domains
+    WHERE domain = $1
+    ORDER BY timestamp ASC, domain_id ASC
+    OFFSET $2 LIMIT NULLIF($3::BIGINT, 0)
+    `
+	ids := []string{}
+	err := r.db.SelectContext(ctx, &ids, sql, domain, offset, limit)
+	if err != nil {
+		log.Error().Err(err).Msgf("could not query domain ids for domain %s", domain)
+		return nil, err
+	}
+	return ids, nil
+}
+
+/*
+saveSnapshot stores the snapshot unless one with the same or a higher version exists. The
+snapshot can not cover events that were never saved.
+*/
+func (r *postgresRepo) saveSnapshot(ctx context.Context, snapshot *dedb.Snapshot) error {
+	log := r.log.With().Str("op", "saveSnapshot").Logger()
+	err := r.transact(ctx, func(tx *sqlx.Tx) error {
+		var current int64
+		err := tx.GetContext(ctx, &current, "SELECT COALESCE(MAX(version), 0) FROM domain_events WHERE domain = $1 AND domain_id = $2", snapshot.Domain, snapshot.DomainId)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not get current version of %s", snapshot.DomainId)
+			return err
+		}
+		if snapshot.Version > current {
+			return status.Errorf(codes.FailedPrecondition, "snapshot version %d is ahead of domain id %s at version %d", snapshot.Version, snapshot.DomainId, current)
+		}
+		md, err := encodeMetadata(snapshot.Metadata)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not encode snapshot metadata")
+			return err
+		}
+		snapshot.Timestamp = time.Now().UnixMicro()
+		sql := `
+        INSERT INTO snapshots (domain, domain_id, version, timestamp, metadata, data)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        ON CONFLICT (domain, domain_id) DO UPDATE SET
+            version = excluded.version,
+            timestamp = excluded.timestamp,
+            metadata = excluded.metadata,
+            data = excluded.data
+        WHERE excluded.version > snapshots.version
+        `
+		_, err = tx.ExecContext(ctx, sql, snapshot.Domain, snapshot.DomainId, snapshot.Version, snapshot.Timestamp, md, snapshot.Data)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not save snapshot for %s", snapshot.DomainId)
+		}
+		return err
+	})
+	if _, ok := status.FromError(err); !ok {
+		return fmt.Errorf("Could not save snapshot in dedb")
+	}
+	return err
+}
+
+func (r *postgresRepo) getSnapshot(ctx context.Context, domain string, domainId string) (*dedb.Snapshot, error) {
+	log := r.log.With().Str("op", "getSnapshot").Logger()
+	sql := "SELECT domain, domain_id, version, timestamp, COALESCE(metadata::TEXT, '') AS metadata, data FROM snapshots WHERE domain = $1 AND domain_id = $2"
+	rows := []snapshotRow{}
+	err := r.db.SelectContext(ctx, &rows, sql, domain, domainId)
+	if err != nil {
+		log.Error().Err(err).Msgf("could not query snapshot for domain %s, id %s", domain, domainId)
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	row := rows[0]
+	snapshot := &dedb.Snapshot{
+		Domain:    row.Domain,
+		DomainId:  row.DomainId,
+		Version:   row.Version,
+		Timestamp: row.Timestamp,
+		Data:      row.Data,
+	}
+	if row.Metadata != "" {
+		err = json.Unmarshal([]byte(row.Metadata), &snapshot.Metadata)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not decode snapshot metadata")
+			return nil, err
+		}
+	}
+	return snapshot, nil
+}
+
+// pending returns the oldest events in the outbox, in position order
+func (r *postgresRepo) pending(ctx context.Context, limit int64) ([]*dedb.Event, error) {
+	log := r.log.With().Str("op", "pending").Logger()
+	rows := []string{}
+	err := r.db.SelectContext(ctx, &rows, "SELECT event FROM outbox ORDER BY position ASC LIMIT $1", limit)
+	if err != nil {
+		log.Error().Err(err).Msgf("could not read the outbox")
+		return nil, err
+	}
+	events := make([]*dedb.Event, 0, len(rows))
+	for _, je := range rows {
+		e := &dedb.Event{}
+		err := Decode(e, je)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not decode event")
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// published removes the events from the outbox
+func (r *postgresRepo) published(ctx context.Context, events []*dedb.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	positions := make([]int64, 0, len(events))
+	for _, e := range events {
+		positions = append(positions, e.Position)
+	}
+	sql, args, err := sqlx.In("DELETE FROM outbox WHERE position IN (?)", positions)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx, r.db.Rebind(sql), args...)
+	if err != nil {
+		r.log.Error().Err(err).Msgf("could not remove published events from the outbox")
+	}
+	return err
+}
+
+/*
+saveSchema registers the schema, taking the next version when it has none. Registering a
+version again is a no op if the definition is the same, and an error if not. The schemas
+of an event are locked through its latest version so concurrent registrations queue up.
+*/
+func (r *postgresRepo) saveSchema(ctx context.Context, schema *dedb.Schema) (*dedb.Schema, error) {
+	log := r.log.With().Str("op", "saveSchema").Logger()
+	saved := proto.Clone(schema).(*dedb.Schema)
+	err := r.transact(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", saved.Domain+":"+saved.EventName)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not lock schemas of %s", saved.EventName)
+			return err
+		}
+		if saved.Version == 0 {
+			err = tx.GetContext(ctx, &saved.Version, "SELECT COALESCE(MAX(version), 0) + 1 FROM schemas WHERE domain = $1 AND event_name = $2", saved.Domain, saved.EventName)
+			if err != nil {
+				log.Error().Err(err).Msgf("could not get latest schema version of %s", saved.EventName)
+				return err
+			}
+		}
+		rows := []schemaRow{}
+		err = tx.SelectContext(ctx, &rows, "SELECT * FROM schemas WHERE domain = $1 AND event_name = $2 AND version = $3", saved.Domain, saved.EventName, saved.Version)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not check for an existing schema")
+			return err
+		}
+		if len(rows) > 0 {
+			existing := rows[0].schema()
+			if !sameSchema(existing, saved) {
+				return schemaExists(saved)
+			}
+			saved = existing
+			return nil
+		}
+		saved.Timestamp = time.Now().UnixMicro()
+		_, err = tx.ExecContext(ctx, "INSERT INTO schemas (domain, event_name, version, type, definition, message_name, timestamp) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+			saved.Domain, saved.EventName, saved.Version, int32(saved.Type), saved.Definition, saved.MessageName, saved.Timestamp)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not save schema")
+		}
+		return err
+	})
+	if _, ok := status.FromError(err); !ok {
+		return nil, fmt.Errorf("Could not save schema in dedb")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+func (r *postgresRepo) getSchema(ctx context.Context, domain string, eventName string, version int32) (*dedb.Schema, error) {
+	sql := "SELECT * FROM schemas WHERE domain = $1 AND event_name = $2 AND version = $3"
+	args := []interface{}{domain, eventName, version}
+	if version == 0 {
+		sql = "SELECT * FROM schemas WHERE domain = $1 AND event_name = $2 ORDER BY version DESC LIMIT 1"
+		args = args[:2]
+	}
+	rows := []schemaRow{}
+	err := r.db.SelectContext(ctx, &rows, sql, args...)
+	if err != nil {
+		r.log.Error().Err(err).Msgf("could not query schema of %s %s", domain, eventName)
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return rows[0].schema(), nil
+}
+
+func (r *postgresRepo) listSchemas(ctx context.Context, domain string, eventName string) ([]*dedb.Schema, error) {
+	sql := `
+    SELECT * FROM schemas
+    WHERE ($1 = '' OR domain = $1) AND ($2 = '' OR event_name = $2)
+    ORDER BY domain, event_name, version
+    `
+	rows := []schemaRow{}
+	err := r.db.SelectContext(ctx, &rows, sql, domain, eventName)
+	if err != nil {
+		r.log.Error().Err(err).Msgf("could not list schemas")
+		return nil, err
+	}
+	return schemaRows(rows), nil
+}
+
+// transact runs fn in a transaction, committing if it returns nil
+func (r *postgresRepo) transact(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		r.log.Error().Err(err).Msgf("could not start transaction")
+		return err
+	}
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		r.log.Error().Err(err).Msgf("could not commit transaction")
+	}
+	return err
+}
+
+func (r *postgresRepo) shutdown() {
+	r.db.Close()
+}
@@ -0,0 +1,289 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"dedb"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+the postgres tests run against POSTGRES_TEST_URL when it is set, and fail when it can not be
+reached. Otherwise they run against an embedded postgres started by the tests, and are
+skipped when it can not be started, as it downloads the binaries on first use. The tables
+are truncated before each test, so POSTGRES_TEST_URL must point at a throwaway database.
+*/
+func TestPostgresRepo(t *testing.T) {
+	url := os.Getenv("POSTGRES_TEST_URL")
+	external := url != ""
+	if !external {
+		config := embeddedpostgres.DefaultConfig().
+			Port(54329).
+			RuntimePath(t.TempDir()).
+			Logger(&bytes.Buffer{})
+		pg := embeddedpostgres.NewDatabase(config)
+		err := pg.Start()
+		if err != nil {
+			t.Skipf("could not start embedded postgres, set POSTGRES_TEST_URL to run against another one: %v", err)
+		}
+		defer pg.Stop()
+		url = config.GetConnectionURL() + "?sslmode=disable"
+	}
+	repo, err := NewPostgresRepo(Config{PostgresDbConfig: PostgresDbConfig{DbUrl: url}})
+	if err != nil {
+		if external {
+			t.Fatalf("could not connect to postgres at POSTGRES_TEST_URL: %v", err)
+		}
+		t.Fatalf("could not connect to embedded postgres: %v", err)
+	}
+	defer repo.shutdown()
+	reset := func() {
+		_, err := repo.db.Exec("TRUNCATE domain_events, domains, snapshots, idempotency, outbox, schemas; UPDATE positions SET position = 0")
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	t.Run("Save", func(t *testing.T) {
+		reset()
+		testPostgresRepoSave(t, repo)
+	})
+	t.Run("GetDomain", func(t *testing.T) {
+		reset()
+		testPostgresRepoGetDomain(t, repo)
+	})
+	t.Run("ConcurrentWriters", func(t *testing.T) {
+		reset()
+		testPostgresRepoConcurrentWriters(t, repo)
+	})
+	t.Run("Idempotent", func(t *testing.T) {
+		reset()
+		testPostgresRepoIdempotent(t, repo)
+	})
+	t.Run("Snapshots", func(t *testing.T) {
+		reset()
+		testPostgresRepoSnapshots(t, repo)
+	})
+	t.Run("ReadAll", func(t *testing.T) {
+		reset()
+		testPostgresRepoReadAll(t, repo)
+	})
+	t.Run("GetDomainByTimeRange", func(t *testing.T) {
+		reset()
+		testRepoGetDomainByTimeRange(t, repo)
+	})
+	t.Run("GetDomainBackward", func(t *testing.T) {
+		reset()
+		testRepoGetDomainBackward(t, repo)
+	})
+	t.Run("SaveSharedDomainId", func(t *testing.T) {
+		reset()
+		testRepoSaveSharedDomainId(t, repo)
+	})
+	t.Run("Migrations are only applied once", func(t *testing.T) {
+		again, err := NewPostgresRepo(Config{PostgresDbConfig: PostgresDbConfig{DbUrl: url}})
+		assert.Nil(t, err)
+		again.shutdown()
+	})
+}
+
+func testPostgresRepoSave(t *testing.T, repo *postgresRepo) {
+	// setup
+	ctx := context.Background()
+	cases := []struct {
+		name     string
+		events   []*dedb.Event
+		expected *dedb.ExpectedVersion
+		versions []int64
+		err      error
+	}{
+		{
+			name: "Simple happy path",
+			events: []*dedb.Event{
+				{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "testid", Metadata: map[string]string{"by": "test"}},
+			},
+			expected: &dedb.ExpectedVersion{Kind: dedb.ExpectedVersion_NO_STREAM},
+			versions: []int64{1},
+		},
+		{
+			name: "Versions continue per domain id",
+			events: []*dedb.Event{
+				{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "testid"},
+				{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "testid2"},
+			},
+			versions: []int64{2, 1},
+		},
+		{
+			name: "Stale expected version",
+			events: []*dedb.Event{
+				{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "testid"},
+			},
+			expected: &dedb.ExpectedVersion{Kind: dedb.ExpectedVersion_EXACT, Version: 1},
+			err:      versionConflict("testid", &dedb.ExpectedVersion{Kind: dedb.ExpectedVersion_EXACT, Version: 1}, 2),
+		},
+		{
+			name:   "Simple error for empty events list",
+			events: []*dedb.Event{},
+			err:    fmt.Errorf("no events were supplied to save"),
+		},
+	}
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			saved, err := repo.save(ctx, tc.events, tc.expected, saveKey{})
+			if tc.err == nil {
+				assert.Nil(t, err)
+				for i, e := range saved {
+					assert.NotEqual(t, "", e.Id)
+					assert.Equal(t, tc.versions[i], e.Version)
+				}
+			} else {
+				assert.Equal(t, tc.err.Error(), err.Error())
+			}
+		})
+	}
+
+	// positions are global and in commit order
+	pending, _ := repo.pending(ctx, 10)
+	assert.Equal(t, 3, len(pending))
+	for i, e := range pending {
+		assert.Equal(t, int64(i+1), e.Position)
+	}
+	repo.published(ctx, pending)
+	pending, _ = repo.pending(ctx, 10)
+	assert.Equal(t, 0, len(pending))
+
+	ids, _ := repo.getDomainIds(ctx, "CUSTOMER", 0, 0)
+	assert.Equal(t, []string{"testid", "testid2"}, ids)
+}
+
+func testPostgresRepoGetDomain(t *testing.T, repo *postgresRepo) {
+	// setup
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		e := &dedb.Event{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "testid", Metadata: map[string]string{"i": fmt.Sprint(i)}, Data: []byte{byte(i)}}
+		repo.save(ctx, []*dedb.Event{e}, nil, saveKey{})
+	}
+	cases := []struct {
+		name     string
+		offset   int64
+		limit    int64
+		versions []int64
+	}{
+		{name: "All events", versions: []int64{1, 2, 3, 4, 5}},
+		{name: "From an offset", offset: 3, versions: []int64{4, 5}},
+		{name: "Limited", offset: 1, limit: 2, versions: []int64{2, 3}},
+		{name: "Past the end", offset: 5, versions: []int64{}},
+	}
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			events, err := repo.getDomain(ctx, "CUSTOMER", "testid", tc.offset, tc.limit)
+			assert.Nil(t, err)
+			versions := []int64{}
+			for _, e := range events {
+				versions = append(versions, e.Version)
+				assert.Equal(t, fmt.Sprint(e.Version-1), e.Metadata["i"])
+				assert.Equal(t, []byte{byte(e.Version - 1)}, e.Data)
+			}
+			assert.Equal(t, tc.versions, versions)
+		})
+	}
+}
+
+func testPostgresRepoConcurrentWriters(t *testing.T, repo *postgresRepo) {
+	// setup
+	ctx := context.Background()
+	writers := 10
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+
+	// when
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			expected := &dedb.ExpectedVersion{Kind: dedb.ExpectedVersion_NO_STREAM}
+			_, err := repo.save(ctx, []*dedb.Event{{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "racer"}}, expected, saveKey{})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	// then
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+		}
+	}
+	assert.Equal(t, 1, succeeded)
+	events, _ := repo.getDomain(ctx, "CUSTOMER", "racer", 0, 0)
+	assert.Equal(t, 1, len(events))
+}
+
+func testPostgresRepoIdempotent(t *testing.T, repo *postgresRepo) {
+	testRepoSaveIdempotent(t, repo)
+}
+
+func testPostgresRepoReadAll(t *testing.T, repo *postgresRepo) {
+	// setup
+	ctx := context.Background()
+	_, err := repo.save(ctx, []*dedb.Event{
+		{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "one"},
+		{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "one"},
+	}, nil, saveKey{})
+	assert.Nil(t, err)
+	_, err = repo.save(ctx, []*dedb.Event{{Name: "OrderPlaced", Domain: "ORDER", DomainId: "two"}}, nil, saveKey{})
+	assert.Nil(t, err)
+
+	// when
+	all, next, err := repo.readAll(ctx, 0, 0, eventFilter{})
+	assert.Nil(t, err)
+	page, pageNext, _ := repo.readAll(ctx, 1, 1, eventFilter{})
+	filtered, _, _ := repo.readAll(ctx, 0, 0, newEventFilter("CUSTOMER", []string{"CustomerUpdated", "OrderPlaced"}))
+
+	// then
+	assert.Equal(t, 3, len(all))
+	assert.Equal(t, int64(3), next)
+	assert.Equal(t, int64(2), page[0].Position)
+	assert.Equal(t, int64(2), pageNext)
+	assert.Equal(t, 1, len(filtered))
+	assert.Equal(t, "CustomerUpdated", filtered[0].Name)
+}
+
+func testPostgresRepoSnapshots(t *testing.T, repo *postgresRepo) {
+	// setup
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		repo.save(ctx, []*dedb.Event{{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "testid"}}, nil, saveKey{})
+	}
+
+	// when / then
+	err := repo.saveSnapshot(ctx, &dedb.Snapshot{Domain: "CUSTOMER", DomainId: "testid", Version: 4})
+	assert.NotNil(t, err)
+
+	err = repo.saveSnapshot(ctx, &dedb.Snapshot{Domain: "CUSTOMER", DomainId: "testid", Version: 2, Data: []byte("two"), Metadata: map[string]string{"k": "v"}})
+	assert.Nil(t, err)
+	err = repo.saveSnapshot(ctx, &dedb.Snapshot{Domain: "CUSTOMER", DomainId: "testid", Version: 1, Data: []byte("one")})
+	assert.Nil(t, err)
+
+	snapshot, err := repo.getSnapshot(ctx, "CUSTOMER", "testid")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), snapshot.Version)
+	assert.Equal(t, []byte("two"), snapshot.Data)
+	assert.Equal(t, "v", snapshot.Metadata["k"])
+
+	snapshot, err = repo.getSnapshot(ctx, "CUSTOMER", "unknown")
+	assert.Nil(t, err)
+	assert.Nil(t, snapshot)
+}
@@ -4,23 +4,47 @@ import (
 	"context"
 	"dedb"
 	"encoding/json"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	readCount  = 10               // max number of messages read per domain stream in one call
+	readBlock  = time.Second      // how long a read waits for new messages before returning empty
+	claimIdle  = 30 * time.Second // pending messages idle this long are claimed by the next reader
+	streamRoot = "dedb:stream:"
+)
+
 type redisPublisher struct {
-	log    zerolog.Logger
-	config Config
-	client *redis.Client
+	log       zerolog.Logger
+	config    Config
+	client    redis.UniversalClient
+	claimIdle time.Duration // how long a message stays pending before another consumer claims it
 }
 
-// NewRedisPublisher function  
+/*
+removeConsumer deletes the consumer from the group unless it has pending messages again,
+as deleting a consumer drops whatever is still pending for it. It is run as a script so
+nothing can be delivered to the consumer between the check and the delete.
+*/
+var removeConsumer = redis.NewScript(`
+if #redis.call('XPENDING', KEYS[1], ARGV[1], '-', '+', 1, ARGV[2]) > 0 then
+	return 0
+end
+return redis.call('XGROUP', 'DELCONSUMER', KEYS[1], ARGV[1], ARGV[2])
+`)
+
+// NewRedisPublisher function
 func NewRedisPublisher(config Config) (*redisPublisher, error) {
 	pub := &redisPublisher{
-		log:    log.With().Str("logger", "redisPublisher").Logger(),
-		config: config,
+		log:       log.With().Str("logger", "redisPublisher").Logger(),
+		config:    config,
+		claimIdle: claimIdle,
 	}
 
 	client, err := newPool(false, pub.config, &pub.log)
@@ -32,11 +56,12 @@ func NewRedisPublisher(config Config) (*redisPublisher, error) {
 	return pub, nil
 }
 
-func (p *redisPublisher) publish(ctx context.Context, events []*dedb.Event) {
+func (p *redisPublisher) publish(ctx context.Context, events []*dedb.Event) error {
 	for _, event := range events {
 		encoded, err := Encode(event)
 		if err != nil {
 			p.log.Error().Err(err).Msgf("could not encode event id %s", event.Id)
+			return err
 		} else {
 			md := ""
 			if event.Metadata != nil {
@@ -45,21 +70,247 @@ func (p *redisPublisher) publish(ctx context.Context, events []*dedb.Event) {
 					md = string(jsonStr)
 				}
 			}
-			args := redis.XAddArgs{
-				Stream: "dedb:stream:" + event.Domain,
-				Values: map[string]interface{}{
-					"id":        event.Id,
-					"name":      event.Name,
-					"timestamp": event.Timestamp,
-					"metadata":  md,
-					"data":      encoded,
-				},
+			values := map[string]interface{}{
+				"id":        event.Id,
+				"name":      event.Name,
+				"timestamp": event.Timestamp,
+				"metadata":  md,
+				"data":      encoded,
+			}
+			// every event goes to the stream of all domains as well, for subscribers of everything.
+			// In a cluster the two streams are in different slots, so they are written apart
+			// and a failed publish can leave the event in the domain stream only, until the
+			// retry adds it to both again.
+			publish := p.client.TxPipelined
+			if p.config.RedisDbConfig.cluster() {
+				publish = p.client.Pipelined
+			}
+			_, err = publish(ctx, func(pipe redis.Pipeliner) error {
+				pipe.XAdd(ctx, &redis.XAddArgs{Stream: p.stream(event.Domain), Values: values})
+				pipe.XAdd(ctx, &redis.XAddArgs{Stream: p.stream(allDomains), Values: values})
+				return nil
+			})
+			if err != nil {
+				p.log.Error().Err(err).Msgf("could not publish event id %s", event.Id)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+stream is the key of the domain stream. In a cluster the domain is a hash tag, which spreads
+the streams over the slots rather than putting every one of them on the same node.
+*/
+func (p *redisPublisher) stream(domain string) string {
+	if p.config.RedisDbConfig.cluster() {
+		return streamRoot + "{" + domain + "}"
+	}
+	return streamRoot + domain
+}
+
+/*
+join creates the consumer group on the domain stream if it does not exist yet. New
+groups start at the end of the stream, so only events published from then on are delivered.
+*/
+func (p *redisPublisher) join(ctx context.Context, group string, domain string) error {
+	err := p.client.XGroupCreateMkStream(ctx, p.stream(domain), group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		p.log.Error().Err(err).Msgf("could not create consumer group %s for domain %s", group, domain)
+		return err
+	}
+	return nil
+}
+
+/*
+read returns the next batch of messages for the consumer. Messages left pending by
+consumers that went away are claimed first, then new messages are read, blocking for
+a short while if none are available. The consumers the messages were claimed from are
+removed from the group once nothing is pending for them anymore, otherwise every
+consumer that went away holding messages would stay in the group for good.
+*/
+func (p *redisPublisher) read(ctx context.Context, group string, consumer string, domains []string) ([]*message, error) {
+	messages := make([]*message, 0)
+	for _, domain := range domains {
+		idle, err := p.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: p.stream(domain),
+			Group:  group,
+			Idle:   p.claimIdle,
+			Start:  "-",
+			End:    "+",
+			Count:  readCount,
+		}).Result()
+		if err != nil && err != redis.Nil {
+			p.log.Error().Err(err).Msgf("could not check pending messages for domain %s", domain)
+			return nil, err
+		}
+		if len(idle) == 0 {
+			continue
+		}
+		ids := make([]string, 0, len(idle))
+		for _, pending := range idle {
+			ids = append(ids, pending.ID)
+		}
+		claimed, err := p.client.XClaim(ctx, &redis.XClaimArgs{
+			Stream:   p.stream(domain),
+			Group:    group,
+			Consumer: consumer,
+			MinIdle:  p.claimIdle,
+			Messages: ids,
+		}).Result()
+		if err != nil && err != redis.Nil {
+			p.log.Error().Err(err).Msgf("could not claim pending messages for domain %s", domain)
+			return nil, err
+		}
+		messages = append(messages, p.toMessages(domain, claimed)...)
+		p.removeClaimed(ctx, group, consumer, domain, idle)
+	}
+	if len(messages) > 0 {
+		return messages, nil
+	}
+	if p.config.RedisDbConfig.cluster() && len(domains) > 1 {
+		return p.readEach(ctx, group, consumer, domains)
+	}
+	return p.readNew(ctx, group, consumer, domains)
+}
+
+// readNew reads the messages never delivered to the group from the domain streams in one call
+func (p *redisPublisher) readNew(ctx context.Context, group string, consumer string, domains []string) ([]*message, error) {
+	messages := make([]*message, 0)
+	streams := make([]string, 0, len(domains)*2)
+	byStream := make(map[string]string)
+	for _, domain := range domains {
+		streams = append(streams, p.stream(domain))
+		byStream[p.stream(domain)] = domain
+	}
+	for range domains {
+		streams = append(streams, ">")
+	}
+	reply, err := p.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    group,
+		Consumer: consumer,
+		Streams:  streams,
+		Count:    readCount,
+		Block:    readBlock,
+	}).Result()
+	if err == redis.Nil {
+		return messages, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, stream := range reply {
+		messages = append(messages, p.toMessages(byStream[stream.Stream], stream.Messages)...)
+	}
+	return messages, nil
+}
+
+/*
+readEach reads each domain stream in a call of its own, as the streams of a cluster are in
+different slots. The calls block side by side and all of them are waited for, since what one
+reads is pending for the consumer whether it is returned or not.
+*/
+func (p *redisPublisher) readEach(ctx context.Context, group string, consumer string, domains []string) ([]*message, error) {
+	read := make([][]*message, len(domains))
+	errs := make([]error, len(domains))
+	var wg sync.WaitGroup
+	for i, domain := range domains {
+		wg.Add(1)
+		go func(i int, domain string) {
+			defer wg.Done()
+			read[i], errs[i] = p.readNew(ctx, group, consumer, []string{domain})
+		}(i, domain)
+	}
+	wg.Wait()
+	messages := make([]*message, 0)
+	for i := range domains {
+		if errs[i] != nil {
+			// anything the other calls read is claimed once idle
+			return nil, errs[i]
+		}
+		messages = append(messages, read[i]...)
+	}
+	return messages, nil
+}
+
+// removeClaimed removes the previous owners of the claimed messages that have nothing pending left
+func (p *redisPublisher) removeClaimed(ctx context.Context, group string, consumer string, domain string, claimed []redis.XPendingExt) {
+	owners := make(map[string]bool)
+	for _, pending := range claimed {
+		if pending.Consumer != consumer && !owners[pending.Consumer] {
+			owners[pending.Consumer] = true
+			err := removeConsumer.Run(ctx, p.client, []string{p.stream(domain)}, group, pending.Consumer).Err()
+			if err != nil {
+				// the consumer is left for the next claim to remove
+				p.log.Warn().Err(err).Msgf("could not remove consumer %s from group %s", pending.Consumer, group)
 			}
-			p.client.XAdd(ctx, &args)
 		}
 	}
 }
 
+func (p *redisPublisher) toMessages(domain string, entries []redis.XMessage) []*message {
+	messages := make([]*message, 0, len(entries))
+	for _, entry := range entries {
+		data, _ := entry.Values["data"].(string)
+		e := &dedb.Event{}
+		err := Decode(e, data)
+		if err != nil {
+			// nothing can ever decode this entry, so it is logged and delivered without an event
+			p.log.Error().Err(err).Msgf("could not decode stream entry %s for domain %s", entry.ID, domain)
+			e = nil
+		}
+		messages = append(messages, &message{id: entry.ID, domain: domain, event: e})
+	}
+	return messages
+}
+
+func (p *redisPublisher) ack(ctx context.Context, group string, domain string, id string) error {
+	return p.client.XAck(ctx, p.stream(domain), group, id).Err()
+}
+
+/*
+release removes the consumer from the group on each domain stream. A consumer still
+holding unacknowledged messages is left in place so those messages can be claimed by
+another consumer of the group, which then removes it.
+*/
+func (p *redisPublisher) release(ctx context.Context, group string, consumer string, domains []string) error {
+	for _, domain := range domains {
+		pending, err := p.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream:   p.stream(domain),
+			Group:    group,
+			Start:    "-",
+			End:      "+",
+			Count:    1,
+			Consumer: consumer,
+		}).Result()
+		if err != nil && err != redis.Nil {
+			p.log.Error().Err(err).Msgf("could not check pending messages of consumer %s", consumer)
+			return err
+		}
+		if len(pending) > 0 {
+			p.log.Warn().Msgf("consumer %s has unacknowledged messages on domain %s, leaving them for the group", consumer, domain)
+			continue
+		}
+		err = p.client.XGroupDelConsumer(ctx, p.stream(domain), group, consumer).Err()
+		if err != nil {
+			p.log.Error().Err(err).Msgf("could not remove consumer %s from group %s", consumer, group)
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *redisPublisher) drop(ctx context.Context, group string, domains []string) error {
+	for _, domain := range domains {
+		err := p.client.XGroupDestroy(ctx, p.stream(domain), group).Err()
+		if err != nil {
+			p.log.Error().Err(err).Msgf("could not drop consumer group %s for domain %s", group, domain)
+			return err
+		}
+	}
+	return nil
+}
+
 func (r *redisPublisher) shutdown() {
 	r.client.Close()
 }
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"context"
+	"dedb"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisPublisherRemovesClaimedConsumers(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := Config{
+		RedisDbConfig: RedisDbConfig{
+			DbAddress: "redis:6379",
+			DbIndex:   0,
+		},
+	}
+	pub, err := NewRedisPublisher(config)
+	assert.Nil(t, err)
+	defer pub.shutdown()
+	pub.claimIdle = 10 * time.Millisecond
+	group := "claims-" + time.Now().Format("150405.000000")
+	domain := "CLAIMS"
+	assert.Nil(t, pub.join(ctx, group, domain))
+	defer pub.drop(ctx, group, []string{domain})
+	assert.Nil(t, pub.publish(ctx, []*dedb.Event{{Id: "first", Name: "Claimed", Domain: domain, DomainId: "1"}}))
+	messages, err := pub.read(ctx, group, "gone", []string{domain})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(messages))
+	assert.Nil(t, pub.release(ctx, group, "gone", []string{domain}))
+	assert.Equal(t, []string{"gone"}, testConsumers(t, pub, group, domain))
+	time.Sleep(20 * time.Millisecond)
+
+	// when
+	claimed, err := pub.read(ctx, group, "next", []string{domain})
+
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(claimed))
+	assert.Equal(t, "first", claimed[0].event.Id)
+	assert.Equal(t, []string{"next"}, testConsumers(t, pub, group, domain))
+}
+
+// testConsumers lists the consumers of the group, read raw as the reply differs between redis versions
+func testConsumers(t *testing.T, pub *redisPublisher, group string, domain string) []string {
+	reply, err := pub.client.Do(context.Background(), "XINFO", "CONSUMERS", pub.stream(domain), group).Slice()
+	assert.Nil(t, err)
+	names := []string{}
+	for _, consumer := range reply {
+		fields, _ := consumer.([]interface{})
+		for i := 0; i+1 < len(fields); i += 2 {
+			if fields[i] == "name" {
+				names = append(names, fields[i+1].(string))
+			}
+		}
+	}
+	return names
+}
+
+func TestRedisPublisherCluster(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := Config{
+		RedisDbConfig: RedisDbConfig{
+			Mode:      redisCluster,
+			Addresses: []string{"redis:6379"},
+		},
+	}
+	pub, err := NewRedisPublisher(config)
+	assert.Nil(t, err)
+	defer pub.shutdown()
+	group := "cluster-" + time.Now().Format("150405.000000")
+	domains := []string{"CLUSTER1", "CLUSTER2"}
+	for _, domain := range domains {
+		assert.Nil(t, pub.join(ctx, group, domain))
+	}
+	defer pub.drop(ctx, group, domains)
+
+	// when
+	err = pub.publish(ctx, []*dedb.Event{
+		{Id: "first", Name: "Clustered", Domain: "CLUSTER1", DomainId: "1"},
+		{Id: "second", Name: "Clustered", Domain: "CLUSTER2", DomainId: "2"},
+	})
+
+	// then each domain has a stream in its own slot, read together by the consumer
+	assert.Nil(t, err)
+	assert.Equal(t, "dedb:stream:{CLUSTER1}", pub.stream("CLUSTER1"))
+	messages, err := pub.read(ctx, group, "reader", domains)
+	assert.Nil(t, err)
+	read := map[string]string{}
+	for _, m := range messages {
+		read[m.event.Id] = m.domain
+	}
+	assert.Equal(t, map[string]string{"first": "CLUSTER1", "second": "CLUSTER2"}, read)
+	for _, m := range messages {
+		assert.Nil(t, pub.ack(ctx, group, m.domain, m.id))
+	}
+}
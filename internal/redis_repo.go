@@ -2,13 +2,20 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
 
 	"dedb"
 )
@@ -16,26 +23,64 @@ import (
 const (
 	domainTypes = "domain_types"
 	domains     = "domains"
+
+	readAllBatch = 500 // index entries fetched at a time by readAll
 )
 
 /*
-data structure is as follows:
-each domain type has a sorted set of domain ids, sorted by microsecond it was added
+data structure is as follows, every key of a domain id being on the shard of the domain id:
+each domain type has a sorted set of the domain ids on each shard, sorted by microsecond it was added
 
 	dedb:domain_types:<domain> => SortedSet
 
 each domain instance has a list of events that make up that domain instance
 
-	dedb:domain_events:<domain_id> => List
+	dedb:domain_events:<shard>:<domain>:<domain_id> => List
 
 each domain id has a sorted set reverse index of the timestamp:event_id
 
-	dedb:domain_events_timestamp_idx:0:<domain_id> => SortedSet
+	dedb:domain_events_timestamp_idx:<shard>:<domain>:<domain_id> => SortedSet
+
+each shard counts the events saved on it, the position of an event being its count times
+the number of shards plus the shard, see redis_shard.go. The version of an event is its
+place in the domain events list
+
+	dedb:position:<shard>:global => String
+
+every event is indexed by its position as domain:domain_id:version, for reading all events in
+commit order, and again per domain
+
+	dedb:position_idx:<shard>:global => SortedSet
+	dedb:domain_position_idx:<shard>:<domain> => SortedSet
+
+each domain id can have a snapshot, only the one with the highest version is kept
+
+	dedb:snapshots:<shard>:<domain>:<domain_id> => String
+
+the result of a save with an idempotency key is kept for the dedup window to answer retries,
+along with the hash of the request it answers, by the key scoped as in saveKey
+
+	dedb:idempotency:<shard>:<key> => Hash
+
+saved events wait in the outbox, sorted by position, until they are published
+
+	dedb:outbox:<shard>:global => SortedSet
+
+each shard notes once its domain id keys include the domain, see keyByDomain
+
+	dedb:layout:<shard>:global => String
+
+registered schemas are kept on shard 0 by domain:event name:version, along with the latest
+version of each domain:event name
+
+	dedb:schemas:0:global => Hash
+	dedb:schema_versions:0:global => Hash
 */
 type redisRepo struct {
 	log    zerolog.Logger
 	config Config
-	pool   *redis.Client
+	pool   redis.UniversalClient   // the main instance, holding the position counter and schemas
+	shards []redis.UniversalClient // the instance of each shard
 }
 
 type redisKey struct {
@@ -43,10 +88,15 @@ type redisKey struct {
 	shard  int    // shard number
 	prefix string // prefix name like 'domains', 'domain_types', 'domain_events'
 	key    string // the actual key value of the entry
+	tagged bool   // the shard is a hash tag, dedb:<prefix>:{<shard>}:<key>
 }
 
 func (rk redisKey) String() string {
-	return rk.db + ":" + rk.prefix + ":" + strconv.FormatInt(int64(rk.shard), 10) + ":" + rk.key
+	shard := strconv.FormatInt(int64(rk.shard), 10)
+	if rk.tagged {
+		shard = "{" + shard + "}"
+	}
+	return rk.db + ":" + rk.prefix + ":" + shard + ":" + rk.key
 }
 
 func NewRedisRepo(config Config) (*redisRepo, error) {
@@ -67,170 +117,1018 @@ func NewRedisRepo(config Config) (*redisRepo, error) {
 	}
 	log.Info().Msgf("connected to redis")
 	repo.pool = pool
+	err = repo.connectShards()
+	if err != nil {
+		repo.log.Error().Err(err).Msgf("could not connect to the redis shards")
+		return nil, err
+	}
+
+	// saves before the shards had their own sequences took their positions from the one of
+	// shard 0, the others are raised past them
+	_, err = repo.fence(context.Background())
+	if err != nil {
+		repo.log.Error().Err(err).Msgf("could not fence the shard positions")
+		return nil, err
+	}
+
+	err = repo.keyByDomain(context.Background())
+	if err != nil {
+		repo.log.Error().Err(err).Msgf("could not move domain ids to keys by domain")
+		return nil, err
+	}
+
+	err = repo.indexPositions(context.Background())
+	if err != nil {
+		repo.log.Error().Err(err).Msgf("could not index events by position")
+		return nil, err
+	}
 
 	return repo, nil
 }
 
 func validateRedisDbConfig(config RedisDbConfig) error {
-	if config.DbAddress == "" {
+	if config.DbAddress == "" && len(config.Addresses) == 0 {
 		return fmt.Errorf("REDIS_DB config entry required")
 	}
-	if config.RedisCa != "" {
-		if config.RedisUserCert == "" {
-			return fmt.Errorf("REDIS_DB_USER_CERT config entry required")
-		}
-		if config.RedisUserKey == "" {
-			return fmt.Errorf("REDIS_DB_USER_KEY config entry required")
+	if config.RedisUserCert != "" && config.RedisUserKey == "" {
+		return fmt.Errorf("REDIS_DB_USER_KEY config entry required with REDIS_DB_USER_CERT")
+	}
+	if config.RedisUserKey != "" && config.RedisUserCert == "" {
+		return fmt.Errorf("REDIS_DB_USER_CERT config entry required with REDIS_DB_USER_KEY")
+	}
+	if config.Shards < 0 {
+		return fmt.Errorf("REDIS_DB_SHARDS can not be negative")
+	}
+	if config.Shards == 1 && config.Mode == redisCluster {
+		return fmt.Errorf("REDIS_DB_SHARDS has to be more than 1 in cluster mode, a shard is in a single slot")
+	}
+	switch config.Mode {
+	case "", redisStandalone, redisCluster:
+	case redisSentinel:
+		if config.MasterName == "" {
+			return fmt.Errorf("REDIS_DB_MASTER_NAME config entry required in sentinel mode")
 		}
+	default:
+		return fmt.Errorf("REDIS_DB_MODE %s is not one of standalone, sentinel or cluster", config.Mode)
+	}
+	if len(config.ShardAddresses) > 0 && config.Mode != "" && config.Mode != redisStandalone {
+		return fmt.Errorf("REDIS_DB_SHARD_ADDRESSES only applies in standalone mode")
 	}
 	return nil
 }
 
-func (r *redisRepo) save(ctx context.Context, events []*dedb.Event) error {
+/*
+saveScript appends the events of a save in one step, so nothing has to be watched and retried.
+It checks the expected version of the first event's domain id and gives each event its
+timestamp, version and position at commit time, from the sequence of the shard, which keeps
+positions in commit order and timestamps growing with the versions of a domain id. The events come encoded without
+those three fields, which are written at the front of each one.
+
+ARGV[1] is the plan of the save, see savePlan, and ARGV[n+1] the nth encoded event less its
+opening brace. It returns the original response of a replayed save, reused when the
+idempotency key was saved with another request, the current version on a conflict or the
+timestamp, version and position of each saved event.
+*/
+var saveScript = redis.NewScript(`
+local plan = cjson.decode(ARGV[1])
+if plan.replay > 0 then
+	local original = redis.call('HMGET', KEYS[plan.replay], 'request', 'response')
+	if original[2] then
+		if original[1] ~= plan.hash then
+			return {'reused'}
+		end
+		return {'replay', original[2]}
+	end
+end
+local current = redis.call('LLEN', KEYS[plan.events[1].events])
+if (plan.kind == 1 and current ~= 0) or (plan.kind == 2 and current ~= plan.version) then
+	return {'conflict', current}
+end
+local sequence = redis.call('INCRBY', KEYS[plan.counter], #plan.events) - #plan.events
+local now = redis.call('TIME')
+local timestamp = tonumber(now[1]) * 1000000 + tonumber(now[2])
+local versions = {}
+local encoded = {}
+local saved = {'saved'}
+for i, e in ipairs(plan.events) do
+	local version = versions[e.events] or redis.call('LLEN', KEYS[e.events])
+	version = version + 1
+	versions[e.events] = version
+	sequence = sequence + 1
+	local position = sequence * plan.shards + plan.shard
+	timestamp = timestamp + 1
+	local last = redis.call('ZREVRANGE', KEYS[e.timestamps], 0, 0, 'WITHSCORES')[2]
+	if last and tonumber(last) >= timestamp then
+		timestamp = tonumber(last) + 1
+	end
+	local ts = string.format('%.0f', timestamp)
+	local p = string.format('%.0f', position)
+	local v = string.format('%.0f', version)
+	local event = '{"timestamp":"' .. ts .. '","version":"' .. v .. '","position":"' .. p .. '",' .. ARGV[i + 1]
+	local member = e.domain .. ':' .. e.domain_id .. ':' .. v
+	redis.call('ZADD', KEYS[e.types], 'NX', ts, e.domain_id)
+	redis.call('RPUSH', KEYS[e.events], event)
+	redis.call('ZADD', KEYS[e.timestamps], ts, e.id)
+	redis.call('ZADD', KEYS[plan.outbox], p, event)
+	redis.call('ZADD', KEYS[plan.positions], p, member)
+	redis.call('ZADD', KEYS[e.domain_positions], p, member)
+	table.insert(encoded, event)
+	table.insert(saved, timestamp)
+	table.insert(saved, version)
+	table.insert(saved, position)
+end
+if plan.replay > 0 then
+	redis.call('HSET', KEYS[plan.replay], 'request', plan.hash, 'response', '{"events":[' .. table.concat(encoded, ',') .. ']}')
+	redis.call('PEXPIRE', KEYS[plan.replay], plan.ttl)
+end
+return saved
+`)
+
+// savePlan tells saveScript what to save, keys being given by their index in KEYS
+type savePlan struct {
+	Kind     int32           `json:"kind"`    // expected version kind of the first event's domain id
+	Version  int64           `json:"version"` // expected version when exact
+	Counter  int             `json:"counter"` // sequence of the shard
+	Shards   int             `json:"shards"`
+	Shard    int             `json:"shard"`
+	Outbox   int             `json:"outbox"`
+	Position int             `json:"positions"`
+	Replay   int             `json:"replay"` // idempotency key, 0 without one
+	Hash     string          `json:"hash"`   // of the request, see saveKey
+	TTL      int64           `json:"ttl"`    // milliseconds the result is kept for retries
+	Events   []savePlanEvent `json:"events"`
+}
+
+type savePlanEvent struct {
+	Id              string `json:"id"`
+	Domain          string `json:"domain"`
+	DomainId        string `json:"domain_id"`
+	Events          int    `json:"events"`
+	Timestamps      int    `json:"timestamps"`
+	Types           int    `json:"types"`
+	DomainPositions int    `json:"domain_positions"`
+}
+
+func (r *redisRepo) save(ctx context.Context, events []*dedb.Event, expected *dedb.ExpectedVersion, key saveKey) ([]*dedb.Event, error) {
 	log := r.log.With().Str("op", "save").Logger()
 	if len(events) == 0 {
-		return fmt.Errorf("no events were supplied to save")
+		return nil, fmt.Errorf("no events were supplied to save")
 	}
 	log.Debug().Msgf("saving %d events", len(events))
-	// TODO: add locking
-	timestamp := time.Now().UnixMicro()
-	shard := r.getShard(events[0].Domain)
-	_, err := r.pool.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-		// set up each event to save
-		for _, e := range events {
-			// give each event an id and a timestamp
-			timestamp++
+	shard := r.getShard(events[0].Domain, events[0].DomainId)
+	for _, e := range events {
+		if r.getShard(e.Domain, e.DomainId) != shard {
+			return nil, status.Errorf(codes.InvalidArgument, "domain ids %s and %s are on different shards and can not be saved together", events[0].DomainId, e.DomainId)
+		}
+	}
+
+	keys := []string{}
+	indexes := make(map[string]int)
+	index := func(key string) int {
+		if _, ok := indexes[key]; !ok {
+			keys = append(keys, key)
+			indexes[key] = len(keys)
+		}
+		return indexes[key]
+	}
+	plan := savePlan{
+		Kind:     int32(expected.GetKind()),
+		Version:  expected.GetVersion(),
+		Outbox:   index(r.outboxKey(shard)),
+		Position: index(r.positionIndexKey(shard, "")),
+		Counter:  index(r.sequenceKey(shard)),
+		Shards:   len(r.shards),
+		Shard:    shard,
+		TTL:      dedupWindow(r.config).Milliseconds(),
+	}
+	if key.key != "" {
+		plan.Replay = index(r.key(shard, "idempotency", key.key))
+		plan.Hash = key.hash
+	}
+	args := []interface{}{""}
+	for _, e := range events {
+		if e.Id == "" {
 			id, _ := generateId()
 			e.Id = id.String()
-			e.Timestamp = timestamp
-
-			// create the keys used
-			domainsKey := redisKey{
-				db:     "dedb",
-				shard:  shard,
-				prefix: "domain_types",
-				key:    e.Domain,
-			}
+		}
+		e.Timestamp, e.Version, e.Position = 0, 0, 0
+		body, err := protojson.Marshal(e)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not encode event")
+			return nil, err
+		}
+		args = append(args, string(body[1:]))
+		plan.Events = append(plan.Events, savePlanEvent{
+			Id:              e.Id,
+			Domain:          e.Domain,
+			DomainId:        e.DomainId,
+			Events:          index(r.eventsKey(shard, e.Domain, e.DomainId)),
+			Timestamps:      index(r.timestampsKey(shard, e.Domain, e.DomainId)),
+			Types:           index(r.key(shard, "domain_types", e.Domain)),
+			DomainPositions: index(r.positionIndexKey(shard, e.Domain)),
+		})
+	}
+	encoded, err := json.Marshal(plan)
+	if err != nil {
+		return nil, err
+	}
+	args[0] = string(encoded)
+
+	reply, err := saveScript.Run(ctx, r.client(shard), keys, args...).Slice()
+	if err != nil {
+		log.Error().Err(err).Msgf("could not save events")
+		return nil, err
+	}
+	switch reply[0] {
+	case "replay":
+		// a retry of a save that already went through gets the original result back
+		response := &dedb.SaveResponse{}
+		err = Decode(response, reply[1].(string))
+		if err != nil {
+			log.Error().Err(err).Msgf("could not decode previous save")
+			return nil, err
+		}
+		log.Debug().Msgf("save already done for idempotency key %s", key.key)
+		return response.Events, nil
+	case "reused":
+		return nil, keyReused()
+	case "conflict":
+		return nil, versionConflict(events[0].DomainId, expected, reply[1].(int64))
+	}
+	for i, e := range events {
+		e.Timestamp = reply[3*i+1].(int64)
+		e.Version = reply[3*i+2].(int64)
+		e.Position = reply[3*i+3].(int64)
+	}
+	return events, nil
+}
+
+/*
+getDomainIds merges the domain ids of every shard by the time they were added. Each shard
+gives up to the first offset+limit of its own, which covers the page whichever shards its
+domain ids are on.
+*/
+func (r *redisRepo) getDomainIds(ctx context.Context, domain string, offset int64, limit int64) ([]string, error) {
+	log := r.log.With().Str("op", "getDomainIds").Logger()
+	log.Debug().Msgf("getting domain ids for domain %s, offset %d, limit %d", domain, offset, limit)
+
+	count := int64(0)
+	if limit > 0 {
+		count = offset + limit
+	}
+	added := []redis.Z{}
+	for shard := range r.shards {
+		reply, err := r.client(shard).ZRangeByScoreWithScores(ctx, r.key(shard, "domain_types", domain), &redis.ZRangeBy{
+			Count: count,
+			Min:   "-inf",
+			Max:   "+inf",
+		}).Result()
+		if err != nil {
+			log.Error().Err(err).Msgf("could not get the domain ids of shard %d", shard)
+			return nil, err
+		}
+		added = append(added, reply...)
+	}
+	sort.SliceStable(added, func(i, j int) bool {
+		if added[i].Score != added[j].Score {
+			return added[i].Score < added[j].Score
+		}
+		return added[i].Member.(string) < added[j].Member.(string)
+	})
+	ids := []string{}
+	for i := offset; i < int64(len(added)) && (limit <= 0 || i < offset+limit); i++ {
+		ids = append(ids, added[i].Member.(string))
+	}
+	return ids, nil
+}
 
-			domainEventsKey := redisKey{
-				db:     "dedb",
-				shard:  shard,
-				prefix: "domain_events",
-				key:    e.DomainId,
+func (r *redisRepo) getDomain(ctx context.Context, domain string, domainId string, offset int64, limit int64) ([]*dedb.Event, error) {
+	log := r.log.With().Str("op", "getDomain").Logger()
+
+	shard := r.getShard(domain, domainId)
+	key := r.eventsKey(shard, domain, domainId)
+
+	stop := int64(-1)
+	if limit > 0 {
+		stop = offset + limit - 1
+	}
+	reply := r.client(shard).LRange(ctx, key, offset, stop)
+	events := make([]*dedb.Event, 0)
+	for i, je := range reply.Val() {
+		e := &dedb.Event{}
+		err := Decode(e, je)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not decode event")
+			return nil, err
+		}
+		// events saved before versions were assigned get theirs from the list index
+		if e.Version == 0 {
+			e.Version = offset + int64(i) + 1
+		}
+		events = append(events, e)
+	}
+
+	return events, nil
+}
+
+// positionIndexKey is the key of the position index of the domain, or of every event
+func (r *redisRepo) positionIndexKey(shard int, domain string) string {
+	if domain == "" {
+		return r.key(shard, "position_idx", "global")
+	}
+	return r.key(shard, "domain_position_idx", domain)
+}
+
+// positionMember is what the position indexes hold for an event, its place in its domain events list
+func positionMember(e *dedb.Event) string {
+	return e.Domain + ":" + e.DomainId + ":" + strconv.FormatInt(e.Version, 10)
+}
+
+// eventsKey is the list of the events of the domain id
+func (r *redisRepo) eventsKey(shard int, domain string, domainId string) string {
+	return r.key(shard, "domain_events", domain+":"+domainId)
+}
+
+// timestampsKey is the timestamp index of the events of the domain id
+func (r *redisRepo) timestampsKey(shard int, domain string, domainId string) string {
+	return r.key(shard, "domain_events_timestamp_idx", domain+":"+domainId)
+}
+
+// snapshotKey is the latest snapshot of the domain id
+func (r *redisRepo) snapshotKey(shard int, domain string, domainId string) string {
+	return r.key(shard, "snapshots", domain+":"+domainId)
+}
+
+/*
+readAll walks the position indexes, fetching the events they point to from the domain events
+lists a batch at a time. The indexes of every shard are merged by position, up to the fence
+of the shards. Event names are filtered after the fetch, so a read can go through more
+positions than it returns events.
+*/
+func (r *redisRepo) readAll(ctx context.Context, from int64, limit int64, filter eventFilter) ([]*dedb.Event, int64, error) {
+	log := r.log.With().Str("op", "readAll").Logger()
+	log.Debug().Msgf("reading all events from position %d, limit %d", from, limit)
+	through, err := r.fence(ctx)
+	if err != nil {
+		log.Error().Err(err).Msgf("could not fence the shards")
+		return nil, 0, err
+	}
+	events := []*dedb.Event{}
+	last := from
+	for {
+		count := int64(readAllBatch)
+		if limit > 0 && len(filter.names) == 0 && limit-int64(len(events)) < count {
+			count = limit - int64(len(events))
+		}
+		entries, more, err := r.readPositions(ctx, filter.domain, last, through, count)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not read the position index")
+			return nil, 0, err
+		}
+		encoded, err := r.readIndexed(ctx, entries)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not read indexed events")
+			return nil, 0, err
+		}
+		for i, je := range encoded {
+			if limit > 0 && int64(len(events)) == limit {
+				return events, last, nil
+			}
+			last = entries[i].position
+			if je == "" {
+				log.Warn().Msgf("position %d is indexed but its event is missing", last)
+				continue
 			}
+			e := &dedb.Event{}
+			err = Decode(e, je)
+			if err != nil {
+				log.Error().Err(err).Msgf("could not decode event at position %d", last)
+				return nil, 0, err
+			}
+			if filter.matches(e) {
+				events = append(events, e)
+			}
+		}
+		if !more || (limit > 0 && int64(len(events)) == limit) {
+			return events, last, nil
+		}
+	}
+}
+
+// indexEntry is an event found in a position index, on the shard holding it
+type indexEntry struct {
+	shard    int
+	position int64
+	events   string // domain:domain id of the events list
+	version  int64
+}
 
-			eventTimestampIndexKey := redisKey{
-				db:     "dedb",
-				shard:  shard,
-				prefix: "domain_events_timestamp_idx",
-				key:    e.DomainId,
+/*
+readPositions returns the first count entries after the position, and up to through when it
+is set, in the indexes of the shards, merged in position order. Every entry left out comes after count entries of its own
+shard, so no position before the last one returned is skipped. more reports whether the
+indexes could hold entries past the ones returned.
+*/
+func (r *redisRepo) readPositions(ctx context.Context, domain string, after int64, through int64, count int64) ([]indexEntry, bool, error) {
+	max := "+inf"
+	if through > 0 {
+		max = strconv.FormatInt(through, 10)
+	}
+	entries := []indexEntry{}
+	for shard := range r.shards {
+		members, err := r.client(shard).ZRangeByScoreWithScores(ctx, r.positionIndexKey(shard, domain), &redis.ZRangeBy{
+			Min:   "(" + strconv.FormatInt(after, 10),
+			Max:   max,
+			Count: count,
+		}).Result()
+		if err != nil {
+			return nil, false, err
+		}
+		for _, m := range members {
+			member := m.Member.(string)
+			split := strings.LastIndex(member, ":")
+			version, _ := strconv.ParseInt(member[split+1:], 10, 64)
+			entries = append(entries, indexEntry{shard: shard, position: int64(m.Score), events: member[:split], version: version})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].position < entries[j].position })
+	more := int64(len(entries)) >= count
+	if more {
+		entries = entries[:count]
+	}
+	return entries, more, nil
+}
+
+// readIndexed fetches the encoded events of the entries, an empty string for one that is missing
+func (r *redisRepo) readIndexed(ctx context.Context, entries []indexEntry) ([]string, error) {
+	encoded := make([]string, len(entries))
+	for client, shards := range r.nodes() {
+		held := make(map[int]bool)
+		for _, shard := range shards {
+			held[shard] = true
+		}
+		indexes := []int{}
+		cmds, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, entry := range entries {
+				if held[entry.shard] {
+					indexes = append(indexes, i)
+					pipe.LIndex(ctx, r.key(entry.shard, "domain_events", entry.events), entry.version-1)
+				}
 			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		for i, cmd := range cmds {
+			encoded[indexes[i]], _ = cmd.(*redis.StringCmd).Result()
+		}
+	}
+	return encoded, nil
+}
 
-			// sEnc := b64.StdEncoding.EncodeToString([]byte(e.Data))
-			// e.Data = []byte(sEnc)
-			encoded, err := Encode(e)
+/*
+indexPositions adds the events saved before the position indexes existed to them. It only
+runs on a shard whose index is still empty while events have been saved, so it is a no op
+once done.
+*/
+func (r *redisRepo) indexPositions(ctx context.Context) error {
+	log := r.log.With().Str("op", "indexPositions").Logger()
+	exists, err := r.client(0).Exists(ctx, r.sequenceKey(0)).Result()
+	if err != nil || exists == 0 {
+		return err
+	}
+	for shard := range r.shards {
+		client := r.client(shard)
+		indexed, err := client.ZCard(ctx, r.positionIndexKey(shard, "")).Result()
+		if err != nil {
+			return err
+		}
+		if indexed > 0 {
+			continue
+		}
+		log.Info().Msgf("indexing the events of shard %d by position", shard)
+		err = scan(ctx, client, r.key(shard, "domain_events", "*"), func(key string) error {
+			encoded, err := client.LRange(ctx, key, 0, -1).Result()
 			if err != nil {
-				log.Error().Err(err).Msgf("could not encode event")
 				return err
 			}
+			_, err = client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				for i, je := range encoded {
+					e := &dedb.Event{}
+					if Decode(e, je) != nil || e.Position == 0 {
+						continue
+					}
+					if e.Version == 0 {
+						e.Version = int64(i) + 1
+					}
+					indexed := &redis.Z{Score: float64(e.Position), Member: positionMember(e)}
+					pipe.ZAdd(ctx, r.positionIndexKey(shard, ""), indexed)
+					pipe.ZAdd(ctx, r.positionIndexKey(shard, e.Domain), indexed)
+				}
+				return nil
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			pipe.ZAddNX(ctx, domainsKey.String(), &redis.Z{Score: float64(timestamp), Member: e.DomainId})
-			pipe.RPush(ctx, domainEventsKey.String(), encoded)
-			pipe.ZAdd(ctx, eventTimestampIndexKey.String(), &redis.Z{Score: float64(timestamp), Member: e.Id})
+/*
+keyByDomain moves the events, timestamp index and snapshot of domain ids saved when their keys
+were named by the domain id alone, dedb:domain_events:<shard>:<domain_id>, to the keys of their
+domain on the shard of the domain and domain id. A list holding events of several domains is
+split, each domain keeping its events in the order they were saved with versions renumbered
+from their new place, and the position indexes are pointed at the new lists. A key of the
+current layout ends in the domain and domain id of its events, so it never matches their domain
+id alone and is left in place. Each shard is only scanned until it is marked as moved.
+*/
+func (r *redisRepo) keyByDomain(ctx context.Context) error {
+	log := r.log.With().Str("op", "keyByDomain").Logger()
+	for shard := range r.shards {
+		client := r.client(shard)
+		layoutKey := r.key(shard, "layout", "global")
+		moved, err := client.Exists(ctx, layoutKey).Result()
+		if err != nil {
+			return err
+		}
+		if moved > 0 {
+			continue
+		}
+		prefix := r.key(shard, "domain_events", "")
+		err = scan(ctx, client, prefix+"*", func(key string) error {
+			return r.moveDomainId(ctx, shard, key[len(prefix):])
+		})
+		if err != nil {
+			log.Error().Err(err).Msgf("could not move the domain ids of shard %d", shard)
+			return err
+		}
+		err = client.Set(ctx, layoutKey, "domain", 0).Err()
+		if err != nil {
+			return err
 		}
-		return nil
-	})
-	if err != nil {
-		return err
 	}
 	return nil
 }
 
-func (r *redisRepo) getDomainIds(ctx context.Context, domain string, offset int64, limit int64) ([]string, error) {
-	log := r.log.With().Str("op", "getDomainIds").Logger()
-	log.Debug().Msgf("getting domain ids for domain %s, offset %d, limit %d", domain, offset, limit)
+// moveDomainId moves the keys of the domain id on the shard to the keys of their domains, see keyByDomain
+func (r *redisRepo) moveDomainId(ctx context.Context, shard int, domainId string) error {
+	client := r.client(shard)
+	oldEvents := r.key(shard, "domain_events", domainId)
+	encoded, err := client.LRange(ctx, oldEvents, 0, -1).Result()
+	if err != nil || len(encoded) == 0 {
+		return err
+	}
+	first := &dedb.Event{}
+	if err = Decode(first, encoded[0]); err != nil {
+		return err
+	}
+	if first.DomainId != domainId {
+		return nil
+	}
+	r.log.Info().Msgf("moving the keys of domain id %s to keys by domain", domainId)
 
-	key := redisKey{
-		db:     "dedb",
-		shard:  0,
-		prefix: "domain_types",
-		key:    domain,
+	events := make([]*dedb.Event, len(encoded))
+	domains := []string{}
+	byDomain := make(map[string][]*dedb.Event)
+	for i, je := range encoded {
+		e := &dedb.Event{}
+		if err = Decode(e, je); err != nil {
+			return err
+		}
+		events[i] = e
+		if _, ok := byDomain[e.Domain]; !ok {
+			domains = append(domains, e.Domain)
+		}
+		byDomain[e.Domain] = append(byDomain[e.Domain], e)
+	}
+	snapshot, err := r.decodeSnapshot(client.Get(ctx, r.key(shard, "snapshots", domainId)))
+	if err != nil {
+		return err
 	}
 
-	args := &redis.ZRangeBy{
-		Offset: offset,
-		Count:  limit,
-		Min:    "-inf",
-		Max:    "+inf",
+	for _, domain := range domains {
+		target := r.getShard(domain, domainId)
+		eventsKey := r.eventsKey(target, domain, domainId)
+		timestampsKey := r.timestampsKey(target, domain, domainId)
+		_, err = r.client(target).TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, eventsKey, timestampsKey)
+			for i, e := range byDomain[domain] {
+				e.Version = int64(i) + 1
+				je, err := Encode(e)
+				if err != nil {
+					return err
+				}
+				pipe.RPush(ctx, eventsKey, je)
+				pipe.ZAdd(ctx, timestampsKey, &redis.Z{Score: float64(e.Timestamp), Member: e.Id})
+				if e.Position == 0 {
+					continue
+				}
+				indexed := &redis.Z{Score: float64(e.Position), Member: positionMember(e)}
+				pipe.ZAdd(ctx, r.positionIndexKey(target, ""), indexed)
+				pipe.ZAdd(ctx, r.positionIndexKey(target, domain), indexed)
+			}
+			if snapshot != nil && snapshot.Domain == domain {
+				je, err := Encode(snapshot)
+				if err != nil {
+					return err
+				}
+				pipe.Set(ctx, r.snapshotKey(target, domain, domainId), je, 0)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
 	}
-	reply := r.pool.ZRangeByScore(ctx, key.String(), args)
 
-	return reply.Val(), nil
+	_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, e := range events {
+			if e.Position == 0 {
+				continue
+			}
+			// the indexes held the domain id and the place of the event in the old list
+			member := domainId + ":" + strconv.FormatInt(int64(i)+1, 10)
+			pipe.ZRem(ctx, r.positionIndexKey(shard, ""), member)
+			pipe.ZRem(ctx, r.positionIndexKey(shard, e.Domain), member)
+		}
+		pipe.Del(ctx, oldEvents, r.key(shard, "domain_events_timestamp_idx", domainId), r.key(shard, "snapshots", domainId))
+		return nil
+	})
+	return err
 }
 
-func (r *redisRepo) getDomain(ctx context.Context, domain string, domainId string, offset int64, limit int64) ([]*dedb.Event, error) {
-	log := r.log.With().Str("op", "getDomain").Logger()
+/*
+getDomainBackward reads the tail of the domain events list. Versions are list positions, so
+the events before a version end at its index, and the read starts limit entries earlier.
+*/
+func (r *redisRepo) getDomainBackward(ctx context.Context, domain string, domainId string, before int64, limit int64) ([]*dedb.Event, error) {
+	log := r.log.With().Str("op", "getDomainBackward").Logger()
+	log.Debug().Msgf("getting domain %s, id %s backward, before %d, limit %d", domain, domainId, before, limit)
+
+	shard := r.getShard(domain, domainId)
+	key := r.eventsKey(shard, domain, domainId)
 
-	key := redisKey{
-		db:     "dedb",
-		shard:  0,
-		prefix: "domain_events",
-		key:    domainId,
+	length, err := r.client(shard).LLen(ctx, key).Result()
+	if err != nil {
+		log.Error().Err(err).Msgf("could not get the number of events of %s", domainId)
+		return nil, err
+	}
+	if before > 0 && before-1 < length {
+		length = before - 1
+	}
+	stop := length - 1
+	start := int64(0)
+	if limit > 0 && stop-limit+1 > 0 {
+		start = stop - limit + 1
+	}
+	if stop < 0 {
+		return []*dedb.Event{}, nil
 	}
 
-	reply := r.pool.LRange(ctx, key.String(), offset, limit)
-	events := make([]*dedb.Event, 0)
-	for _, je := range reply.Val() {
+	reply, err := r.client(shard).LRange(ctx, key, start, stop).Result()
+	if err != nil {
+		log.Error().Err(err).Msgf("could not read events of %s", domainId)
+		return nil, err
+	}
+	events := make([]*dedb.Event, 0, len(reply))
+	for i, je := range reply {
 		e := &dedb.Event{}
 		err := Decode(e, je)
 		if err != nil {
 			log.Error().Err(err).Msgf("could not decode event")
 			return nil, err
 		}
+		// events saved before versions were assigned get theirs from the list index
+		if e.Version == 0 {
+			e.Version = start + int64(i) + 1
+		}
 		events = append(events, e)
 	}
-
+	reverseEvents(events)
 	return events, nil
 }
 
+func (r *redisRepo) schemaKeys() (string, string) {
+	schemas := r.key(0, "schemas", "global")
+	versions := r.key(0, "schema_versions", "global")
+	return schemas, versions
+}
+
 /*
-func (r *redisRepo) getDomainByTimeRange(ctx context.Context, domain string, domainId string, from int64, limit int32) ([]*dedb.Event, error) {
-	log := r.log.With().Str("op", "getDomainByTimeRange").Logger()
-	conn := r.pool.Get()
-	defer conn.Close()
+saveSchema registers the schema, taking the next version when it has none. Registering a
+version again is a no op if the definition is the same, and an error if not.
+*/
+func (r *redisRepo) saveSchema(ctx context.Context, schema *dedb.Schema) (*dedb.Schema, error) {
+	log := r.log.With().Str("op", "saveSchema").Logger()
+	schemasKey, versionsKey := r.schemaKeys()
+	latestField := schema.Domain + ":" + schema.EventName
+	var saved *dedb.Schema
 
-	key := redisKey{
-		db:     "dedb",
-		shard:  0,
-		prefix: "domain_events_timestamp_idx",
-		key:    domainId,
+	txf := func(tx *redis.Tx) error {
+		candidate := proto.Clone(schema).(*dedb.Schema)
+		latest, err := tx.HGet(ctx, versionsKey, latestField).Int64()
+		if err != nil && err != redis.Nil {
+			log.Error().Err(err).Msgf("could not get latest schema version of %s", latestField)
+			return err
+		}
+		if candidate.Version == 0 {
+			candidate.Version = int32(latest) + 1
+		}
+		field := schemaKey(candidate.Domain, candidate.EventName, candidate.Version)
+		existing, err := r.decodeSchema(tx.HGet(ctx, schemasKey, field))
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			if !sameSchema(existing, candidate) {
+				return schemaExists(candidate)
+			}
+			saved = existing
+			return nil
+		}
+
+		candidate.Timestamp = time.Now().UnixMicro()
+		encoded, err := Encode(candidate)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not encode schema")
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, schemasKey, field, encoded)
+			if int64(candidate.Version) > latest {
+				pipe.HSet(ctx, versionsKey, latestField, candidate.Version)
+			}
+			return nil
+		})
+		if err == nil {
+			saved = candidate
+		}
+		return err
+	}
+
+	for attempt := 0; attempt < maxSaveAttempts; attempt++ {
+		err := r.pool.Watch(ctx, txf, schemasKey, versionsKey)
+		if err != redis.TxFailedErr {
+			return saved, err
+		}
+		time.Sleep(saveBackoff(attempt))
+	}
+	return nil, status.Errorf(codes.Aborted, "could not save schema after %d attempts due to concurrent writes", maxSaveAttempts)
+}
+
+func (r *redisRepo) getSchema(ctx context.Context, domain string, eventName string, version int32) (*dedb.Schema, error) {
+	schemasKey, versionsKey := r.schemaKeys()
+	if version == 0 {
+		latest, err := r.pool.HGet(ctx, versionsKey, domain+":"+eventName).Int64()
+		if err == redis.Nil {
+			return nil, nil
+		} else if err != nil {
+			r.log.Error().Err(err).Msgf("could not get latest schema version of %s:%s", domain, eventName)
+			return nil, err
+		}
+		version = int32(latest)
 	}
+	return r.decodeSchema(r.pool.HGet(ctx, schemasKey, schemaKey(domain, eventName, version)))
+}
 
-	var sortedIds []string
-	res, err := redis.Values(conn.Do("ZRANGE", key.String(), strconv.FormatInt(from, 10), limit))
+func (r *redisRepo) listSchemas(ctx context.Context, domain string, eventName string) ([]*dedb.Schema, error) {
+	schemasKey, _ := r.schemaKeys()
+	all, err := r.pool.HGetAll(ctx, schemasKey).Result()
 	if err != nil {
+		r.log.Error().Err(err).Msgf("could not list schemas")
 		return nil, err
 	}
-	err = redis.ScanSlice(res, &sortedIds)
+	schemas := []*dedb.Schema{}
+	for _, encoded := range all {
+		schema := &dedb.Schema{}
+		err = Decode(schema, encoded)
+		if err != nil {
+			r.log.Error().Err(err).Msgf("could not decode schema")
+			return nil, err
+		}
+		if (domain == "" || schema.Domain == domain) && (eventName == "" || schema.EventName == eventName) {
+			schemas = append(schemas, schema)
+		}
+	}
+	sortSchemas(schemas)
+	return schemas, nil
+}
+
+// decodeSchema returns nil if the schema field does not exist
+func (r *redisRepo) decodeSchema(reply *redis.StringCmd) (*dedb.Schema, error) {
+	encoded, err := reply.Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		r.log.Error().Err(err).Msgf("could not get schema")
+		return nil, err
+	}
+	schema := &dedb.Schema{}
+	err = Decode(schema, encoded)
 	if err != nil {
+		r.log.Error().Err(err).Msgf("could not decode schema")
 		return nil, err
 	}
+	return schema, nil
+}
 
-	// parse the event id off the sorted ids list
-	ids := make([]string, 0)
-	for _, id := range sortedIds {
-		ids = append(ids, id)
+// pending returns the oldest events in the outboxes of every shard, in position order
+func (r *redisRepo) pending(ctx context.Context, limit int64) ([]*dedb.Event, error) {
+	log := r.log.With().Str("op", "pending").Logger()
+	events := []*dedb.Event{}
+	for shard := range r.shards {
+		reply, err := r.client(shard).ZRange(ctx, r.outboxKey(shard), 0, limit-1).Result()
+		if err != nil {
+			log.Error().Err(err).Msgf("could not read the outbox of shard %d", shard)
+			return nil, err
+		}
+		for _, je := range reply {
+			e := &dedb.Event{}
+			err := Decode(e, je)
+			if err != nil {
+				log.Error().Err(err).Msgf("could not decode event")
+				return nil, err
+			}
+			events = append(events, e)
+		}
 	}
-	log.Debug().Msgf("ids: %v", ids)
+	sort.Slice(events, func(i, j int) bool { return events[i].Position < events[j].Position })
+	return page(events, 0, limit), nil
+}
+
+// published removes the events from the outbox of their shard, they are found by their position
+func (r *redisRepo) published(ctx context.Context, events []*dedb.Event) error {
+	byShard := make(map[int][]*dedb.Event)
+	for _, e := range events {
+		shard := r.getShard(e.Domain, e.DomainId)
+		byShard[shard] = append(byShard[shard], e)
+	}
+	for shard, events := range byShard {
+		_, err := r.client(shard).TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, e := range events {
+				position := strconv.FormatInt(e.Position, 10)
+				pipe.ZRemRangeByScore(ctx, r.outboxKey(shard), position, position)
+			}
+			return nil
+		})
+		if err != nil {
+			r.log.Error().Err(err).Msgf("could not remove published events from the outbox of shard %d", shard)
+			return err
+		}
+	}
+	return nil
+}
 
-	return nil, nil
+func (r *redisRepo) outboxKey(shard int) string {
+	return r.key(shard, "outbox", "global")
 }
+
+/*
+saveSnapshot stores the snapshot unless one with the same or a higher version exists. The
+snapshot can not cover events that were never saved.
 */
+func (r *redisRepo) saveSnapshot(ctx context.Context, snapshot *dedb.Snapshot) error {
+	log := r.log.With().Str("op", "saveSnapshot").Logger()
+	shard := r.getShard(snapshot.Domain, snapshot.DomainId)
+	snapshotKey := r.snapshotKey(shard, snapshot.Domain, snapshot.DomainId)
+	eventsKey := r.eventsKey(shard, snapshot.Domain, snapshot.DomainId)
 
-func (r *redisRepo) shutdown() {
-	r.pool.Close()
+	txf := func(tx *redis.Tx) error {
+		current, err := tx.LLen(ctx, eventsKey).Result()
+		if err != nil {
+			log.Error().Err(err).Msgf("could not get current version of %s", snapshot.DomainId)
+			return err
+		}
+		if snapshot.Version > current {
+			return status.Errorf(codes.FailedPrecondition, "snapshot version %d is ahead of domain id %s at version %d", snapshot.Version, snapshot.DomainId, current)
+		}
+		existing, err := r.decodeSnapshot(tx.Get(ctx, snapshotKey))
+		if err != nil {
+			return err
+		}
+		if existing != nil && existing.Version >= snapshot.Version {
+			log.Debug().Msgf("snapshot at version %d already exists for %s", existing.Version, snapshot.DomainId)
+			return nil
+		}
+		snapshot.Timestamp = time.Now().UnixMicro()
+		encoded, err := Encode(snapshot)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not encode snapshot")
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, snapshotKey, encoded, 0)
+			return nil
+		})
+		return err
+	}
+
+	for attempt := 0; attempt < maxSaveAttempts; attempt++ {
+		err := r.client(shard).Watch(ctx, txf, snapshotKey, eventsKey)
+		if err != redis.TxFailedErr {
+			return err
+		}
+		time.Sleep(saveBackoff(attempt))
+	}
+	return status.Errorf(codes.Aborted, "could not save snapshot after %d attempts due to concurrent writes", maxSaveAttempts)
+}
+
+func (r *redisRepo) getSnapshot(ctx context.Context, domain string, domainId string) (*dedb.Snapshot, error) {
+	shard := r.getShard(domain, domainId)
+	key := r.snapshotKey(shard, domain, domainId)
+	return r.decodeSnapshot(r.client(shard).Get(ctx, key))
 }
 
-func (r *redisRepo) getShard(domain string) int {
-	return 0
+// decodeSnapshot returns nil if the snapshot key does not exist
+func (r *redisRepo) decodeSnapshot(reply *redis.StringCmd) (*dedb.Snapshot, error) {
+	encoded, err := reply.Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		r.log.Error().Err(err).Msgf("could not get snapshot")
+		return nil, err
+	}
+	snapshot := &dedb.Snapshot{}
+	err = Decode(snapshot, encoded)
+	if err != nil {
+		r.log.Error().Err(err).Msgf("could not decode snapshot")
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+/*
+getDomainByTimeRange finds the events in the range with the timestamp index. Timestamps
+grow with versions, so the number of entries before each end of the range are the list
+indexes of the first and last event in it, which are then read with a single LRANGE.
+*/
+func (r *redisRepo) getDomainByTimeRange(ctx context.Context, domain string, domainId string, from int64, to int64, limit int64, direction dedb.Direction) ([]*dedb.Event, error) {
+	log := r.log.With().Str("op", "getDomainByTimeRange").Logger()
+	log.Debug().Msgf("getting domain %s, id %s, from %d to %d, limit %d", domain, domainId, from, to, limit)
+
+	shard := r.getShard(domain, domainId)
+	indexKey := r.timestampsKey(shard, domain, domainId)
+	eventsKey := r.eventsKey(shard, domain, domainId)
+
+	upper := "+inf"
+	if to > 0 {
+		upper = strconv.FormatInt(to, 10)
+	}
+	var before, through *redis.IntCmd
+	_, err := r.client(shard).Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		before = pipe.ZCount(ctx, indexKey, "-inf", "("+strconv.FormatInt(from, 10))
+		through = pipe.ZCount(ctx, indexKey, "-inf", upper)
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msgf("could not count events in the time range")
+		return nil, err
+	}
+	start, stop := before.Val(), through.Val()-1
+	if start > stop {
+		return []*dedb.Event{}, nil
+	}
+	if limit > 0 && stop-start+1 > limit {
+		if direction == dedb.Direction_BACKWARD {
+			start = stop - limit + 1
+		} else {
+			stop = start + limit - 1
+		}
+	}
+
+	reply, err := r.client(shard).LRange(ctx, eventsKey, start, stop).Result()
+	if err != nil {
+		log.Error().Err(err).Msgf("could not read events of %s", domainId)
+		return nil, err
+	}
+	events := make([]*dedb.Event, 0, len(reply))
+	for i, je := range reply {
+		e := &dedb.Event{}
+		err := Decode(e, je)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not decode event")
+			return nil, err
+		}
+		if e.Version == 0 {
+			e.Version = start + int64(i) + 1
+		}
+		events = append(events, e)
+	}
+	if direction == dedb.Direction_BACKWARD {
+		reverseEvents(events)
+	}
+	return events, nil
+}
+
+func (r *redisRepo) shutdown() {
+	r.pool.Close()
+	for client := range r.nodes() {
+		if client != r.pool {
+			client.Close()
+		}
+	}
 }
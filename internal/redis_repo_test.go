@@ -2,13 +2,30 @@ package internal
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"dedb"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestRepoSave(t *testing.T) {
@@ -54,7 +71,7 @@ func TestRepoSave(t *testing.T) {
 	// when / then
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
-			err := repo.save(ctx, tc.events)
+			_, err := repo.save(ctx, tc.events, nil, saveKey{})
 			if tc.err == nil {
 				assert.Nil(t, err)
 
@@ -68,7 +85,7 @@ func TestRepoSave(t *testing.T) {
 						db:     "dedb",
 						shard:  0,
 						prefix: "domain_events_timestamp_idx",
-						key:    domainId,
+						key:    domain + ":" + domainId,
 					}
 					s := repo.pool.ZRange(ctx, key.String(), int64(0), int64(1)).Val()
 					repo.log.Info().Msgf("s: %v", s)
@@ -78,7 +95,7 @@ func TestRepoSave(t *testing.T) {
 
 					// see if the domain events has an entry
 					key.prefix = "domain_events"
-					key.key = domainId
+					key.key = domain + ":" + domainId
 					s = repo.pool.LRange(ctx, key.String(), int64(0), int64(1)).Val()
 					assert.Equal(t, len(s), 1)
 					payload := s[0]
@@ -174,7 +191,7 @@ func TestRepoGetDomain(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			// add the test data for the test case
 			for _, je := range tc.jsonEvents {
-				repo.pool.RPush(ctx, "dedb:domain_events:0:"+tc.domainId, je.data)
+				repo.pool.RPush(ctx, "dedb:domain_events:0:"+tc.domain+":"+tc.domainId, je.data)
 			}
 
 			// execute the test case
@@ -282,3 +299,968 @@ func TestGetDomainIds(t *testing.T) {
 	}
 
 }
+
+func TestRepoSaveExpectedVersion(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := Config{
+		RedisDbConfig: RedisDbConfig{
+			DbAddress: "redis:6379",
+			DbIndex:   0,
+		},
+	}
+	repo, err := NewRedisRepo(config)
+	if err != nil {
+		panic(err)
+	}
+	cases := []struct {
+		name     string
+		expected *dedb.ExpectedVersion
+		current  string
+		code     codes.Code
+	}{
+		{
+			name:     "No stream on a new domain id",
+			expected: &dedb.ExpectedVersion{Kind: dedb.ExpectedVersion_NO_STREAM},
+			code:     codes.OK,
+		},
+		{
+			name:     "No stream on an existing domain id",
+			expected: &dedb.ExpectedVersion{Kind: dedb.ExpectedVersion_NO_STREAM},
+			current:  "1",
+			code:     codes.Aborted,
+		},
+		{
+			name:     "Exact version matches",
+			expected: &dedb.ExpectedVersion{Kind: dedb.ExpectedVersion_EXACT, Version: 1},
+			code:     codes.OK,
+		},
+		{
+			name:     "Exact version is stale",
+			expected: &dedb.ExpectedVersion{Kind: dedb.ExpectedVersion_EXACT, Version: 1},
+			current:  "2",
+			code:     codes.Aborted,
+		},
+		{
+			name:     "Any version",
+			expected: &dedb.ExpectedVersion{Kind: dedb.ExpectedVersion_ANY},
+			code:     codes.OK,
+		},
+	}
+
+	// clear the db
+	repo.pool.FlushAll(ctx)
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			events := []*dedb.Event{
+				{
+					Name:     "CustomerUpdated",
+					Domain:   "CUSTOMER",
+					DomainId: "versionid",
+				},
+			}
+			_, err := repo.save(ctx, events, tc.expected, saveKey{})
+			st := status.Convert(err)
+			assert.Equal(t, tc.code, st.Code())
+			if tc.code == codes.Aborted {
+				assert.Equal(t, 1, len(st.Details()))
+				info := st.Details()[0].(*errdetails.ErrorInfo)
+				assert.Equal(t, tc.current, info.Metadata["current_version"])
+			}
+		})
+	}
+}
+
+func TestRepoSaveConcurrentWriters(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := Config{
+		RedisDbConfig: RedisDbConfig{
+			DbAddress: "redis:6379",
+			DbIndex:   0,
+		},
+	}
+	repo, err := NewRedisRepo(config)
+	if err != nil {
+		panic(err)
+	}
+	repo.pool.FlushAll(ctx)
+
+	// when several writers race to append at the same version
+	writers := 5
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		go func() {
+			events := []*dedb.Event{{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "raceid"}}
+			_, err := repo.save(ctx, events, &dedb.ExpectedVersion{Kind: dedb.ExpectedVersion_NO_STREAM}, saveKey{})
+			errs <- err
+		}()
+	}
+
+	// then exactly one of them wins
+	saved := 0
+	for i := 0; i < writers; i++ {
+		err := <-errs
+		if err == nil {
+			saved++
+		} else {
+			assert.Equal(t, codes.Aborted, status.Code(err))
+		}
+	}
+	assert.Equal(t, 1, saved)
+	assert.Equal(t, int64(1), repo.pool.LLen(ctx, "dedb:domain_events:0:CUSTOMER:raceid").Val())
+}
+
+func TestRepoSaveConcurrentPositions(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := Config{
+		RedisDbConfig: RedisDbConfig{
+			DbAddress: "redis:6379",
+			DbIndex:   0,
+		},
+	}
+	repo, err := NewRedisRepo(config)
+	if err != nil {
+		panic(err)
+	}
+	repo.pool.FlushAll(ctx)
+
+	// when writers of different and the same domain ids save at once
+	writers := 20
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			events := []*dedb.Event{
+				{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: fmt.Sprintf("positionid%d", i%4)},
+				{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: fmt.Sprintf("positionid%d", i%4)},
+			}
+			_, err := repo.save(ctx, events, nil, saveKey{})
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < writers; i++ {
+		assert.Nil(t, <-errs)
+	}
+
+	// then every position is taken once, in the order the events were appended
+	all, last, err := repo.readAll(ctx, 0, 0, eventFilter{})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2*writers), last)
+	assert.Equal(t, 2*writers, len(all))
+	versions := make(map[string]int64)
+	timestamps := make(map[string]int64)
+	for i, e := range all {
+		assert.Equal(t, int64(i+1), e.Position)
+		assert.Equal(t, versions[e.DomainId]+1, e.Version)
+		assert.Greater(t, e.Timestamp, timestamps[e.DomainId])
+		versions[e.DomainId] = e.Version
+		timestamps[e.DomainId] = e.Timestamp
+	}
+}
+
+func TestRepoSaveVersions(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := Config{
+		RedisDbConfig: RedisDbConfig{
+			DbAddress: "redis:6379",
+			DbIndex:   0,
+		},
+	}
+	repo, err := NewRedisRepo(config)
+	if err != nil {
+		panic(err)
+	}
+	repo.pool.FlushAll(ctx)
+
+	// when
+	batches := [][]*dedb.Event{
+		{
+			{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "versionid"},
+			{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "versionid"},
+		},
+		{
+			{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "otherid"},
+		},
+		{
+			{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "versionid"},
+		},
+	}
+	for _, b := range batches {
+		_, err := repo.save(ctx, b, nil, saveKey{})
+		assert.Nil(t, err)
+	}
+
+	// then versions are per domain id and positions are global
+	assert.Equal(t, int64(1), batches[0][0].Version)
+	assert.Equal(t, int64(2), batches[0][1].Version)
+	assert.Equal(t, int64(1), batches[1][0].Version)
+	assert.Equal(t, int64(3), batches[2][0].Version)
+	assert.Equal(t, int64(1), batches[0][0].Position)
+	assert.Equal(t, int64(2), batches[0][1].Position)
+	assert.Equal(t, int64(3), batches[1][0].Position)
+	assert.Equal(t, int64(4), batches[2][0].Position)
+
+	// and the version of the last event read is the offset for the next read
+	events, err := repo.getDomain(ctx, "CUSTOMER", "versionid", 2, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, int64(3), events[0].Version)
+	assert.Equal(t, int64(4), events[0].Position)
+}
+
+func TestRepoSnapshots(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := Config{
+		RedisDbConfig: RedisDbConfig{
+			DbAddress: "redis:6379",
+			DbIndex:   0,
+		},
+	}
+	repo, err := NewRedisRepo(config)
+	if err != nil {
+		panic(err)
+	}
+	repo.pool.FlushAll(ctx)
+	events := []*dedb.Event{
+		{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "snapid"},
+		{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "snapid"},
+	}
+	_, err = repo.save(ctx, events, nil, saveKey{})
+	if err != nil {
+		panic(err)
+	}
+	cases := []struct {
+		name     string
+		version  int64
+		code     codes.Code
+		expected int64
+	}{
+		{
+			name:     "No snapshot yet",
+			version:  0,
+			code:     codes.OK,
+			expected: 0,
+		},
+		{
+			name:     "Snapshot saved",
+			version:  2,
+			code:     codes.OK,
+			expected: 2,
+		},
+		{
+			name:     "Older snapshot is ignored",
+			version:  1,
+			code:     codes.OK,
+			expected: 2,
+		},
+		{
+			name:     "Snapshot ahead of the events",
+			version:  3,
+			code:     codes.FailedPrecondition,
+			expected: 2,
+		},
+	}
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.version > 0 {
+				err := repo.saveSnapshot(ctx, &dedb.Snapshot{
+					Domain:   "CUSTOMER",
+					DomainId: "snapid",
+					Version:  tc.version,
+					Data:     []byte(`{"name":"test"}`),
+				})
+				assert.Equal(t, tc.code, status.Code(err))
+			}
+			snapshot, err := repo.getSnapshot(ctx, "CUSTOMER", "snapid")
+			assert.Nil(t, err)
+			if tc.expected == 0 {
+				assert.Nil(t, snapshot)
+			} else {
+				assert.Equal(t, tc.expected, snapshot.Version)
+				assert.Equal(t, []byte(`{"name":"test"}`), snapshot.Data)
+			}
+		})
+	}
+}
+
+func TestRepoSaveIdempotent(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := Config{
+		RedisDbConfig: RedisDbConfig{
+			DbAddress: "redis:6379",
+			DbIndex:   0,
+		},
+	}
+	repo, err := NewRedisRepo(config)
+	if err != nil {
+		panic(err)
+	}
+	cases := []struct {
+		name    string
+		request func() *dedb.SaveRequest
+	}{
+		{
+			name: "Request idempotency key",
+			request: func() *dedb.SaveRequest {
+				return &dedb.SaveRequest{
+					IdempotencyKey:  "retry-key",
+					ExpectedVersion: &dedb.ExpectedVersion{Kind: dedb.ExpectedVersion_NO_STREAM},
+					Events:          []*dedb.Event{{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "retryid"}},
+				}
+			},
+		},
+		{
+			name: "Client supplied event ids",
+			request: func() *dedb.SaveRequest {
+				return &dedb.SaveRequest{
+					ExpectedVersion: &dedb.ExpectedVersion{Kind: dedb.ExpectedVersion_NO_STREAM},
+					Events:          []*dedb.Event{{Id: "01GJ95SGV2492NWNQ3GHR3AZ02", Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "retryid"}},
+				}
+			},
+		},
+	}
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			repo.pool.FlushAll(ctx)
+			save := func(request *dedb.SaveRequest) ([]*dedb.Event, error) {
+				key, err := newSaveKey(ctx, request)
+				assert.Nil(t, err)
+				return repo.save(ctx, request.Events, request.ExpectedVersion, key)
+			}
+			saved, err := save(tc.request())
+			assert.Nil(t, err)
+
+			// a retry, whose expected version is stale by now, still gets the original result
+			replayed, err := save(tc.request())
+			assert.Nil(t, err)
+			assert.Equal(t, 1, len(replayed))
+			assert.Equal(t, saved[0].Id, replayed[0].Id)
+			assert.Equal(t, saved[0].Timestamp, replayed[0].Timestamp)
+			assert.Equal(t, saved[0].Version, replayed[0].Version)
+			assert.Equal(t, int64(1), repo.pool.LLen(ctx, "dedb:domain_events:0:CUSTOMER:retryid").Val())
+
+			// but another save reusing the key is refused
+			reused := tc.request()
+			reused.Events[0].Name = "CustomerDeleted"
+			_, err = save(reused)
+			assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+		})
+	}
+}
+
+func TestRepoOutbox(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := Config{
+		RedisDbConfig: RedisDbConfig{
+			DbAddress: "redis:6379",
+			DbIndex:   0,
+		},
+	}
+	repo, err := NewRedisRepo(config)
+	if err != nil {
+		panic(err)
+	}
+	repo.pool.FlushAll(ctx)
+
+	// when
+	events := []*dedb.Event{
+		{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "outboxid"},
+		{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "outboxid"},
+		{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "outboxid"},
+	}
+	_, err = repo.save(ctx, events, nil, saveKey{})
+	assert.Nil(t, err)
+
+	// then the saved events wait in the outbox in position order
+	pending, err := repo.pending(ctx, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(pending))
+	assert.Equal(t, events[0].Id, pending[0].Id)
+	assert.Equal(t, events[1].Id, pending[1].Id)
+
+	// and leave it once published
+	err = repo.published(ctx, pending)
+	assert.Nil(t, err)
+	pending, err = repo.pending(ctx, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(pending))
+	assert.Equal(t, events[2].Id, pending[0].Id)
+}
+
+func TestRepoSchemas(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := Config{
+		RedisDbConfig: RedisDbConfig{
+			DbAddress: "redis:6379",
+			DbIndex:   0,
+		},
+	}
+	repo, err := NewRedisRepo(config)
+	if err != nil {
+		panic(err)
+	}
+	repo.pool.FlushAll(ctx)
+	first, err := repo.saveSchema(ctx, &dedb.Schema{Domain: "CUSTOMER", EventName: "CustomerCreated", Definition: []byte(`{}`)})
+	assert.Nil(t, err)
+
+	// when
+	second, err := repo.saveSchema(ctx, &dedb.Schema{Domain: "CUSTOMER", EventName: "CustomerCreated", Definition: []byte(`{"type":"object"}`)})
+	assert.Nil(t, err)
+	_, retryErr := repo.saveSchema(ctx, &dedb.Schema{Domain: "CUSTOMER", EventName: "CustomerCreated", Version: 1, Definition: []byte(`{}`)})
+	_, changeErr := repo.saveSchema(ctx, &dedb.Schema{Domain: "CUSTOMER", EventName: "CustomerCreated", Version: 1, Definition: []byte(`{"type":"string"}`)})
+	_, err = repo.saveSchema(ctx, &dedb.Schema{Domain: "ORDER", EventName: "OrderPlaced", Definition: []byte(`{}`)})
+	assert.Nil(t, err)
+
+	// then
+	assert.Equal(t, int32(1), first.Version)
+	assert.Equal(t, int32(2), second.Version)
+	assert.Nil(t, retryErr)
+	assert.Equal(t, codes.AlreadyExists, status.Code(changeErr))
+	latest, _ := repo.getSchema(ctx, "CUSTOMER", "CustomerCreated", 0)
+	assert.Equal(t, int32(2), latest.Version)
+	earlier, _ := repo.getSchema(ctx, "CUSTOMER", "CustomerCreated", 1)
+	assert.Equal(t, []byte(`{}`), earlier.Definition)
+	missing, err := repo.getSchema(ctx, "CUSTOMER", "CustomerDeleted", 0)
+	assert.Nil(t, err)
+	assert.Nil(t, missing)
+	schemas, _ := repo.listSchemas(ctx, "CUSTOMER", "")
+	assert.Equal(t, 2, len(schemas))
+	schemas, _ = repo.listSchemas(ctx, "", "")
+	assert.Equal(t, 3, len(schemas))
+}
+
+func TestRepoReadAll(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := Config{
+		RedisDbConfig: RedisDbConfig{
+			DbAddress: "redis:6379",
+			DbIndex:   0,
+		},
+	}
+	repo, err := NewRedisRepo(config)
+	if err != nil {
+		panic(err)
+	}
+	repo.pool.FlushAll(ctx)
+	for i := 0; i < readAllBatch+10; i++ {
+		name := "CustomerUpdated"
+		if i%100 == 0 {
+			name = "CustomerCreated"
+		}
+		_, err = repo.save(ctx, []*dedb.Event{{Name: name, Domain: "CUSTOMER", DomainId: fmt.Sprintf("id%d", i%7)}}, nil, saveKey{})
+		assert.Nil(t, err)
+	}
+	_, err = repo.save(ctx, []*dedb.Event{{Name: "OrderPlaced", Domain: "ORDER", DomainId: "order"}}, nil, saveKey{})
+	assert.Nil(t, err)
+	cases := []struct {
+		name   string
+		from   int64
+		limit  int64
+		filter eventFilter
+		count  int
+		first  int64
+		next   int64
+	}{
+		{name: "Everything", limit: 0, count: readAllBatch + 11, first: 1, next: readAllBatch + 11},
+		{name: "A page", from: 10, limit: 5, count: 5, first: 11, next: 15},
+		{name: "One domain", filter: newEventFilter("ORDER", nil), count: 1, first: readAllBatch + 11, next: readAllBatch + 11},
+		{name: "Names across batches", filter: newEventFilter("", []string{"CustomerCreated"}), count: 6, first: 1, next: readAllBatch + 11},
+		{name: "Names with a limit", limit: 2, filter: newEventFilter("", []string{"CustomerCreated"}), count: 2, first: 1, next: 101},
+	}
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			events, next, err := repo.readAll(ctx, tc.from, tc.limit, tc.filter)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.count, len(events))
+			assert.Equal(t, tc.first, events[0].Position)
+			assert.Equal(t, tc.next, next)
+			for i := 1; i < len(events); i++ {
+				assert.Less(t, events[i-1].Position, events[i].Position)
+			}
+		})
+	}
+
+	t.Run("Events saved before the index are indexed", func(t *testing.T) {
+		repo.pool.Del(ctx, repo.positionIndexKey(0, ""), repo.positionIndexKey(0, "ORDER"))
+		repo, err := NewRedisRepo(config)
+		assert.Nil(t, err)
+		events, _, err := repo.readAll(ctx, 0, 0, newEventFilter("ORDER", nil))
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(events))
+		all, _, _ := repo.readAll(ctx, 0, 0, eventFilter{})
+		assert.Equal(t, readAllBatch+11, len(all))
+	})
+}
+
+func TestRepoGetDomainByTimeRange(t *testing.T) {
+	config := Config{
+		RedisDbConfig: RedisDbConfig{
+			DbAddress: "redis:6379",
+			DbIndex:   0,
+		},
+	}
+	repo, err := NewRedisRepo(config)
+	if err != nil {
+		panic(err)
+	}
+	repo.pool.FlushAll(context.Background())
+	testRepoGetDomainByTimeRange(t, repo)
+}
+
+func TestRepoGetDomainBackward(t *testing.T) {
+	config := Config{
+		RedisDbConfig: RedisDbConfig{
+			DbAddress: "redis:6379",
+			DbIndex:   0,
+		},
+	}
+	repo, err := NewRedisRepo(config)
+	if err != nil {
+		panic(err)
+	}
+	repo.pool.FlushAll(context.Background())
+	testRepoGetDomainBackward(t, repo)
+}
+
+func TestRepoSaveSharedDomainId(t *testing.T) {
+	config := Config{
+		RedisDbConfig: RedisDbConfig{
+			DbAddress: "redis:6379",
+			DbIndex:   0,
+		},
+	}
+	repo, err := NewRedisRepo(config)
+	if err != nil {
+		panic(err)
+	}
+	repo.pool.FlushAll(context.Background())
+	testRepoSaveSharedDomainId(t, repo)
+}
+
+func TestRepoKeyByDomain(t *testing.T) {
+	// setup, domain ids saved when their keys did not name the domain
+	ctx := context.Background()
+	config := Config{
+		RedisDbConfig: RedisDbConfig{
+			DbAddress: "redis:6379",
+			DbIndex:   0,
+		},
+	}
+	old, err := NewRedisRepo(config)
+	if err != nil {
+		panic(err)
+	}
+	old.pool.FlushAll(ctx)
+	saved := []*dedb.Event{
+		{Id: "1", Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "sharedid", Timestamp: 10, Version: 1, Position: 1},
+		{Id: "2", Name: "OrderCreated", Domain: "ORDER", DomainId: "sharedid", Timestamp: 20, Version: 2, Position: 2},
+		{Id: "3", Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "sharedid", Timestamp: 30, Version: 3, Position: 3},
+		{Id: "4", Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "otherid", Timestamp: 40, Version: 1, Position: 4},
+	}
+	for _, e := range saved {
+		je, _ := Encode(e)
+		member := e.DomainId + ":" + strconv.FormatInt(e.Version, 10)
+		old.pool.RPush(ctx, "dedb:domain_events:0:"+e.DomainId, je)
+		old.pool.ZAdd(ctx, "dedb:domain_events_timestamp_idx:0:"+e.DomainId, &redis.Z{Score: float64(e.Timestamp), Member: e.Id})
+		old.pool.ZAdd(ctx, "dedb:position_idx:0:global", &redis.Z{Score: float64(e.Position), Member: member})
+		old.pool.ZAdd(ctx, "dedb:domain_position_idx:0:"+e.Domain, &redis.Z{Score: float64(e.Position), Member: member})
+	}
+	old.pool.Set(ctx, "dedb:position:0:global", 4, 0)
+	snapshot, _ := Encode(&dedb.Snapshot{Domain: "CUSTOMER", DomainId: "otherid", Version: 1, Data: []byte("state")})
+	old.pool.Set(ctx, "dedb:snapshots:0:otherid", snapshot, 0)
+	old.shutdown()
+
+	// when
+	repo, err := NewRedisRepo(config)
+	assert.Nil(t, err)
+	defer repo.shutdown()
+
+	// then each domain has its own events, numbered in the order they were saved
+	customers, err := repo.getDomain(ctx, "CUSTOMER", "sharedid", 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(customers))
+	assert.Equal(t, "3", customers[1].Id)
+	assert.Equal(t, int64(2), customers[1].Version)
+	orders, err := repo.getDomainByTimeRange(ctx, "ORDER", "sharedid", 0, 0, 0, dedb.Direction_FORWARD)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(orders))
+	assert.Equal(t, int64(1), orders[0].Version)
+	moved, err := repo.getSnapshot(ctx, "CUSTOMER", "otherid")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("state"), moved.Data)
+	all, _, err := repo.readAll(ctx, 0, 0, eventFilter{})
+	assert.Nil(t, err)
+	ids := []string{}
+	for _, e := range all {
+		ids = append(ids, e.Id)
+	}
+	assert.Equal(t, []string{"1", "2", "3", "4"}, ids)
+	orders, _, err = repo.readAll(ctx, 0, 0, eventFilter{domain: "ORDER"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(orders))
+	assert.Equal(t, int64(0), repo.pool.Exists(ctx, "dedb:domain_events:0:sharedid", "dedb:snapshots:0:otherid").Val())
+	indexed, _ := repo.pool.ZCard(ctx, "dedb:position_idx:0:global").Result()
+	assert.Equal(t, int64(4), indexed)
+
+	// and saves go on from the moved events
+	next, err := repo.save(ctx, []*dedb.Event{{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "sharedid"}}, nil, saveKey{})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), next[0].Version)
+}
+
+func TestRepoSharding(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := Config{
+		RedisDbConfig: RedisDbConfig{
+			DbAddress:      "redis:6379",
+			DbIndex:        0,
+			Shards:         4,
+			ShardAddresses: []string{"redis:6379", "127.0.0.1:6379"},
+			HashTags:       true,
+		},
+	}
+	repo, err := NewRedisRepo(config)
+	if err != nil {
+		panic(err)
+	}
+	repo.pool.FlushAll(ctx)
+	assert.Equal(t, 2, len(repo.nodes()))
+	domains := map[int]string{}
+	for i := 0; len(domains) < 4; i++ {
+		domain := fmt.Sprintf("DOMAIN%d", i)
+		if _, ok := domains[repo.getShard(domain, domain+"id")]; !ok {
+			domains[repo.getShard(domain, domain+"id")] = domain
+		}
+	}
+
+	// when
+	saved := []*dedb.Event{}
+	for i := 0; i < 12; i++ {
+		domain := domains[i%4]
+		events, err := repo.save(ctx, []*dedb.Event{{Name: "Updated", Domain: domain, DomainId: domain + "id"}}, nil, saveKey{})
+		assert.Nil(t, err)
+		saved = append(saved, events...)
+	}
+	err = repo.saveSnapshot(ctx, &dedb.Snapshot{Domain: domains[3], DomainId: domains[3] + "id", Version: 3, Data: []byte("state")})
+	assert.Nil(t, err)
+
+	// then the keys of each domain id are on its shard
+	for shard, domain := range domains {
+		key := repo.eventsKey(shard, domain, domain+"id")
+		assert.Contains(t, key, fmt.Sprintf("{%d}", shard))
+		length, _ := repo.client(shard).LLen(ctx, key).Result()
+		assert.Equal(t, int64(3), length)
+		events, err := repo.getDomain(ctx, domain, domain+"id", 0, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, len(events))
+		assert.Equal(t, int64(3), events[2].Version)
+		ids, _ := repo.getDomainIds(ctx, domain, 0, 0)
+		assert.Equal(t, []string{domain + "id"}, ids)
+	}
+	snapshot, err := repo.getSnapshot(ctx, domains[3], domains[3]+"id")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), snapshot.Version)
+
+	// and reading everything merges the shards in position order
+	all, next, err := repo.readAll(ctx, 0, 0, eventFilter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 12, len(all))
+	for i, e := range all {
+		assert.Equal(t, saved[i].Id, e.Id)
+	}
+	assert.Equal(t, saved[11].Position, next)
+	page, next, _ := repo.readAll(ctx, saved[4].Position, 3, eventFilter{})
+	assert.Equal(t, 3, len(page))
+	assert.Equal(t, saved[5].Id, page[0].Id)
+	assert.Equal(t, saved[7].Position, next)
+	one, _, _ := repo.readAll(ctx, 0, 0, newEventFilter(domains[2], nil))
+	assert.Equal(t, 3, len(one))
+
+	// and so does the outbox
+	pending, err := repo.pending(ctx, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(pending))
+	for i, e := range pending {
+		assert.Equal(t, saved[i].Id, e.Id)
+	}
+	assert.Nil(t, repo.published(ctx, pending))
+	pending, _ = repo.pending(ctx, 20)
+	assert.Equal(t, 7, len(pending))
+	assert.Equal(t, saved[5].Id, pending[0].Id)
+
+	// and a shard that fell behind saves past what was read
+	ahead := []*dedb.Event{}
+	for i := 0; i < 3; i++ {
+		events, err := repo.save(ctx, []*dedb.Event{{Name: "Updated", Domain: domains[0], DomainId: domains[0] + "id"}}, nil, saveKey{})
+		assert.Nil(t, err)
+		ahead = append(ahead, events...)
+	}
+	all, next, _ = repo.readAll(ctx, saved[11].Position, 0, eventFilter{})
+	assert.Equal(t, 3, len(all))
+	assert.Equal(t, ahead[2].Position, next)
+	behind, err := repo.save(ctx, []*dedb.Event{{Name: "Updated", Domain: domains[1], DomainId: domains[1] + "id"}}, nil, saveKey{})
+	assert.Nil(t, err)
+	assert.Greater(t, behind[0].Position, next)
+	all, _, _ = repo.readAll(ctx, next, 0, eventFilter{})
+	assert.Equal(t, 1, len(all))
+
+	// and the domain ids of a domain are merged from every shard
+	spread := map[int]bool{}
+	for i := 0; i < 8; i++ {
+		domainId := fmt.Sprintf("spread%d", i)
+		spread[repo.getShard("SPREAD", domainId)] = true
+		_, err := repo.save(ctx, []*dedb.Event{{Name: "Created", Domain: "SPREAD", DomainId: domainId}}, nil, saveKey{})
+		assert.Nil(t, err)
+	}
+	assert.Greater(t, len(spread), 1)
+	ids, err := repo.getDomainIds(ctx, "SPREAD", 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"spread0", "spread1", "spread2", "spread3", "spread4", "spread5", "spread6", "spread7"}, ids)
+	ids, _ = repo.getDomainIds(ctx, "SPREAD", 3, 2)
+	assert.Equal(t, []string{"spread3", "spread4"}, ids)
+
+	// and a save can't span shards
+	_, err = repo.save(ctx, []*dedb.Event{
+		{Name: "Updated", Domain: domains[0], DomainId: domains[0] + "id"},
+		{Name: "Updated", Domain: domains[1], DomainId: domains[1] + "id"},
+	}, nil, saveKey{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestJumpHash(t *testing.T) {
+	moved := 0
+	for key := uint64(0); key < 10000; key++ {
+		four := jumpHash(key*0x9E3779B97F4A7C15, 4)
+		five := jumpHash(key*0x9E3779B97F4A7C15, 5)
+		assert.True(t, four >= 0 && four < 4)
+		assert.Equal(t, four, jumpHash(key*0x9E3779B97F4A7C15, 4))
+		if four != five {
+			// a key only ever moves to the new bucket
+			assert.Equal(t, 4, five)
+			moved++
+		}
+	}
+	assert.InDelta(t, 2000, moved, 300)
+	assert.Equal(t, 0, jumpHash(42, 1))
+}
+
+func TestRepoCluster(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := Config{
+		RedisDbConfig: RedisDbConfig{
+			Mode:      redisCluster,
+			Addresses: []string{"redis:6379"},
+			Shards:    2,
+		},
+	}
+	repo, err := NewRedisRepo(config)
+	if err != nil {
+		panic(err)
+	}
+	_, ok := repo.pool.(*redis.ClusterClient)
+	assert.True(t, ok)
+	repo.pool.FlushAll(ctx)
+
+	// when
+	for i := 0; i < 6; i++ {
+		domain := fmt.Sprintf("DOMAIN%d", i%3)
+		_, err := repo.save(ctx, []*dedb.Event{{Name: "Updated", Domain: domain, DomainId: domain + "id"}}, nil, saveKey{key: "idem" + domain + fmt.Sprint(i)})
+		assert.Nil(t, err)
+	}
+
+	// then every key of a save shares the hash tag of its shard
+	shard := repo.getShard("DOMAIN1", "DOMAIN1id")
+	assert.Equal(t, fmt.Sprintf("dedb:domain_events:{%d}:DOMAIN1:DOMAIN1id", shard), repo.eventsKey(shard, "DOMAIN1", "DOMAIN1id"))
+	events, err := repo.getDomain(ctx, "DOMAIN1", "DOMAIN1id", 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(events))
+	all, _, err := repo.readAll(ctx, 0, 0, eventFilter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 6, len(all))
+
+	// and the position indexes are rebuilt from every node
+	for shard := range repo.shards {
+		repo.pool.Del(ctx, repo.positionIndexKey(shard, ""))
+	}
+	repo, err = NewRedisRepo(config)
+	assert.Nil(t, err)
+	all, _, _ = repo.readAll(ctx, 0, 0, eventFilter{})
+	assert.Equal(t, 6, len(all))
+
+	// and a cluster gets several shards by default
+	config.RedisDbConfig.Shards = 0
+	repo, err = NewRedisRepo(config)
+	assert.Nil(t, err)
+	assert.Equal(t, defaultClusterShards, len(repo.shards))
+}
+
+func TestRedisModes(t *testing.T) {
+	cases := []struct {
+		name   string
+		config RedisDbConfig
+		valid  bool
+		client interface{}
+	}{
+		{name: "Standalone", config: RedisDbConfig{DbAddress: "redis:6379"}, valid: true, client: &redis.Client{}},
+		{name: "Sentinel", config: RedisDbConfig{Mode: redisSentinel, MasterName: "master", Addresses: []string{"sentinel:26379"}}, valid: true, client: &redis.Client{}},
+		{name: "Sentinel without a master", config: RedisDbConfig{Mode: redisSentinel, Addresses: []string{"sentinel:26379"}}},
+		{name: "Cluster", config: RedisDbConfig{Mode: redisCluster, Addresses: []string{"node1:6379", "node2:6379"}}, valid: true, client: &redis.ClusterClient{}},
+		{name: "Cluster with shard addresses", config: RedisDbConfig{Mode: redisCluster, DbAddress: "node1:6379", ShardAddresses: []string{"node2:6379"}}},
+		{name: "Cluster with one shard", config: RedisDbConfig{Mode: redisCluster, Addresses: []string{"node1:6379"}, Shards: 1}},
+		{name: "Unknown mode", config: RedisDbConfig{Mode: "ring", DbAddress: "redis:6379"}},
+	}
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateRedisDbConfig(tc.config)
+			if !tc.valid {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			l := log.Logger
+			client, err := newPool(false, Config{RedisDbConfig: tc.config}, &l)
+			assert.Nil(t, err)
+			assert.IsType(t, tc.client, client)
+			client.Close()
+		})
+	}
+}
+
+func TestRedisTLS(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	ca, caKey := testCertificate(t, nil, nil, x509.ExtKeyUsageAny)
+	serverCert, serverKey := testCertificate(t, ca, caKey, x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := testCertificate(t, ca, caKey, x509.ExtKeyUsageClientAuth)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.Nil(t, os.WriteFile(caFile, testPEM("CERTIFICATE", ca.Raw), 0600))
+	clientPEM := string(testPEM("CERTIFICATE", clientCert.Raw))
+	clientKeyPEM := string(testPEM("EC PRIVATE KEY", testMarshalKey(t, clientKey)))
+	serverPair := tls.Certificate{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	tlsAddress := testTLSProxy(t, &tls.Config{Certificates: []tls.Certificate{serverPair}})
+	mtlsAddress := testTLSProxy(t, &tls.Config{Certificates: []tls.Certificate{serverPair}, ClientCAs: roots, ClientAuth: tls.RequireAndVerifyClientCert})
+
+	cases := []struct {
+		name   string
+		config RedisDbConfig
+		ok     bool
+	}{
+		{name: "CA from a file", config: RedisDbConfig{DbAddress: tlsAddress, RedisCa: caFile}, ok: true},
+		{name: "CA from the value", config: RedisDbConfig{DbAddress: tlsAddress, RedisCa: string(testPEM("CERTIFICATE", ca.Raw))}, ok: true},
+		{name: "Wrong server name", config: RedisDbConfig{DbAddress: tlsAddress, RedisCa: caFile, ServerName: "elsewhere"}},
+		{name: "System roots", config: RedisDbConfig{DbAddress: tlsAddress, TLS: true}},
+		{name: "Mutual TLS", config: RedisDbConfig{DbAddress: mtlsAddress, RedisCa: caFile, RedisUserCert: clientPEM, RedisUserKey: clientKeyPEM}, ok: true},
+		{name: "Mutual TLS without a client certificate", config: RedisDbConfig{DbAddress: mtlsAddress, RedisCa: caFile}},
+	}
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Nil(t, validateRedisDbConfig(tc.config))
+			l := log.Logger
+			client, err := newPool(false, Config{RedisDbConfig: tc.config}, &l)
+			assert.Nil(t, err)
+			defer client.Close()
+			err = client.Ping(ctx).Err()
+			if tc.ok {
+				assert.Nil(t, err)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+
+	t.Run("Bad PEM", func(t *testing.T) {
+		l := log.Logger
+		_, err := newPool(false, Config{RedisDbConfig: RedisDbConfig{DbAddress: tlsAddress, RedisCa: filepath.Join(t.TempDir(), "missing.pem")}}, &l)
+		assert.NotNil(t, err)
+		_, err = newPool(false, Config{RedisDbConfig: RedisDbConfig{DbAddress: tlsAddress, RedisUserCert: clientPEM, RedisUserKey: clientPEM}}, &l)
+		assert.NotNil(t, err)
+	})
+}
+
+// testCertificate issues a certificate for localhost from the CA, or a self signed CA without one
+func testCertificate(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, usage x509.ExtKeyUsage) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	parent, signer := template, key
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca, caKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return cert, key
+}
+
+func testMarshalKey(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	return der
+}
+
+func testPEM(kind string, der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+}
+
+// testTLSProxy terminates TLS in front of the dev Redis, returning the address to connect to
+func testTLSProxy(t *testing.T, config *tls.Config) string {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	assert.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				upstream, err := net.Dial("tcp", "redis:6379")
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return "localhost:" + port
+}
@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"context"
+	"hash/fnv"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// defaultClusterShards is the number of shards in cluster mode when REDIS_DB_SHARDS is not set
+const defaultClusterShards = 16
+
+/*
+Sharding spreads domain ids over a fixed number of shards, set with REDIS_DB_SHARDS, and the
+shards over the Redis instances in REDIS_DB_SHARD_ADDRESSES. Every key of a domain id lives
+on its shard, so a save stays a single script on one instance, while the domain ids of a
+domain are listed by merging the sorted sets of every shard. Domain ids are hashed to shards
+along with their domain by jump consistent hashing, so growing the number of shards only
+moves the domain ids that land on the new ones. Their keys have to be moved over before the
+new count is used.
+
+Each shard counts the events saved on it in its own sequence, which the save script takes
+the next values of, so positions are assigned at commit time without crossing instances or
+slots. The position of an event is its sequence times the number of shards plus its shard.
+Shards fill positions at their own pace, so before reading everything the lagging sequences
+are raised to the highest one and the read stops at the positions it covers, see fence. A
+read never finds an event at a position before one it already went past, the positions of a
+shard are in its commit order and those of different shards interleave, not every one of
+them being taken.
+
+With REDIS_DB_HASH_TAGS the shard number in each key is a hash tag, which puts every key of
+a shard in the same Redis Cluster slot.
+*/
+
+// jumpHash maps the key to one of the buckets, as in Lamping and Veach's jump consistent hash
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// getShard is the shard the keys of the domain id live on
+func (r *redisRepo) getShard(domain string, domainId string) int {
+	if len(r.shards) <= 1 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(domain + ":" + domainId))
+	return jumpHash(h.Sum64(), len(r.shards))
+}
+
+// client is the connection to the Redis instance holding the shard
+func (r *redisRepo) client(shard int) redis.UniversalClient {
+	return r.shards[shard]
+}
+
+func (r *redisRepo) key(shard int, prefix string, key string) string {
+	return redisKey{
+		db:     "dedb",
+		shard:  shard,
+		prefix: prefix,
+		key:    key,
+		tagged: r.tagged(),
+	}.String()
+}
+
+// tagged reports whether the shard number in keys is a hash tag
+func (r *redisRepo) tagged() bool {
+	return r.config.RedisDbConfig.HashTags || r.config.RedisDbConfig.cluster()
+}
+
+// sequenceKey is the counter of the events saved on the shard
+func (r *redisRepo) sequenceKey(shard int) string {
+	return r.key(shard, "position", "global")
+}
+
+// raiseSequence sets the sequence to the value unless it is past it already
+var raiseSequence = redis.NewScript(`
+local current = tonumber(redis.call('GET', KEYS[1]) or '0')
+if current < tonumber(ARGV[1]) then
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+/*
+fence returns the last position a read of every shard can go up to, 0 when it is not bounded.
+The sequences behind the highest one are raised to it, so every save from then on gets a
+position past the fence, and every position up to it is either committed or never taken.
+With a single shard its sequence is the position, taken in commit order, so there is no fence.
+*/
+func (r *redisRepo) fence(ctx context.Context) (int64, error) {
+	count := int64(len(r.shards))
+	if count <= 1 {
+		return 0, nil
+	}
+	sequences := make([]int64, count)
+	highest := int64(0)
+	for shard := range r.shards {
+		sequence, err := r.client(shard).Get(ctx, r.sequenceKey(shard)).Int64()
+		if err != nil && err != redis.Nil {
+			return 0, err
+		}
+		sequences[shard] = sequence
+		if sequence > highest {
+			highest = sequence
+		}
+	}
+	for shard, sequence := range sequences {
+		if sequence < highest {
+			err := raiseSequence.Run(ctx, r.client(shard), []string{r.sequenceKey(shard)}, highest).Err()
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return (highest+1)*count - 1, nil
+}
+
+/*
+connectShards connects to the instances the shards are spread over, shard n being on the
+nth address modulo their number. An address is only connected to once, the main one
+included. Sentinel and cluster modes keep every shard on the main client, a cluster
+spreading the shards over its nodes by their hash tags. All the keys of a shard are in one
+slot, so a cluster gets several shards unless told otherwise.
+*/
+func (r *redisRepo) connectShards() error {
+	count := r.config.RedisDbConfig.Shards
+	if count < 1 && r.config.RedisDbConfig.cluster() {
+		count = defaultClusterShards
+	} else if count < 1 {
+		count = 1
+	}
+	r.shards = make([]redis.UniversalClient, count)
+	mode := r.config.RedisDbConfig.Mode
+	if mode != "" && mode != redisStandalone {
+		for shard := range r.shards {
+			r.shards[shard] = r.pool
+		}
+		return nil
+	}
+	addresses := r.config.RedisDbConfig.ShardAddresses
+	if len(addresses) == 0 {
+		addresses = []string{r.config.RedisDbConfig.DbAddress}
+	}
+	clients := map[string]redis.UniversalClient{r.config.RedisDbConfig.DbAddress: r.pool}
+	for shard := range r.shards {
+		address := addresses[shard%len(addresses)]
+		client, ok := clients[address]
+		if !ok {
+			config := r.config
+			config.RedisDbConfig.DbAddress = address
+			var err error
+			client, err = newPool(false, config, &r.log)
+			if err != nil {
+				return err
+			}
+			clients[address] = client
+		}
+		r.shards[shard] = client
+	}
+	return nil
+}
+
+// nodes are the distinct instances the shards are on, each with the shards it holds
+func (r *redisRepo) nodes() map[redis.UniversalClient][]int {
+	nodes := make(map[redis.UniversalClient][]int)
+	for shard, client := range r.shards {
+		nodes[client] = append(nodes[client], shard)
+	}
+	return nodes
+}
+
+/*
+scan calls the function with every key matching the pattern. A cluster is scanned node by
+node, as each master only holds the keys of its own slots.
+*/
+func scan(ctx context.Context, client redis.UniversalClient, pattern string, fn func(key string) error) error {
+	scanNode := func(ctx context.Context, node redis.Cmdable) error {
+		iter := node.Scan(ctx, 0, pattern, 100).Iterator()
+		for iter.Next(ctx) {
+			if err := fn(iter.Val()); err != nil {
+				return err
+			}
+		}
+		return iter.Err()
+	}
+	if cluster, ok := client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return scanNode(ctx, node)
+		})
+	}
+	return scanNode(ctx, client)
+}
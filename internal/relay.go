@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	relayBatchSize       = 100
+	defaultRelayInterval = time.Second
+)
+
+/*
+relay moves events from the repository outbox to the publisher. Events are only removed
+from the outbox once the publisher accepted them, so a failed publish is retried until it
+goes through and subscribers get every event at least once.
+*/
+type relay struct {
+	log      zerolog.Logger
+	repo     repository
+	pub      publisher
+	interval time.Duration
+	nudge    chan struct{}
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+func newRelay(repo repository, pub publisher, interval time.Duration, log zerolog.Logger) *relay {
+	if interval <= 0 {
+		interval = defaultRelayInterval
+	}
+	return &relay{
+		log:      log.With().Str("op", "relay").Logger(),
+		repo:     repo,
+		pub:      pub,
+		interval: interval,
+		nudge:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+func (r *relay) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	go func() {
+		defer close(r.done)
+		r.run(ctx)
+	}()
+}
+
+// notify wakes the relay up so newly saved events don't wait for the next poll
+func (r *relay) notify() {
+	select {
+	case r.nudge <- struct{}{}:
+	default:
+	}
+}
+
+func (r *relay) stop() {
+	if r.cancel != nil {
+		r.cancel()
+		<-r.done
+	}
+}
+
+func (r *relay) run(ctx context.Context) {
+	for {
+		err := r.drain(ctx)
+		if err != nil && ctx.Err() == nil {
+			r.log.Error().Err(err).Msgf("could not relay events, retrying in %s", r.interval)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.nudge:
+		case <-time.After(r.interval):
+		}
+	}
+}
+
+// drain publishes batches from the outbox until it is empty
+func (r *relay) drain(ctx context.Context) error {
+	for ctx.Err() == nil {
+		events, err := r.repo.pending(ctx, relayBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		err = r.pub.publish(ctx, events)
+		if err != nil {
+			return err
+		}
+		err = r.repo.published(ctx, events)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
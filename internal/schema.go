@@ -0,0 +1,298 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	api "dedb"
+)
+
+// payloadValidator checks event data against a registered schema
+type payloadValidator interface {
+	validate(data []byte) []string
+}
+
+// latestSchemaTTL is how long the latest schema of an event is cached, or that it has none
+const latestSchemaTTL = 5 * time.Second
+
+/*
+schemaRegistry validates saved events against the schemas registered for them. Schemas are
+stored through the repository, so every instance of the service sees the same ones.
+Registered versions never change, which lets them and their compiled validators be cached
+for good. Which version is the latest is cached for a few seconds, and dropped when this
+instance registers a new one, so saves do not go to the repository for every event.
+*/
+type schemaRegistry struct {
+	repo repository
+
+	mu       sync.Mutex
+	compiled map[string]payloadValidator // domain:event name:version => validator
+	versions map[string]*api.Schema      // domain:event name:version => schema
+	latest   map[string]latestSchema     // domain:event name => latest schema
+}
+
+type latestSchema struct {
+	schema  *api.Schema // nil when none is registered
+	expires time.Time
+}
+
+func newSchemaRegistry(repo repository) *schemaRegistry {
+	return &schemaRegistry{
+		repo:     repo,
+		compiled: make(map[string]payloadValidator),
+		versions: make(map[string]*api.Schema),
+		latest:   make(map[string]latestSchema),
+	}
+}
+
+func (r *schemaRegistry) register(ctx context.Context, schema *api.Schema) (*api.Schema, error) {
+	if schema == nil || schema.Domain == "" || schema.EventName == "" {
+		return nil, status.Error(codes.InvalidArgument, "schema with a domain and event name is required")
+	}
+	if schema.Version < 0 {
+		return nil, status.Error(codes.InvalidArgument, "schema version can not be negative")
+	}
+	_, err := compileSchema(schema)
+	if err != nil {
+		return nil, invalidArgument("schema definition is not valid", []*errdetails.BadRequest_FieldViolation{
+			{Field: "schema.definition", Description: err.Error()},
+		})
+	}
+	saved, err := r.repo.saveSchema(ctx, schema)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	delete(r.latest, schema.Domain+":"+schema.EventName)
+	r.mu.Unlock()
+	return saved, nil
+}
+
+// lookup returns the schema of the version, or the latest one for version 0, nil if none is registered
+func (r *schemaRegistry) lookup(ctx context.Context, domain string, eventName string, version int32) (*api.Schema, error) {
+	latestKey := domain + ":" + eventName
+	r.mu.Lock()
+	if version == 0 {
+		if cached, ok := r.latest[latestKey]; ok && time.Now().Before(cached.expires) {
+			r.mu.Unlock()
+			return cached.schema, nil
+		}
+	} else if schema, ok := r.versions[schemaKey(domain, eventName, version)]; ok {
+		r.mu.Unlock()
+		return schema, nil
+	}
+	r.mu.Unlock()
+
+	schema, err := r.repo.getSchema(ctx, domain, eventName, version)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if version == 0 {
+		r.latest[latestKey] = latestSchema{schema: schema, expires: time.Now().Add(latestSchemaTTL)}
+	}
+	if schema != nil {
+		r.versions[schemaKey(domain, eventName, schema.Version)] = schema
+	}
+	return schema, nil
+}
+
+/*
+validate checks the data of each event against the schema registered for its domain and
+name, the latest one unless the event asks for a version. The version used is set on the
+event, and so is the content type and schema when the event leaves them out. Events with
+no schema registered are not checked.
+*/
+func (r *schemaRegistry) validate(ctx context.Context, events []*api.Event) error {
+	violations := []*errdetails.BadRequest_FieldViolation{}
+	for i, e := range events {
+		field := fmt.Sprintf("events[%d].data", i)
+		schema, err := r.lookup(ctx, e.Domain, e.Name, e.SchemaVersion)
+		if err != nil {
+			return err
+		}
+		if schema == nil {
+			if e.SchemaVersion != 0 {
+				violations = append(violations, &errdetails.BadRequest_FieldViolation{
+					Field:       fmt.Sprintf("events[%d].schema_version", i),
+					Description: fmt.Sprintf("%s has no schema version %d registered", e.Name, e.SchemaVersion),
+				})
+			}
+			continue
+		}
+		e.SchemaVersion = schema.Version
+
+		contentType, name := schemaContentType(schema)
+		if e.ContentType == "" {
+			e.ContentType = contentType
+		}
+		if e.Schema == "" {
+			e.Schema = name
+		}
+		if e.ContentType != contentType || e.Schema != name {
+			violations = append(violations, &errdetails.BadRequest_FieldViolation{
+				Field:       field,
+				Description: fmt.Sprintf("%s schema version %d is for %s %s data", e.Name, schema.Version, contentType, name),
+			})
+			continue
+		}
+
+		validator, err := r.validator(schema)
+		if err != nil {
+			return status.Errorf(codes.Internal, "registered schema for %s does not compile", e.Name)
+		}
+		for _, problem := range validator.validate(e.Data) {
+			violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: field, Description: problem})
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return invalidArgument("event data does not match the registered schema", violations)
+}
+
+func (r *schemaRegistry) validator(schema *api.Schema) (payloadValidator, error) {
+	key := schemaKey(schema.Domain, schema.EventName, schema.Version)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if v, ok := r.compiled[key]; ok {
+		return v, nil
+	}
+	v, err := compileSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+	r.compiled[key] = v
+	return v, nil
+}
+
+func compileSchema(schema *api.Schema) (payloadValidator, error) {
+	switch schema.Type {
+	case api.Schema_JSON_SCHEMA:
+		return compileJSONSchema(schema.Definition)
+	case api.Schema_PROTOBUF:
+		return compileProtoSchema(schema.Definition, schema.MessageName)
+	}
+	return nil, fmt.Errorf("unknown schema type %v", schema.Type)
+}
+
+// schemaContentType is the content type and schema name events of the schema carry
+func schemaContentType(schema *api.Schema) (string, string) {
+	if schema.Type == api.Schema_PROTOBUF {
+		return contentTypeProtobuf, schema.MessageName
+	}
+	return contentTypeJSON, ""
+}
+
+func schemaKey(domain string, eventName string, version int32) string {
+	return domain + ":" + eventName + ":" + strconv.Itoa(int(version))
+}
+
+// sameSchema reports whether registering b again over a is a retry rather than a change
+func sameSchema(a *api.Schema, b *api.Schema) bool {
+	return a.Type == b.Type && a.MessageName == b.MessageName && bytes.Equal(a.Definition, b.Definition)
+}
+
+func schemaExists(schema *api.Schema) error {
+	return status.Errorf(codes.AlreadyExists, "%s version %d of %s is already registered with a different definition", schema.EventName, schema.Version, schema.Domain)
+}
+
+// sortSchemas orders schemas by domain, event name and version
+func sortSchemas(schemas []*api.Schema) {
+	sort.Slice(schemas, func(i, j int) bool {
+		a, b := schemas[i], schemas[j]
+		if a.Domain != b.Domain {
+			return a.Domain < b.Domain
+		}
+		if a.EventName != b.EventName {
+			return a.EventName < b.EventName
+		}
+		return a.Version < b.Version
+	})
+}
+
+// protoSchema validates data as a message built from a registered descriptor set
+type protoSchema struct {
+	desc protoreflect.MessageDescriptor
+}
+
+func compileProtoSchema(definition []byte, messageName string) (*protoSchema, error) {
+	if messageName == "" {
+		return nil, fmt.Errorf("message name is required for protobuf schemas")
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	err := proto.Unmarshal(definition, set)
+	if err != nil {
+		return nil, fmt.Errorf("definition is not a serialized FileDescriptorSet: %v", err)
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, fmt.Errorf("descriptor set does not resolve: %v", err)
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(messageName))
+	if err != nil {
+		return nil, fmt.Errorf("message %s is not in the descriptor set", messageName)
+	}
+	desc, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a message", messageName)
+	}
+	return &protoSchema{desc: desc}, nil
+}
+
+/*
+validate decodes the data as the message. protobuf skips fields it does not know, so any
+left over means the data was written as some other message.
+*/
+func (s *protoSchema) validate(data []byte) []string {
+	m := dynamicpb.NewMessage(s.desc)
+	err := proto.Unmarshal(data, m)
+	if err != nil {
+		return []string{fmt.Sprintf("data is not a valid %s: %v", s.desc.FullName(), err)}
+	}
+	if path := unknownFields(m, string(s.desc.Name())); path != "" {
+		return []string{fmt.Sprintf("data has fields %s does not define at %s", s.desc.FullName(), path)}
+	}
+	return nil
+}
+
+// unknownFields returns the path of the first message holding unknown fields, if any
+func unknownFields(m protoreflect.Message, path string) string {
+	if len(m.GetUnknown()) > 0 {
+		return path
+	}
+	found := ""
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsList() && fd.Message() != nil:
+			list := v.List()
+			for i := 0; i < list.Len() && found == ""; i++ {
+				found = unknownFields(list.Get(i).Message(), fmt.Sprintf("%s.%s[%d]", path, fd.Name(), i))
+			}
+		case fd.IsMap() && fd.MapValue().Message() != nil:
+			v.Map().Range(func(k protoreflect.MapKey, mv protoreflect.Value) bool {
+				found = unknownFields(mv.Message(), fmt.Sprintf("%s.%s[%v]", path, fd.Name(), k.Interface()))
+				return found == ""
+			})
+		case fd.Message() != nil && !fd.IsList() && !fd.IsMap():
+			found = unknownFields(v.Message(), path+"."+string(fd.Name()))
+		}
+		return found == ""
+	})
+	return found
+}
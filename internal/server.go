@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+
+	"google.golang.org/grpc/credentials"
+)
+
+/*
+NewServerCredentials returns the TLS credentials of the gRPC server, or nil when it has no
+certificate and serves plaintext. With a client CA every client has to present a
+certificate it issued.
+*/
+func NewServerCredentials(config ServerConfig) (credentials.TransportCredentials, error) {
+	if config.TLSCert == "" {
+		if config.ClientCa != "" {
+			return nil, fmt.Errorf("SERVER_TLS_CERT config entry required with SERVER_CLIENT_CA")
+		}
+		return nil, nil
+	}
+	certPEM, err := loadPEM(config.TLSCert)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the server certificate: %w", err)
+	}
+	keyPEM, err := loadPEM(config.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the server key: %w", err)
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the server key pair: %w", err)
+	}
+	tlscfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{pair},
+	}
+	if config.ClientCa != "" {
+		caPEM, err := loadPEM(config.ClientCa)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the client CA: %w", err)
+		}
+		tlscfg.ClientCAs = x509.NewCertPool()
+		if !tlscfg.ClientCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in the client CA")
+		}
+		tlscfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return credentials.NewTLS(tlscfg), nil
+}
@@ -3,34 +3,163 @@ package internal
 import (
 	"context"
 	"fmt"
+	"io"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	api "dedb"
 )
 
+// defaultReadAllLimit caps ReadAll pages when the request sets no limit
+const defaultReadAllLimit = 1000
+
 /*
 Base API level gRPC service
 */
 type Service struct {
-	repo repository
-	pub  publisher
-	log  zerolog.Logger
+	repo    repository
+	pub     publisher
+	sub     subscriber
+	relay   *relay
+	schemas *schemaRegistry
+	upcasts upcasterChain
+	policy  *policy // nil when every call is allowed
+	log     zerolog.Logger
+}
+
+// authorize checks the accesses against the policy, when there is one
+func (s *Service) authorize(ctx context.Context, accesses ...access) error {
+	if s.policy == nil {
+		return nil
+	}
+	return s.policy.authorize(ctx, accesses...)
 }
 
 func (s *Service) Save(ctx context.Context, request *api.SaveRequest) (*api.SaveResponse, error) {
-	err := s.repo.save(ctx, request.Events)
+	if len(request.Events) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "at least one event is required to save")
+	}
+	err := validateExpectedVersion(request)
+	if err != nil {
+		return nil, err
+	}
+	key, err := newSaveKey(ctx, request)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "could not hash the request")
+	}
+	err = validatePayloads(request.Events)
+	if err != nil {
+		return nil, err
+	}
+	accesses := make([]access, 0, len(request.Events))
+	for _, e := range request.Events {
+		accesses = append(accesses, access{operation: opSave, domain: e.Domain, eventName: e.Name})
+	}
+	err = s.authorize(ctx, accesses...)
+	if err != nil {
+		return nil, err
+	}
+	err = s.schemas.validate(ctx, request.Events)
+	if err != nil {
+		return nil, err
+	}
+	events, err := s.repo.save(ctx, request.Events, request.ExpectedVersion, key)
 	if err != nil {
 		return nil, err
 	}
 
-	s.pub.publish(ctx, request.Events)
-	return &api.SaveResponse{}, nil
+	// the events were put in the outbox with the save, the relay publishes them
+	s.relay.notify()
+	return saveResponse(events), nil
+}
+
+/*
+saveResponse returns the events as assigned by the repository, along with the version the
+domain id of the first event ended up at.
+*/
+func saveResponse(events []*api.Event) *api.SaveResponse {
+	response := &api.SaveResponse{Events: events}
+	for _, e := range events {
+		if e.DomainId == events[0].DomainId && e.Version > response.Version {
+			response.Version = e.Version
+		}
+	}
+	return response
 }
 
 func (s *Service) GetDomain(ctx context.Context, request *api.GetDomainRequest) (*api.GetResponse, error) {
-	events, err := s.repo.getDomain(ctx, request.Domain, request.DomainId, request.Offset, request.Limit)
+	err := s.authorize(ctx, access{operation: opRead, domain: request.Domain})
+	if err != nil {
+		return nil, err
+	}
+	if request.Direction == api.Direction_BACKWARD {
+		return s.getDomainBackward(ctx, request)
+	}
+	var snapshot *api.Snapshot
+	offset := request.Offset
+	if request.FromSnapshot {
+		snapshot, err = s.repo.getSnapshot(ctx, request.Domain, request.DomainId)
+		if err != nil {
+			return nil, err
+		}
+		if snapshot != nil {
+			offset = snapshot.Version
+		}
+	}
+	events, err := s.repo.getDomain(ctx, request.Domain, request.DomainId, offset, request.Limit)
+	if err != nil {
+		return nil, err
+	}
+	events, err = s.upcasts.upcast(events)
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetResponse{Events: events, Snapshot: snapshot}, nil
+}
+
+// getDomainBackward returns the latest events first, the offset being the version to read before
+func (s *Service) getDomainBackward(ctx context.Context, request *api.GetDomainRequest) (*api.GetResponse, error) {
+	if request.FromSnapshot {
+		return nil, status.Error(codes.InvalidArgument, "from snapshot can only be read forward")
+	}
+	if request.Offset < 0 || request.Limit < 0 {
+		return nil, status.Error(codes.InvalidArgument, "offset and limit can not be negative")
+	}
+	events, err := s.repo.getDomainBackward(ctx, request.Domain, request.DomainId, request.Offset, request.Limit)
+	if err != nil {
+		return nil, err
+	}
+	events, err = s.upcasts.upcast(events)
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetResponse{Events: events}, nil
+}
+
+/*
+GetDomainByTimeRange returns the events of a domain id saved within the time range, which
+is how the domain instance looked at a point in time when read from the start.
+*/
+func (s *Service) GetDomainByTimeRange(ctx context.Context, request *api.GetDomainByTimeRangeRequest) (*api.GetResponse, error) {
+	err := s.authorize(ctx, access{operation: opRead, domain: request.Domain})
+	if err != nil {
+		return nil, err
+	}
+	if request.FromTimestamp < 0 || request.ToTimestamp < 0 || request.Limit < 0 {
+		return nil, status.Error(codes.InvalidArgument, "timestamps and limit can not be negative")
+	}
+	if request.ToTimestamp > 0 && request.ToTimestamp < request.FromTimestamp {
+		return nil, status.Error(codes.InvalidArgument, "to timestamp must not be before from timestamp")
+	}
+	events, err := s.repo.getDomainByTimeRange(ctx, request.Domain, request.DomainId, request.FromTimestamp, request.ToTimestamp, request.Limit, request.Direction)
+	if err != nil {
+		return nil, err
+	}
+	events, err = s.upcasts.upcast(events)
 	if err != nil {
 		return nil, err
 	}
@@ -38,6 +167,10 @@ func (s *Service) GetDomain(ctx context.Context, request *api.GetDomainRequest)
 }
 
 func (s *Service) GetDomainIds(ctx context.Context, request *api.GetDomainIdsRequest) (*api.GetDomainIdsResponse, error) {
+	err := s.authorize(ctx, access{operation: opRead, domain: request.Domain})
+	if err != nil {
+		return nil, err
+	}
 	ids, err := s.repo.getDomainIds(ctx, request.Domain, request.Offset, request.Limit)
 	if err != nil {
 		return nil, err
@@ -45,46 +178,283 @@ func (s *Service) GetDomainIds(ctx context.Context, request *api.GetDomainIdsReq
 	return &api.GetDomainIdsResponse{DomainIds: ids}, nil
 }
 
+/*
+ReadAll pages through the events of every domain id in commit order, optionally filtered
+to a domain and event names, for rebuilding read models from the start.
+*/
+func (s *Service) ReadAll(ctx context.Context, request *api.ReadAllRequest) (*api.ReadAllResponse, error) {
+	if request.FromPosition < 0 || request.Limit < 0 {
+		return nil, status.Error(codes.InvalidArgument, "from position and limit can not be negative")
+	}
+	domain := request.Domain
+	if domain == "" {
+		domain = allDomains
+	}
+	err := s.authorize(ctx, access{operation: opRead, domain: domain})
+	if err != nil {
+		return nil, err
+	}
+	limit := request.Limit
+	if limit == 0 {
+		limit = defaultReadAllLimit
+	}
+	events, next, err := s.repo.readAll(ctx, request.FromPosition, limit, newEventFilter(request.Domain, request.EventNames))
+	if err != nil {
+		return nil, err
+	}
+	events, err = s.upcasts.upcast(events)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ReadAllResponse{Events: events, NextPosition: next}, nil
+}
+
+func (s *Service) SaveSnapshot(ctx context.Context, request *api.SaveSnapshotRequest) (*api.SaveSnapshotResponse, error) {
+	snapshot := request.Snapshot
+	if snapshot == nil || snapshot.Domain == "" || snapshot.DomainId == "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshot with a domain and domain id is required")
+	}
+	if snapshot.Version < 1 {
+		return nil, status.Error(codes.InvalidArgument, "snapshot version must be at least 1")
+	}
+	err := s.authorize(ctx, access{operation: opSave, domain: snapshot.Domain})
+	if err != nil {
+		return nil, err
+	}
+	err = s.repo.saveSnapshot(ctx, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return &api.SaveSnapshotResponse{}, nil
+}
+
+func (s *Service) GetSnapshot(ctx context.Context, request *api.GetSnapshotRequest) (*api.GetSnapshotResponse, error) {
+	err := s.authorize(ctx, access{operation: opRead, domain: request.Domain})
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := s.repo.getSnapshot(ctx, request.Domain, request.DomainId)
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetSnapshotResponse{Snapshot: snapshot}, nil
+}
+
+/*
+RegisterUpcaster adds the upcaster that brings events of the domain and name written with
+the schema version up to the next version. GetDomain and subscriptions run the events they
+read through every upcaster in turn, so readers only ever see the latest shape. Upcasters
+of JSON payloads can also be declared in the UPCASTERS_FILE, which is registered at Start.
+*/
+func (s *Service) RegisterUpcaster(domain string, eventName string, version int32, upcaster Upcaster) {
+	s.upcasts.register(domain, eventName, version, upcaster)
+}
+
+/*
+RegisterSchema registers a schema that the data of the named events is validated against
+when saved. Without a version it becomes the next version of the event's schema.
+*/
+func (s *Service) RegisterSchema(ctx context.Context, request *api.RegisterSchemaRequest) (*api.RegisterSchemaResponse, error) {
+	err := s.authorize(ctx, access{operation: opSave, domain: request.Schema.GetDomain(), eventName: request.Schema.GetEventName()})
+	if err != nil {
+		return nil, err
+	}
+	schema, err := s.schemas.register(ctx, request.Schema)
+	if err != nil {
+		return nil, err
+	}
+	return &api.RegisterSchemaResponse{Schema: schema}, nil
+}
+
+func (s *Service) GetSchema(ctx context.Context, request *api.GetSchemaRequest) (*api.GetSchemaResponse, error) {
+	err := s.authorize(ctx, access{operation: opRead, domain: request.Domain})
+	if err != nil {
+		return nil, err
+	}
+	schema, err := s.repo.getSchema(ctx, request.Domain, request.EventName, request.Version)
+	if err != nil {
+		return nil, err
+	}
+	if schema == nil {
+		return nil, status.Errorf(codes.NotFound, "no schema registered for %s %s", request.Domain, request.EventName)
+	}
+	return &api.GetSchemaResponse{Schema: schema}, nil
+}
+
+func (s *Service) ListSchemas(ctx context.Context, request *api.ListSchemasRequest) (*api.ListSchemasResponse, error) {
+	domain := request.Domain
+	if domain == "" {
+		domain = allDomains
+	}
+	err := s.authorize(ctx, access{operation: opRead, domain: domain})
+	if err != nil {
+		return nil, err
+	}
+	schemas, err := s.repo.listSchemas(ctx, request.Domain, request.EventName)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ListSchemasResponse{Schemas: schemas}, nil
+}
+
+/*
+Subscribe runs a consumer group subscription over the bidirectional stream. The client
+sends CONNECT with its consumer group, domains and event names, gets matching events
+sent back, ACKs each one by its id and finally sends DISCONNECT.
+*/
 func (s *Service) Subscribe(src api.DeDB_SubscribeServer) error {
-	/*
+	log := s.log.With().Str("op", "subscribe").Logger()
+	if s.sub == nil {
+		return status.Error(codes.Unimplemented, "subscriptions are not supported by the configured broker")
+	}
+	ctx, cancel := context.WithCancel(src.Context())
+	defer cancel()
+
+	requests := make(chan *api.SubscribeRequest)
+	errs := make(chan error, 2)
+	go func() {
 		for {
-			if s.shutdown {
-				//s.notifyClientsOfRemoval()
-				break
-			}
 			r, err := src.Recv()
-			if err == io.EOF {
-				s.log.Error().Err(err).Msgf("client broke connection")
-				s.removeClient(src)
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case requests <- r:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var sub *subscription
+	defer func() {
+		if sub != nil {
+			sub.close()
+		}
+	}()
+	for {
+		select {
+		case err := <-errs:
+			if err == io.EOF || status.Code(err) == codes.Canceled {
+				log.Debug().Msg("client closed the stream")
 				return nil
-			} else if err != nil {
-				s.log.Error().Err(err).Msgf("error receiving from client")
-				s.removeClient(src)
+			}
+			log.Error().Err(err).Msg("subscription ended")
+			return err
+		case r := <-requests:
+			switch r.RequestType {
+			case api.SubscribeRequest_CONNECT:
+				if sub != nil {
+					return status.Error(codes.FailedPrecondition, "client is already connected")
+				}
+				err := s.authorize(ctx, subscribeAccesses(r.ConsumerGroup, r.Domains, r.EventNames)...)
+				if err != nil {
+					return err
+				}
+				sub, err = newSubscription(ctx, s.sub, &s.upcasts, src, r, log)
+				if err != nil {
+					return err
+				}
+				log.Info().Msgf("consumer %s connected to %v", sub.consumer, sub.domains)
+				sub.start(ctx, errs)
+			case api.SubscribeRequest_ACK:
+				if sub == nil {
+					return status.Error(codes.FailedPrecondition, "client must connect before acking")
+				}
+				err := sub.ack(ctx, r.EventId, r.Domain, r.Timestamp)
+				if err != nil {
+					log.Error().Err(err).Msgf("could not ack event")
+					return status.Error(codes.Internal, "could not ack event")
+				}
+			case api.SubscribeRequest_DISCONNECT:
+				log.Debug().Msg("client disconnected")
 				return nil
-			} else if r.RequestType == pb.SubscribeEventsRequest_ACK {
-				s.ack(r)
-			} else if !s.leader {
-				s.notifyClientsOfRemoval()
-			} else if r.RequestType == pb.SubscribeEventsRequest_CONNECT {
-				s.addClient(src, r.ServiceName, r.EventNames)
-			} else if r.RequestType == pb.SubscribeEventsRequest_DISCONNECT {
-				s.removeClient(src)
 			}
 		}
-	*/
-	return nil
+	}
+}
+
+/*
+SubscribeFrom streams the stored events after the requested position, followed by a
+caught up message and then the live events as they are published, with no gap and no
+duplicate in between. A client resumes after a disconnect from the last position it got.
+*/
+func (s *Service) SubscribeFrom(request *api.SubscribeFromRequest, src api.DeDB_SubscribeFromServer) error {
+	log := s.log.With().Str("op", "subscribeFrom").Logger()
+	if s.sub == nil {
+		return status.Error(codes.Unimplemented, "subscriptions are not supported by the configured broker")
+	}
+	domain := request.Domain
+	if domain == "" {
+		domain = allDomains
+	}
+	err := s.authorize(src.Context(), subscribeAccesses("", []string{domain}, request.EventNames)...)
+	if err != nil {
+		return err
+	}
+	c, err := newCatchUp(s.repo, s.sub, &s.upcasts, src, request, log)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("catching up %s from position %d", c.consumer, request.FromPosition)
+	err = c.run(src.Context())
+	if status.Code(err) == codes.Canceled || src.Context().Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// subscribeAccesses is subscribing to each event name of each domain, or to the "*" name for all of them
+func subscribeAccesses(group string, domains []string, eventNames []string) []access {
+	if len(eventNames) == 0 {
+		eventNames = []string{"*"}
+	}
+	accesses := make([]access, 0, len(domains)*len(eventNames))
+	for _, domain := range domains {
+		for _, name := range eventNames {
+			accesses = append(accesses, access{operation: opSubscribe, domain: domain, eventName: name, group: group})
+		}
+	}
+	return accesses
 }
 
 func (s *Service) Shutdown() {
+	if s.relay != nil {
+		s.relay.stop()
+	}
 	if s.repo != nil {
 		s.repo.shutdown()
 	}
+	if s.pub != nil {
+		s.pub.shutdown()
+	}
 }
 
 func (s *Service) Start(config Config) error {
 	s.log = log.With().Str("logger", "dedbService").Logger()
 	s.log.Info().Msg("processing configuration")
 
+	// the files are loaded first, so a bad one fails the start before any connection is opened
+	if config.ServerConfig.PolicyFile != "" {
+		p, err := newPolicy(config.ServerConfig.PolicyFile)
+		if err != nil {
+			s.log.Error().Err(err).Msg("could not load the policy file")
+			return err
+		}
+		s.policy = p
+	}
+	if config.UpcastersFile != "" {
+		rules, err := loadUpcasters(config.UpcastersFile)
+		if err != nil {
+			s.log.Error().Err(err).Msg("could not load the upcasters file")
+			return err
+		}
+		for _, rule := range rules {
+			s.RegisterUpcaster(rule.Domain, rule.EventName, rule.Version, rule)
+		}
+	}
+
 	if config.RepoImpl == "redis" {
 		r, err := NewRedisRepo(config)
 		if err != nil {
@@ -93,6 +463,14 @@ func (s *Service) Start(config Config) error {
 		} else {
 			s.repo = r
 		}
+	} else if config.RepoImpl == "memory" {
+		r, err := NewMemoryRepo(config)
+		if err != nil {
+			s.log.Error().Err(err).Msg("could not configure memory repo")
+			return err
+		} else {
+			s.repo = r
+		}
 	} else if config.RepoImpl == "sqlite" {
 		r, err := NewSqliteRepo(config)
 		if err != nil {
@@ -101,11 +479,20 @@ func (s *Service) Start(config Config) error {
 		} else {
 			s.repo = r
 		}
+	} else if config.RepoImpl == "postgres" {
+		r, err := NewPostgresRepo(config)
+		if err != nil {
+			s.log.Error().Err(err).Msg("could not configure postgres repo")
+			return err
+		} else {
+			s.repo = r
+		}
 	} else {
 		msg := fmt.Sprintf("repository %s not supported", config.RepoImpl)
 		s.log.Error().Msgf(msg)
 		return fmt.Errorf(msg)
 	}
+	s.schemas = newSchemaRegistry(s.repo)
 
 	if config.BrokerImpl == "redis" {
 		p, err := NewRedisPublisher(config)
@@ -114,6 +501,16 @@ func (s *Service) Start(config Config) error {
 			return err
 		} else {
 			s.pub = p
+			s.sub = p
+		}
+	} else if config.BrokerImpl == "memory" {
+		p, err := NewMemoryPublisher(config)
+		if err != nil {
+			s.log.Error().Err(err).Msg("could not configure memory publisher")
+			return err
+		} else {
+			s.pub = p
+			s.sub = p
 		}
 	} else {
 		msg := fmt.Sprintf("broker %s not supported", config.BrokerImpl)
@@ -121,6 +518,9 @@ func (s *Service) Start(config Config) error {
 		return fmt.Errorf(msg)
 	}
 
+	s.relay = newRelay(s.repo, s.pub, time.Duration(config.OutboxInterval)*time.Millisecond, s.log)
+	s.relay.start()
+
 	s.log.Info().Msg("service initialized")
 	return nil
 }
@@ -1,10 +1,26 @@
 package internal
 
 import (
+	"bytes"
+	"context"
+	"dedb"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 func TestServiceRepo(t *testing.T) {
@@ -24,11 +40,8 @@ func TestServiceRepo(t *testing.T) {
 		{
 			name: "Broker not supported",
 			config: Config{
-				RepoImpl:   "redis",
+				RepoImpl:   "memory",
 				BrokerImpl: "test",
-				RedisDbConfig: RedisDbConfig{
-					Server: "test_server",
-				},
 			},
 			err: fmt.Errorf("broker test not supported"),
 		},
@@ -47,3 +60,1087 @@ func TestServiceRepo(t *testing.T) {
 		})
 	}
 }
+
+type testSubscribeStream struct {
+	grpc.ServerStream
+	ctx       context.Context
+	requests  chan *dedb.SubscribeRequest
+	responses chan *dedb.SubscribeResponse
+}
+
+func (t *testSubscribeStream) Context() context.Context {
+	return t.ctx
+}
+
+func (t *testSubscribeStream) Send(r *dedb.SubscribeResponse) error {
+	t.responses <- r
+	return nil
+}
+
+func (t *testSubscribeStream) Recv() (*dedb.SubscribeRequest, error) {
+	select {
+	case r := <-t.requests:
+		return r, nil
+	case <-t.ctx.Done():
+		return nil, io.EOF
+	}
+}
+
+type testSubscribeFromStream struct {
+	grpc.ServerStream
+	ctx       context.Context
+	responses chan *dedb.SubscribeFromResponse
+}
+
+func (t *testSubscribeFromStream) Context() context.Context {
+	return t.ctx
+}
+
+func (t *testSubscribeFromStream) Send(r *dedb.SubscribeFromResponse) error {
+	t.responses <- r
+	return nil
+}
+
+func TestServiceSubscribe(t *testing.T) {
+	// setup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	svc := Service{}
+	err := svc.Start(Config{
+		RepoImpl:   "memory",
+		BrokerImpl: "memory",
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer svc.Shutdown()
+	pub := svc.pub.(*memoryPublisher)
+
+	stream := &testSubscribeStream{
+		ctx:       ctx,
+		requests:  make(chan *dedb.SubscribeRequest),
+		responses: make(chan *dedb.SubscribeResponse, 10),
+	}
+	done := make(chan error)
+	go func() {
+		done <- svc.Subscribe(stream)
+	}()
+
+	// when
+	stream.requests <- &dedb.SubscribeRequest{
+		ConsumerGroup: "test_group",
+		RequestType:   dedb.SubscribeRequest_CONNECT,
+		Domains:       []string{"CUSTOMER"},
+		EventNames:    []string{"CustomerCreated"},
+	}
+	assert.Eventually(t, func() bool {
+		pub.mu.Lock()
+		defer pub.mu.Unlock()
+		return len(pub.stream("CUSTOMER").groups) == 1
+	}, time.Second, 10*time.Millisecond)
+	_, err = svc.Save(ctx, &dedb.SaveRequest{
+		Events: []*dedb.Event{
+			{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "testid"},
+			{Name: "CustomerDeleted", Domain: "CUSTOMER", DomainId: "testid"},
+		},
+	})
+	assert.Nil(t, err)
+
+	// then only the subscribed event is delivered
+	var event *dedb.Event
+	select {
+	case r := <-stream.responses:
+		event = r.GetEvent()
+	case <-time.After(3 * time.Second):
+		t.Fatal("no event delivered")
+	}
+	assert.Equal(t, "CustomerCreated", event.Name)
+	assert.Equal(t, "testid", event.DomainId)
+
+	stream.requests <- &dedb.SubscribeRequest{
+		RequestType: dedb.SubscribeRequest_ACK,
+		Domain:      event.Domain,
+		Timestamp:   event.Timestamp,
+	}
+	assert.Eventually(t, func() bool {
+		pub.mu.Lock()
+		defer pub.mu.Unlock()
+		return len(pub.stream("CUSTOMER").groups["test_group"].pending) == 0
+	}, 3*time.Second, 10*time.Millisecond)
+
+	stream.requests <- &dedb.SubscribeRequest{RequestType: dedb.SubscribeRequest_DISCONNECT}
+	assert.Nil(t, <-done)
+	assert.Equal(t, 0, len(stream.responses))
+}
+
+func TestServiceSubscribeAcksEventsOfOneSave(t *testing.T) {
+	// setup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	svc := Service{}
+	err := svc.Start(Config{
+		RepoImpl:   "memory",
+		BrokerImpl: "memory",
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer svc.Shutdown()
+	pub := svc.pub.(*memoryPublisher)
+	stream := &testSubscribeStream{
+		ctx:       ctx,
+		requests:  make(chan *dedb.SubscribeRequest),
+		responses: make(chan *dedb.SubscribeResponse, 10),
+	}
+	go svc.Subscribe(stream)
+	stream.requests <- &dedb.SubscribeRequest{
+		ConsumerGroup: "test_group",
+		RequestType:   dedb.SubscribeRequest_CONNECT,
+		Domains:       []string{"CUSTOMER"},
+		EventNames:    []string{"CustomerUpdated"},
+	}
+	assert.Eventually(t, func() bool {
+		pub.mu.Lock()
+		defer pub.mu.Unlock()
+		return len(pub.stream("CUSTOMER").groups) == 1
+	}, time.Second, 10*time.Millisecond)
+	pending := func() int {
+		pub.mu.Lock()
+		defer pub.mu.Unlock()
+		return len(pub.stream("CUSTOMER").groups["test_group"].pending)
+	}
+	// events sharing a timestamp, as events of concurrent saves can
+	saved := []*dedb.Event{
+		{Id: "first", Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "testid", Timestamp: 10},
+		{Id: "second", Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "testid", Timestamp: 10},
+		{Id: "third", Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "testid", Timestamp: 10},
+	}
+	err = pub.publish(ctx, saved)
+	assert.Nil(t, err)
+	for range saved {
+		select {
+		case <-stream.responses:
+		case <-time.After(3 * time.Second):
+			t.Fatal("no event delivered")
+		}
+	}
+	assert.Eventually(t, func() bool { return pending() == 3 }, time.Second, 10*time.Millisecond)
+
+	// when the last event is acked by id
+	stream.requests <- &dedb.SubscribeRequest{RequestType: dedb.SubscribeRequest_ACK, EventId: "third"}
+
+	// then only it is acked
+	assert.Eventually(t, func() bool { return pending() == 2 }, time.Second, 10*time.Millisecond)
+
+	// and acks by domain and timestamp take the others one at a time
+	for i := 1; i >= 0; i-- {
+		stream.requests <- &dedb.SubscribeRequest{RequestType: dedb.SubscribeRequest_ACK, Domain: "CUSTOMER", Timestamp: 10}
+		assert.Eventually(t, func() bool { return pending() == i }, time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestServiceSave(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	svc := Service{}
+	err := svc.Start(Config{
+		RepoImpl:   "memory",
+		BrokerImpl: "memory",
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer svc.Shutdown()
+
+	// when
+	response, err := svc.Save(ctx, &dedb.SaveRequest{
+		Events: []*dedb.Event{
+			{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "testid"},
+			{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "testid"},
+		},
+	})
+
+	// then the assigned values are returned to the caller
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), response.Version)
+	assert.Equal(t, 2, len(response.Events))
+	for i, e := range response.Events {
+		assert.NotEqual(t, "", e.Id)
+		assert.NotEqual(t, int64(0), e.Timestamp)
+		assert.Equal(t, int64(i+1), e.Version)
+	}
+
+	// and a stale expected version is rejected
+	_, err = svc.Save(ctx, &dedb.SaveRequest{
+		Events:          []*dedb.Event{{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "testid"}},
+		ExpectedVersion: &dedb.ExpectedVersion{Kind: dedb.ExpectedVersion_EXACT, Version: 1},
+	})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	// and so is a save without events, idempotency key or not
+	_, err = svc.Save(ctx, &dedb.SaveRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = svc.Save(ctx, &dedb.SaveRequest{IdempotencyKey: "empty"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestServiceSavePayloads(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	svc := Service{}
+	err := svc.Start(Config{
+		RepoImpl:   "memory",
+		BrokerImpl: "memory",
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer svc.Shutdown()
+	valid, _ := proto.Marshal(wrapperspb.String("customer"))
+	cases := []struct {
+		name  string
+		event *dedb.Event
+		code  codes.Code
+	}{
+		{
+			name:  "Opaque data is not checked",
+			event: &dedb.Event{Data: []byte("{not json")},
+			code:  codes.OK,
+		},
+		{
+			name:  "Valid json",
+			event: &dedb.Event{ContentType: "application/json", Data: []byte(`{"name":"customer"}`)},
+			code:  codes.OK,
+		},
+		{
+			name:  "Invalid json",
+			event: &dedb.Event{ContentType: "application/json", Data: []byte("{not json")},
+			code:  codes.InvalidArgument,
+		},
+		{
+			name:  "Valid protobuf",
+			event: &dedb.Event{ContentType: "application/protobuf", Schema: "google.protobuf.StringValue", Data: valid},
+			code:  codes.OK,
+		},
+		{
+			name:  "Protobuf without a schema",
+			event: &dedb.Event{ContentType: "application/protobuf", Data: valid},
+			code:  codes.InvalidArgument,
+		},
+		{
+			name:  "Malformed protobuf",
+			event: &dedb.Event{ContentType: "application/protobuf", Schema: "acme.Customer", Data: []byte{0xff}},
+			code:  codes.InvalidArgument,
+		},
+		{
+			name:  "Known message that does not decode",
+			event: &dedb.Event{ContentType: "application/protobuf", Schema: "google.protobuf.StringValue", Data: []byte{0x0a, 0x01, 0xff}},
+			code:  codes.InvalidArgument,
+		},
+	}
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.event.Name = "CustomerCreated"
+			tc.event.Domain = "CUSTOMER"
+			tc.event.DomainId = "testid"
+			_, err := svc.Save(ctx, &dedb.SaveRequest{Events: []*dedb.Event{tc.event}})
+			assert.Equal(t, tc.code, status.Code(err))
+			if tc.code == codes.InvalidArgument {
+				details := status.Convert(err).Details()
+				assert.Equal(t, "events[0].data", details[0].(*errdetails.BadRequest).FieldViolations[0].Field)
+			}
+		})
+	}
+}
+
+func TestServiceGetDomainFromSnapshot(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	svc := Service{}
+	err := svc.Start(Config{
+		RepoImpl:   "memory",
+		BrokerImpl: "memory",
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer svc.Shutdown()
+	_, err = svc.Save(ctx, &dedb.SaveRequest{
+		Events: []*dedb.Event{
+			{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "testid"},
+			{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "testid"},
+			{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "testid"},
+		},
+	})
+	assert.Nil(t, err)
+	request := &dedb.GetDomainRequest{Domain: "CUSTOMER", DomainId: "testid", FromSnapshot: true}
+
+	// when there is no snapshot, then every event is returned
+	response, err := svc.GetDomain(ctx, request)
+	assert.Nil(t, err)
+	assert.Nil(t, response.Snapshot)
+	assert.Equal(t, 3, len(response.Events))
+
+	// when there is a snapshot, then only the events after it are returned
+	_, err = svc.SaveSnapshot(ctx, &dedb.SaveSnapshotRequest{
+		Snapshot: &dedb.Snapshot{Domain: "CUSTOMER", DomainId: "testid", Version: 2},
+	})
+	assert.Nil(t, err)
+	response, err = svc.GetDomain(ctx, request)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), response.Snapshot.Version)
+	assert.Equal(t, 1, len(response.Events))
+	assert.Equal(t, int64(3), response.Events[0].Version)
+}
+
+type testPublisher struct {
+	failures  int
+	published chan *dedb.Event
+}
+
+func (t *testPublisher) publish(ctx context.Context, events []*dedb.Event) error {
+	if t.failures > 0 {
+		t.failures--
+		return fmt.Errorf("broker unavailable")
+	}
+	for _, e := range events {
+		t.published <- e
+	}
+	return nil
+}
+
+func (t *testPublisher) shutdown() {}
+
+func TestServiceRelayRetries(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	repo, err := NewMemoryRepo(Config{})
+	if err != nil {
+		panic(err)
+	}
+	pub := &testPublisher{failures: 2, published: make(chan *dedb.Event, 10)}
+	svc := Service{repo: repo, pub: pub, schemas: newSchemaRegistry(repo)}
+	svc.relay = newRelay(repo, pub, 10*time.Millisecond, svc.log)
+	svc.relay.start()
+	defer svc.Shutdown()
+
+	// when the broker fails the first publish attempts
+	response, err := svc.Save(ctx, &dedb.SaveRequest{
+		Events: []*dedb.Event{{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "testid"}},
+	})
+	assert.Nil(t, err)
+
+	// then the event is still published once the broker is back
+	select {
+	case e := <-pub.published:
+		assert.Equal(t, response.Events[0].Id, e.Id)
+	case <-time.After(3 * time.Second):
+		t.Fatal("event was never published")
+	}
+	assert.Eventually(t, func() bool {
+		pending, _ := repo.pending(ctx, 10)
+		return len(pending) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestServiceSchemas(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	svc := Service{}
+	err := svc.Start(Config{
+		RepoImpl:   "memory",
+		BrokerImpl: "memory",
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer svc.Shutdown()
+	descriptors, _ := proto.Marshal(&descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{protodesc.ToFileDescriptorProto(wrapperspb.File_google_protobuf_wrappers_proto)},
+	})
+	_, err = svc.RegisterSchema(ctx, &dedb.RegisterSchemaRequest{Schema: &dedb.Schema{
+		Domain:     "CUSTOMER",
+		EventName:  "CustomerCreated",
+		Definition: []byte(`{"type":"object","properties":{"name":{"type":"string"}},"required":["name"]}`),
+	}})
+	assert.Nil(t, err)
+	_, err = svc.RegisterSchema(ctx, &dedb.RegisterSchemaRequest{Schema: &dedb.Schema{
+		Domain:      "CUSTOMER",
+		EventName:   "CustomerCreated",
+		Type:        dedb.Schema_PROTOBUF,
+		Definition:  descriptors,
+		MessageName: "google.protobuf.StringValue",
+	}})
+	assert.Nil(t, err)
+	valid, _ := proto.Marshal(wrapperspb.String("customer"))
+	other, _ := proto.Marshal(wrapperspb.Int64(42))
+	cases := []struct {
+		name  string
+		event *dedb.Event
+		code  codes.Code
+	}{
+		{
+			name:  "Latest schema is used",
+			event: &dedb.Event{Name: "CustomerCreated", Data: valid},
+			code:  codes.OK,
+		},
+		{
+			name:  "Latest schema rejects other messages",
+			event: &dedb.Event{Name: "CustomerCreated", Data: other},
+			code:  codes.InvalidArgument,
+		},
+		{
+			name:  "Earlier version is used when asked for",
+			event: &dedb.Event{Name: "CustomerCreated", SchemaVersion: 1, Data: []byte(`{"name":"customer"}`)},
+			code:  codes.OK,
+		},
+		{
+			name:  "Earlier version rejects data missing required fields",
+			event: &dedb.Event{Name: "CustomerCreated", SchemaVersion: 1, Data: []byte(`{"age":42}`)},
+			code:  codes.InvalidArgument,
+		},
+		{
+			name:  "Content type of another version",
+			event: &dedb.Event{Name: "CustomerCreated", SchemaVersion: 1, ContentType: "application/protobuf", Schema: "google.protobuf.StringValue", Data: valid},
+			code:  codes.InvalidArgument,
+		},
+		{
+			name:  "Unknown version",
+			event: &dedb.Event{Name: "CustomerCreated", SchemaVersion: 3, Data: valid},
+			code:  codes.InvalidArgument,
+		},
+		{
+			name:  "Events without a schema are not checked",
+			event: &dedb.Event{Name: "CustomerDeleted", Data: []byte("anything")},
+			code:  codes.OK,
+		},
+	}
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.event.Domain = "CUSTOMER"
+			tc.event.DomainId = "testid"
+			response, err := svc.Save(ctx, &dedb.SaveRequest{Events: []*dedb.Event{tc.event}})
+			assert.Equal(t, tc.code, status.Code(err))
+			if tc.code == codes.OK && tc.event.Name == "CustomerCreated" {
+				assert.NotZero(t, response.Events[0].SchemaVersion)
+				assert.NotEmpty(t, response.Events[0].ContentType)
+			}
+		})
+	}
+
+	t.Run("Schemas are listed and fetched", func(t *testing.T) {
+		list, err := svc.ListSchemas(ctx, &dedb.ListSchemasRequest{Domain: "CUSTOMER"})
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(list.Schemas))
+		latest, err := svc.GetSchema(ctx, &dedb.GetSchemaRequest{Domain: "CUSTOMER", EventName: "CustomerCreated"})
+		assert.Nil(t, err)
+		assert.Equal(t, int32(2), latest.Schema.Version)
+		_, err = svc.GetSchema(ctx, &dedb.GetSchemaRequest{Domain: "CUSTOMER", EventName: "CustomerDeleted"})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+
+	t.Run("Invalid definitions are rejected", func(t *testing.T) {
+		_, err := svc.RegisterSchema(ctx, &dedb.RegisterSchemaRequest{Schema: &dedb.Schema{
+			Domain:     "CUSTOMER",
+			EventName:  "CustomerUpdated",
+			Definition: []byte(`{"$ref":"https://example.com/customer.json"}`),
+		}})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
+// countingRepo counts the schema lookups that reach the repository
+type countingRepo struct {
+	repository
+	lookups int
+}
+
+func (r *countingRepo) getSchema(ctx context.Context, domain string, eventName string, version int32) (*dedb.Schema, error) {
+	r.lookups++
+	return r.repository.getSchema(ctx, domain, eventName, version)
+}
+
+func TestServiceSchemaLookupsAreCached(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	memory, _ := NewMemoryRepo(Config{})
+	repo := &countingRepo{repository: memory}
+	registry := newSchemaRegistry(repo)
+	_, err := registry.register(ctx, &dedb.Schema{Domain: "CUSTOMER", EventName: "CustomerCreated", Definition: []byte(`{"required":["name"]}`)})
+	assert.Nil(t, err)
+	event := func(data string) []*dedb.Event {
+		return []*dedb.Event{{Name: "CustomerCreated", Domain: "CUSTOMER", Data: []byte(data)}}
+	}
+
+	// when saves validate against the latest schema, or an event has none
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, registry.validate(ctx, event(`{"name":"customer"}`)))
+		assert.Nil(t, registry.validate(ctx, []*dedb.Event{{Name: "CustomerDeleted", Domain: "CUSTOMER"}}))
+	}
+
+	// then the repository is asked once for each
+	assert.Equal(t, 2, repo.lookups)
+
+	// and registering a version is seen by the next save
+	_, err = registry.register(ctx, &dedb.Schema{Domain: "CUSTOMER", EventName: "CustomerCreated", Definition: []byte(`{"required":["fullName"]}`)})
+	assert.Nil(t, err)
+	assert.Equal(t, codes.InvalidArgument, status.Code(registry.validate(ctx, event(`{"name":"customer"}`))))
+	assert.Nil(t, registry.validate(ctx, event(`{"fullName":"customer"}`)))
+	assert.Equal(t, 3, repo.lookups)
+}
+
+func TestServiceUpcasting(t *testing.T) {
+	// setup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	svc := Service{}
+	err := svc.Start(Config{
+		RepoImpl:   "memory",
+		BrokerImpl: "memory",
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer svc.Shutdown()
+	pub := svc.pub.(*memoryPublisher)
+	for _, definition := range []string{`{"required":["name"]}`, `{"required":["fullName"]}`} {
+		_, err = svc.RegisterSchema(ctx, &dedb.RegisterSchemaRequest{Schema: &dedb.Schema{
+			Domain:     "CUSTOMER",
+			EventName:  "CustomerCreated",
+			Definition: []byte(definition),
+		}})
+		assert.Nil(t, err)
+	}
+	_, err = svc.Save(ctx, &dedb.SaveRequest{Events: []*dedb.Event{
+		{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "old", SchemaVersion: 1, Data: []byte(`{"name":"customer"}`)},
+	}})
+	assert.Nil(t, err)
+
+	// when
+	svc.RegisterUpcaster("CUSTOMER", "CustomerCreated", 1, UpcasterFunc(func(e *dedb.Event) (*dedb.Event, error) {
+		e.Data = bytes.Replace(e.Data, []byte(`"name"`), []byte(`"fullName"`), 1)
+		return e, nil
+	}))
+	svc.RegisterUpcaster("CUSTOMER", "CustomerCreated", 2, UpcasterFunc(func(e *dedb.Event) (*dedb.Event, error) {
+		e.Data = bytes.Replace(e.Data, []byte(`}`), []byte(`,"active":true}`), 1)
+		return e, nil
+	}))
+
+	// then reads see the latest shape
+	response, err := svc.GetDomain(ctx, &dedb.GetDomainRequest{Domain: "CUSTOMER", DomainId: "old"})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), response.Events[0].SchemaVersion)
+	assert.Equal(t, `{"fullName":"customer","active":true}`, string(response.Events[0].Data))
+	stored, _ := svc.repo.getDomain(ctx, "CUSTOMER", "old", 0, 0)
+	assert.Equal(t, `{"name":"customer"}`, string(stored[0].Data))
+
+	// and so do subscribers
+	stream := &testSubscribeStream{
+		ctx:       ctx,
+		requests:  make(chan *dedb.SubscribeRequest),
+		responses: make(chan *dedb.SubscribeResponse, 10),
+	}
+	go svc.Subscribe(stream)
+	stream.requests <- &dedb.SubscribeRequest{
+		ConsumerGroup: "test_group",
+		RequestType:   dedb.SubscribeRequest_CONNECT,
+		Domains:       []string{"CUSTOMER"},
+		EventNames:    []string{"CustomerCreated"},
+	}
+	assert.Eventually(t, func() bool {
+		pub.mu.Lock()
+		defer pub.mu.Unlock()
+		return len(pub.stream("CUSTOMER").groups) == 1
+	}, time.Second, 10*time.Millisecond)
+	_, err = svc.Save(ctx, &dedb.SaveRequest{Events: []*dedb.Event{
+		{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "new", Data: []byte(`{"fullName":"customer"}`)},
+	}})
+	assert.Nil(t, err)
+	select {
+	case r := <-stream.responses:
+		assert.Equal(t, int32(3), r.GetEvent().SchemaVersion)
+		assert.Equal(t, `{"fullName":"customer","active":true}`, string(r.GetEvent().Data))
+	case <-time.After(3 * time.Second):
+		t.Fatal("no event delivered")
+	}
+
+	// and a failing upcaster fails the read
+	svc.RegisterUpcaster("CUSTOMER", "CustomerCreated", 2, UpcasterFunc(func(e *dedb.Event) (*dedb.Event, error) {
+		return nil, fmt.Errorf("broken")
+	}))
+	_, err = svc.GetDomain(ctx, &dedb.GetDomainRequest{Domain: "CUSTOMER", DomainId: "old"})
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
+
+func TestServiceUpcastersFile(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "upcasters.json")
+	err := os.WriteFile(file, []byte(`{"upcasters": [
+		{"domain": "CUSTOMER", "event_name": "CustomerCreated", "version": 1, "rename_fields": {"name": "fullName"}, "remove_fields": ["legacy"]},
+		{"domain": "CUSTOMER", "event_name": "CustomerCreated", "version": 2, "default_fields": {"active": true, "fullName": "unknown"}}
+	]}`), 0600)
+	assert.Nil(t, err)
+	svc := Service{}
+	err = svc.Start(Config{RepoImpl: "memory", BrokerImpl: "memory", UpcastersFile: file})
+	if err != nil {
+		panic(err)
+	}
+	defer svc.Shutdown()
+	for i := 0; i < 3; i++ {
+		_, err = svc.RegisterSchema(ctx, &dedb.RegisterSchemaRequest{Schema: &dedb.Schema{Domain: "CUSTOMER", EventName: "CustomerCreated", Definition: []byte(`{}`)}})
+		assert.Nil(t, err)
+	}
+	_, err = svc.Save(ctx, &dedb.SaveRequest{Events: []*dedb.Event{
+		{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "old", SchemaVersion: 1, Data: []byte(`{"name":"customer","legacy":1}`)},
+		{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "old", SchemaVersion: 2, Data: []byte(`{}`)},
+		{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "old", SchemaVersion: 2, Data: []byte(`[]`)},
+	}})
+	assert.Nil(t, err)
+
+	// when
+	response, err := svc.GetDomain(ctx, &dedb.GetDomainRequest{Domain: "CUSTOMER", DomainId: "old", Limit: 2})
+
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), response.Events[0].SchemaVersion)
+	assert.Equal(t, `{"active":true,"fullName":"customer"}`, string(response.Events[0].Data))
+	assert.Equal(t, `{"active":true,"fullName":"unknown"}`, string(response.Events[1].Data))
+	_, err = svc.GetDomain(ctx, &dedb.GetDomainRequest{Domain: "CUSTOMER", DomainId: "old"})
+	assert.Equal(t, codes.Internal, status.Code(err))
+
+	t.Run("A bad file fails the start before the repo is opened", func(t *testing.T) {
+		for _, content := range []string{`{"upcasters": [{"domain": "CUSTOMER", "event_name": "CustomerCreated"}]}`, `not json`} {
+			assert.Nil(t, os.WriteFile(file, []byte(content), 0600))
+			failed := &Service{}
+			err := failed.Start(Config{RepoImpl: "memory", BrokerImpl: "memory", UpcastersFile: file})
+			assert.NotNil(t, err)
+			assert.Nil(t, failed.repo)
+		}
+	})
+}
+
+func TestServiceReadAll(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	svc := Service{}
+	err := svc.Start(Config{
+		RepoImpl:   "memory",
+		BrokerImpl: "memory",
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer svc.Shutdown()
+	for _, e := range []*dedb.Event{
+		{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "one"},
+		{Name: "OrderPlaced", Domain: "ORDER", DomainId: "two"},
+		{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "three"},
+		{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "one"},
+	} {
+		_, err = svc.Save(ctx, &dedb.SaveRequest{Events: []*dedb.Event{e}})
+		assert.Nil(t, err)
+	}
+	cases := []struct {
+		name      string
+		request   *dedb.ReadAllRequest
+		positions []int64
+		next      int64
+	}{
+		{
+			name:      "Everything",
+			request:   &dedb.ReadAllRequest{},
+			positions: []int64{1, 2, 3, 4},
+			next:      4,
+		},
+		{
+			name:      "A page",
+			request:   &dedb.ReadAllRequest{FromPosition: 1, Limit: 2},
+			positions: []int64{2, 3},
+			next:      3,
+		},
+		{
+			name:      "One domain",
+			request:   &dedb.ReadAllRequest{Domain: "CUSTOMER"},
+			positions: []int64{1, 3, 4},
+			next:      4,
+		},
+		{
+			name:      "Event names",
+			request:   &dedb.ReadAllRequest{EventNames: []string{"CustomerUpdated", "OrderPlaced"}},
+			positions: []int64{2, 4},
+			next:      4,
+		},
+		{
+			name:      "Past the end",
+			request:   &dedb.ReadAllRequest{FromPosition: 4},
+			positions: []int64{},
+			next:      4,
+		},
+	}
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			response, err := svc.ReadAll(ctx, tc.request)
+			assert.Nil(t, err)
+			positions := []int64{}
+			for _, e := range response.Events {
+				positions = append(positions, e.Position)
+			}
+			assert.Equal(t, tc.positions, positions)
+			assert.Equal(t, tc.next, response.NextPosition)
+		})
+	}
+}
+
+func TestServiceSubscribeFrom(t *testing.T) {
+	// setup
+	svc := Service{}
+	err := svc.Start(Config{
+		RepoImpl:       "memory",
+		BrokerImpl:     "memory",
+		OutboxInterval: 10,
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer svc.Shutdown()
+	pub := svc.pub.(*memoryPublisher)
+	save := func(domain string, count int) {
+		for i := 0; i < count; i++ {
+			_, err := svc.Save(context.Background(), &dedb.SaveRequest{
+				Events: []*dedb.Event{{Name: "Updated", Domain: domain, DomainId: fmt.Sprintf("id%d", i%3)}},
+			})
+			assert.Nil(t, err)
+		}
+	}
+	save("CUSTOMER", 2)
+	save("ORDER", 2)
+	cases := []struct {
+		name    string
+		request *dedb.SubscribeFromRequest
+		live    int // events saved once subscribed that are sent
+	}{
+		{
+			name:    "Every domain",
+			request: &dedb.SubscribeFromRequest{FromPosition: 1},
+			live:    20,
+		},
+		{
+			name:    "One domain",
+			request: &dedb.SubscribeFromRequest{Domain: "CUSTOMER"},
+			live:    10,
+		},
+	}
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			stored, _, _ := svc.repo.readAll(ctx, tc.request.FromPosition, 0, newEventFilter(tc.request.Domain, nil))
+			expected := len(stored) + tc.live
+			stream := &testSubscribeFromStream{ctx: ctx, responses: make(chan *dedb.SubscribeFromResponse, 100)}
+			done := make(chan error)
+			go func() {
+				done <- svc.SubscribeFrom(tc.request, stream)
+			}()
+
+			// events saved while the stored ones are sent are not missed or sent twice
+			var saving sync.WaitGroup
+			saving.Add(2)
+			go func() {
+				defer saving.Done()
+				save("CUSTOMER", 10)
+			}()
+			go func() {
+				defer saving.Done()
+				save("ORDER", 10)
+			}()
+			last := tc.request.FromPosition
+			received := 0
+			caughtUp := 0
+			for received < expected || caughtUp == 0 {
+				select {
+				case r := <-stream.responses:
+					if r.GetCaughtUp() {
+						caughtUp++
+						continue
+					}
+					e := r.GetEvent()
+					if tc.request.Domain == "" {
+						assert.Equal(t, last+1, e.Position)
+					} else {
+						assert.Equal(t, tc.request.Domain, e.Domain)
+						assert.Greater(t, e.Position, last)
+					}
+					last = e.Position
+					received++
+				case <-time.After(5 * time.Second):
+					t.Fatalf("only %d events delivered", received)
+				}
+			}
+			saving.Wait()
+			time.Sleep(50 * time.Millisecond)
+			assert.Equal(t, 1, caughtUp)
+			assert.Equal(t, 0, len(stream.responses))
+
+			cancel()
+			assert.Nil(t, <-done)
+			pub.mu.Lock()
+			defer pub.mu.Unlock()
+			assert.Equal(t, 0, len(pub.stream(allDomains).groups))
+			assert.Equal(t, 0, len(pub.stream("CUSTOMER").groups))
+		})
+	}
+}
+
+func TestServiceGetDomainByTimeRange(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	svc := Service{}
+	err := svc.Start(Config{
+		RepoImpl:   "memory",
+		BrokerImpl: "memory",
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer svc.Shutdown()
+	saved, err := svc.Save(ctx, &dedb.SaveRequest{Events: []*dedb.Event{
+		{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "testid"},
+		{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "testid"},
+	}})
+	assert.Nil(t, err)
+	cases := []struct {
+		name    string
+		request *dedb.GetDomainByTimeRangeRequest
+		code    codes.Code
+		count   int
+	}{
+		{
+			name:    "As of the first event",
+			request: &dedb.GetDomainByTimeRangeRequest{ToTimestamp: saved.Events[0].Timestamp},
+			code:    codes.OK,
+			count:   1,
+		},
+		{
+			name:    "Open range",
+			request: &dedb.GetDomainByTimeRangeRequest{FromTimestamp: saved.Events[0].Timestamp},
+			code:    codes.OK,
+			count:   2,
+		},
+		{
+			name:    "Range ending before it starts",
+			request: &dedb.GetDomainByTimeRangeRequest{FromTimestamp: 10, ToTimestamp: 5},
+			code:    codes.InvalidArgument,
+		},
+		{
+			name:    "Negative limit",
+			request: &dedb.GetDomainByTimeRangeRequest{Limit: -1},
+			code:    codes.InvalidArgument,
+		},
+	}
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.request.Domain = "CUSTOMER"
+			tc.request.DomainId = "testid"
+			response, err := svc.GetDomainByTimeRange(ctx, tc.request)
+			assert.Equal(t, tc.code, status.Code(err))
+			if tc.code == codes.OK {
+				assert.Equal(t, tc.count, len(response.Events))
+			}
+		})
+	}
+}
+
+func TestServiceGetDomainBackward(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	svc := Service{}
+	err := svc.Start(Config{
+		RepoImpl:   "memory",
+		BrokerImpl: "memory",
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer svc.Shutdown()
+	for i := 0; i < 5; i++ {
+		_, err = svc.Save(ctx, &dedb.SaveRequest{Events: []*dedb.Event{{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "testid"}}})
+		assert.Nil(t, err)
+	}
+
+	// when paging backward from the latest event
+	versions := []int64{}
+	offset := int64(0)
+	for {
+		response, err := svc.GetDomain(ctx, &dedb.GetDomainRequest{
+			Domain:    "CUSTOMER",
+			DomainId:  "testid",
+			Offset:    offset,
+			Limit:     2,
+			Direction: dedb.Direction_BACKWARD,
+		})
+		assert.Nil(t, err)
+		if len(response.Events) == 0 {
+			break
+		}
+		for _, e := range response.Events {
+			versions = append(versions, e.Version)
+		}
+		offset = response.Events[len(response.Events)-1].Version
+	}
+
+	// then every event is read, newest first
+	assert.Equal(t, []int64{5, 4, 3, 2, 1}, versions)
+	_, err = svc.GetDomain(ctx, &dedb.GetDomainRequest{
+		Domain:       "CUSTOMER",
+		DomainId:     "testid",
+		FromSnapshot: true,
+		Direction:    dedb.Direction_BACKWARD,
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestServiceAuthorization(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	policyFile := filepath.Join(t.TempDir(), "policy.json")
+	err := os.WriteFile(policyFile, []byte(`{"rules": [
+		{"principal": "orders", "domains": ["ORDER"], "event_names": ["Order*"], "operations": ["save", "read"]},
+		{"principal": "billing", "domains": ["ORDER", "INVOICE"], "operations": ["read", "subscribe"], "consumer_groups": ["billing-*"]},
+		{"principal": "*", "domains": ["PUBLIC"], "operations": ["read"]}
+	]}`), 0600)
+	assert.Nil(t, err)
+	svc := Service{}
+	err = svc.Start(Config{
+		RepoImpl:     "memory",
+		BrokerImpl:   "memory",
+		ServerConfig: ServerConfig{PolicyFile: policyFile},
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer svc.Shutdown()
+	as := func(name string) context.Context {
+		return withPrincipal(ctx, &Principal{Name: name})
+	}
+	save := func(ctx context.Context, domain string, name string) error {
+		_, err := svc.Save(ctx, &dedb.SaveRequest{Events: []*dedb.Event{{Name: name, Domain: domain, DomainId: "authzid"}}})
+		return err
+	}
+	subscribe := func(ctx context.Context, group string, domains ...string) error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		stream := &testSubscribeStream{
+			ctx:       ctx,
+			requests:  make(chan *dedb.SubscribeRequest, 1),
+			responses: make(chan *dedb.SubscribeResponse, 10),
+		}
+		stream.requests <- &dedb.SubscribeRequest{ConsumerGroup: group, RequestType: dedb.SubscribeRequest_CONNECT, Domains: domains, EventNames: []string{"OrderPlaced"}}
+		done := make(chan error, 1)
+		go func() {
+			done <- svc.Subscribe(stream)
+		}()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(200 * time.Millisecond):
+			return nil
+		}
+	}
+	cases := []struct {
+		name string
+		call func() error
+		code codes.Code
+	}{
+		{name: "Save an allowed event", call: func() error { return save(as("orders"), "ORDER", "OrderPlaced") }},
+		{name: "Save another event name", call: func() error { return save(as("orders"), "ORDER", "InvoiceSent") }, code: codes.PermissionDenied},
+		{name: "Save to a read only domain", call: func() error { return save(as("billing"), "ORDER", "OrderPlaced") }, code: codes.PermissionDenied},
+		{name: "Save unauthenticated", call: func() error { return save(ctx, "ORDER", "OrderPlaced") }, code: codes.PermissionDenied},
+		{name: "Read a domain", call: func() error {
+			_, err := svc.GetDomain(as("billing"), &dedb.GetDomainRequest{Domain: "ORDER", DomainId: "authzid"})
+			return err
+		}},
+		{name: "Read another domain", call: func() error {
+			_, err := svc.GetDomain(as("orders"), &dedb.GetDomainRequest{Domain: "INVOICE", DomainId: "authzid"})
+			return err
+		}, code: codes.PermissionDenied},
+		{name: "Read the domain ids of a domain open to all", call: func() error {
+			_, err := svc.GetDomainIds(as("anyone"), &dedb.GetDomainIdsRequest{Domain: "PUBLIC"})
+			return err
+		}},
+		{name: "Read the domain ids of another domain", call: func() error {
+			_, err := svc.GetDomainIds(as("anyone"), &dedb.GetDomainIdsRequest{Domain: "ORDER"})
+			return err
+		}, code: codes.PermissionDenied},
+		{name: "Read every domain", call: func() error {
+			_, err := svc.ReadAll(as("billing"), &dedb.ReadAllRequest{})
+			return err
+		}, code: codes.PermissionDenied},
+		{name: "Register a schema of an allowed event", call: func() error {
+			_, err := svc.RegisterSchema(as("orders"), &dedb.RegisterSchemaRequest{Schema: &dedb.Schema{Domain: "ORDER", EventName: "OrderPlaced", Definition: []byte(`{"type": "object"}`)}})
+			return err
+		}},
+		{name: "Register a schema of another event name", call: func() error {
+			_, err := svc.RegisterSchema(as("orders"), &dedb.RegisterSchemaRequest{Schema: &dedb.Schema{Domain: "ORDER", EventName: "InvoiceSent", Definition: []byte(`{"type": "object"}`)}})
+			return err
+		}, code: codes.PermissionDenied},
+		{name: "Register a schema of a read only domain", call: func() error {
+			_, err := svc.RegisterSchema(as("billing"), &dedb.RegisterSchemaRequest{Schema: &dedb.Schema{Domain: "ORDER", EventName: "OrderPlaced", Definition: []byte(`{"type": "object"}`)}})
+			return err
+		}, code: codes.PermissionDenied},
+		{name: "Get a schema of a read domain", call: func() error {
+			_, err := svc.GetSchema(as("billing"), &dedb.GetSchemaRequest{Domain: "ORDER", EventName: "OrderPlaced"})
+			return err
+		}},
+		{name: "Get a schema of another domain", call: func() error {
+			_, err := svc.GetSchema(as("anyone"), &dedb.GetSchemaRequest{Domain: "ORDER", EventName: "OrderPlaced"})
+			return err
+		}, code: codes.PermissionDenied},
+		{name: "List the schemas of a read domain", call: func() error {
+			_, err := svc.ListSchemas(as("billing"), &dedb.ListSchemasRequest{Domain: "INVOICE"})
+			return err
+		}},
+		{name: "List the schemas of every domain", call: func() error {
+			_, err := svc.ListSchemas(as("billing"), &dedb.ListSchemasRequest{})
+			return err
+		}, code: codes.PermissionDenied},
+		{name: "Subscribe as an allowed consumer group", call: func() error { return subscribe(as("billing"), "billing-orders", "ORDER") }},
+		{name: "Subscribe as another consumer group", call: func() error { return subscribe(as("billing"), "shipping", "ORDER") }, code: codes.PermissionDenied},
+		{name: "Subscribe to another domain", call: func() error { return subscribe(as("billing"), "billing-orders", "ORDER", "CUSTOMER") }, code: codes.PermissionDenied},
+		{name: "Subscribe without the operation", call: func() error { return subscribe(as("orders"), "orders", "ORDER") }, code: codes.PermissionDenied},
+	}
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.code, status.Code(tc.call()))
+		})
+	}
+
+	t.Run("Policy changes are picked up", func(t *testing.T) {
+		err := os.WriteFile(policyFile, []byte(`{"rules": [{"principal": "orders", "domains": ["ORDER", "INVOICE"]}]}`), 0600)
+		assert.Nil(t, err)
+		later := time.Now().Add(time.Minute)
+		assert.Nil(t, os.Chtimes(policyFile, later, later))
+		assert.Eventually(t, func() bool {
+			return save(as("orders"), "INVOICE", "InvoiceSent") == nil
+		}, 3*time.Second, 100*time.Millisecond)
+
+		// and a broken file keeps the rules loaded before it
+		assert.Nil(t, os.WriteFile(policyFile, []byte(`{"rules": [`), 0600))
+		later = later.Add(time.Minute)
+		assert.Nil(t, os.Chtimes(policyFile, later, later))
+		time.Sleep(1100 * time.Millisecond)
+		assert.Nil(t, save(as("orders"), "INVOICE", "InvoiceSent"))
+		assert.Equal(t, codes.PermissionDenied, status.Code(save(as("billing"), "INVOICE", "InvoiceSent")))
+	})
+}
@@ -2,12 +2,17 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/libsql/go-libsql"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 
 	"dedb"
 )
@@ -18,41 +23,290 @@ type sqliteRepo struct {
 	config Config
 }
 
-func (s *sqliteRepo) save(ctx context.Context, events []*dedb.Event) error {
+type snapshotRow struct {
+	Domain    string `db:"domain"`
+	DomainId  string `db:"domain_id"`
+	Version   int64  `db:"version"`
+	Timestamp int64  `db:"timestamp"`
+	Metadata  string `db:"metadata"`
+	Data      []byte `db:"data"`
+}
+
+type schemaRow struct {
+	Domain      string `db:"domain"`
+	EventName   string `db:"event_name"`
+	Version     int32  `db:"version"`
+	Type        int32  `db:"type"`
+	Definition  []byte `db:"definition"`
+	MessageName string `db:"message_name"`
+	Timestamp   int64  `db:"timestamp"`
+}
+
+func (r schemaRow) schema() *dedb.Schema {
+	return &dedb.Schema{
+		Domain:      r.Domain,
+		EventName:   r.EventName,
+		Version:     r.Version,
+		Type:        dedb.Schema_Type(r.Type),
+		Definition:  r.Definition,
+		MessageName: r.MessageName,
+		Timestamp:   r.Timestamp,
+	}
+}
+
+func schemaRows(rows []schemaRow) []*dedb.Schema {
+	schemas := make([]*dedb.Schema, 0, len(rows))
+	for _, row := range rows {
+		schemas = append(schemas, row.schema())
+	}
+	return schemas
+}
+
+func (s *sqliteRepo) save(ctx context.Context, events []*dedb.Event, expected *dedb.ExpectedVersion, key saveKey) ([]*dedb.Event, error) {
 	log := s.log.With().Str("op", "save").Logger()
 	if len(events) == 0 {
-		return fmt.Errorf("no events were supplied to save")
+		return nil, fmt.Errorf("no events were supplied to save")
 	}
 	log.Info().Msgf("saving %d events", len(events))
-	// timestamp := time.Now().UnixMicro()
-	sql := `
-    INSERT INTO domain_events (id, domain, domain_id, name, timestamp, trace_id, data)
-    VALUES(?, ?, ?, ?, ?, ?, ?);
-    `
-	for _, event := range events {
-		_, err := s.db.Exec(sql, event.Id, event.Domain, event.DomainId, event.Name, event.Timestamp, string(event.Data))
+	saved := events
+	err := s.transact(ctx, func(conn *sqlx.Conn) error {
+		// a retry of a save that already went through gets the original result back
+		if key.key != "" {
+			now := time.Now().UnixMicro()
+			_, err := conn.ExecContext(ctx, "DELETE FROM idempotency WHERE expires <= ?", now)
+			if err != nil {
+				log.Error().Err(err).Msgf("could not remove expired idempotency keys")
+				return err
+			}
+			original := []idempotencyRow{}
+			err = conn.SelectContext(ctx, &original, "SELECT request_hash, response FROM idempotency WHERE key = ?", key.key)
+			if err != nil {
+				log.Error().Err(err).Msgf("could not check for a previous save")
+				return err
+			}
+			if len(original) > 0 {
+				if original[0].RequestHash != key.hash {
+					return keyReused()
+				}
+				response := &dedb.SaveResponse{}
+				err = Decode(response, original[0].Response)
+				if err != nil {
+					log.Error().Err(err).Msgf("could not decode previous save")
+					return err
+				}
+				log.Debug().Msgf("save already done for idempotency key %s", key.key)
+				saved = response.Events
+				return nil
+			}
+		}
+
+		// versions are per domain and domain id and positions are global, both read while holding
+		// the write lock so concurrent writers can not interleave
+		versions := make(map[string]int64)
+		for _, event := range events {
+			stream := memoryKey(event.Domain, event.DomainId)
+			if _, ok := versions[stream]; ok {
+				continue
+			}
+			var current int64
+			err := conn.GetContext(ctx, &current, "SELECT COALESCE(MAX(version), 0) FROM domain_events WHERE domain = ? AND domain_id = ?", event.Domain, event.DomainId)
+			if err != nil {
+				log.Error().Err(err).Msgf("could not get current version of %s", event.DomainId)
+				return err
+			}
+			versions[stream] = current
+		}
+		err := checkExpectedVersion(events[0].DomainId, expected, versions[memoryKey(events[0].Domain, events[0].DomainId)])
 		if err != nil {
-			s.log.Error().Err(err).Msgf("could not save event %s", event.Id)
-			return fmt.Errorf("Could not save event in dedb")
+			return err
 		}
-		_, err = s.db.Exec("INSERT INTO domains (id, domain) VALUES (?,?)", event.DomainId, event.Domain)
+		var position int64
+		err = conn.GetContext(ctx, &position, "SELECT COALESCE(MAX(position), 0) FROM domain_events")
 		if err != nil {
-			s.log.Error().Err(err).Msgf("could not save event %s", event.Id)
-			return fmt.Errorf("Could not save event in dedb")
+			log.Error().Err(err).Msgf("could not get current position")
+			return err
+		}
+
+		sql := `
+        INSERT INTO domain_events (id, domain, domain_id, name, timestamp, trace_id, stream_id, metadata, content_type, schema, data, version, position)
+        VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+        `
+		timestamp := time.Now().UnixMicro()
+		for _, event := range events {
+			// give each event an id and a timestamp
+			timestamp++
+			if event.Id == "" {
+				id, _ := generateId()
+				event.Id = id.String()
+			}
+			event.Timestamp = timestamp
+			stream := memoryKey(event.Domain, event.DomainId)
+			versions[stream]++
+			event.Version = versions[stream]
+			position++
+			event.Position = position
+
+			md, err := encodeMetadata(event.Metadata)
+			if err != nil {
+				log.Error().Err(err).Msgf("could not encode metadata of event %s", event.Id)
+				return err
+			}
+			_, err = conn.ExecContext(ctx, sql, event.Id, event.Domain, event.DomainId, event.Name, event.Timestamp, event.TraceId, event.StreamId, md, event.ContentType, event.Schema, event.Data, event.Version, event.Position)
+			if err != nil {
+				log.Error().Err(err).Msgf("could not save event %s", event.Id)
+				return err
+			}
+			_, err = conn.ExecContext(ctx, "INSERT OR IGNORE INTO domains (domain, domain_id, timestamp) VALUES (?, ?, ?)", event.Domain, event.DomainId, event.Timestamp)
+			if err != nil {
+				log.Error().Err(err).Msgf("could not save domain id %s", event.DomainId)
+				return err
+			}
+			encoded, err := Encode(event)
+			if err != nil {
+				log.Error().Err(err).Msgf("could not encode event %s", event.Id)
+				return err
+			}
+			_, err = conn.ExecContext(ctx, "INSERT INTO outbox (position, event) VALUES (?, ?)", event.Position, encoded)
+			if err != nil {
+				log.Error().Err(err).Msgf("could not add event %s to the outbox", event.Id)
+				return err
+			}
 		}
+		if key.key != "" {
+			encoded, err := Encode(&dedb.SaveResponse{Events: events})
+			if err != nil {
+				log.Error().Err(err).Msgf("could not encode save result")
+				return err
+			}
+			expires := time.Now().Add(dedupWindow(s.config)).UnixMicro()
+			_, err = conn.ExecContext(ctx, "INSERT INTO idempotency (key, request_hash, response, expires) VALUES (?, ?, ?, ?)", key.key, key.hash, encoded, expires)
+			if err != nil {
+				log.Error().Err(err).Msgf("could not save idempotency key %s", key.key)
+				return err
+			}
+		}
+		return nil
+	})
+	if _, ok := status.FromError(err); !ok {
+		return nil, fmt.Errorf("Could not save event in dedb")
 	}
-	return nil
+	if err != nil {
+		return nil, err
+	}
+	return saved, nil
 }
 
 func (s *sqliteRepo) getDomain(ctx context.Context, domain string, domainId string, offset int64, limit int64) ([]*dedb.Event, error) {
 	log := s.log.With().Str("op", "getDomain").Logger()
 	log.Info().Msgf("getting domain %s, id %s, offset %d, limit %d", domain, domainId, offset, limit)
-	sql := "SELECT id, domain, domain_id, name, timestamp, trace_id, data FROM domain_events WHERE domain_id = ? ORDER BY timestamp ASC LIMIT ?, ?"
-	events := []*dedb.Event{}
-	err := s.db.Select(&events, sql, domainId, limit, offset)
+	sql := `
+    SELECT id, domain, domain_id, name, timestamp, trace_id, stream_id, metadata, content_type, schema, data, version, position
+    FROM domain_events
+    WHERE domain = ? AND domain_id = ? AND version > ?
+    ORDER BY version ASC
+    LIMIT ?
+    `
+	rows := []eventRow{}
+	err := s.db.SelectContext(ctx, &rows, sql, domain, domainId, offset, sqliteLimit(limit))
+	if err != nil {
+		log.Error().Err(err).Msgf("could not query domain events for domain %s, id %s", domain, domainId)
+		return nil, err
+	}
+	return s.toEvents(rows)
+}
+
+func (s *sqliteRepo) getDomainBackward(ctx context.Context, domain string, domainId string, before int64, limit int64) ([]*dedb.Event, error) {
+	log := s.log.With().Str("op", "getDomainBackward").Logger()
+	log.Debug().Msgf("getting domain %s, id %s backward, before %d, limit %d", domain, domainId, before, limit)
+	sql := `
+    SELECT id, domain, domain_id, name, timestamp, trace_id, stream_id, metadata, content_type, schema, data, version, position
+    FROM domain_events
+    WHERE domain = ? AND domain_id = ? AND (? = 0 OR version < ?)
+    ORDER BY version DESC
+    LIMIT ?
+    `
+	rows := []eventRow{}
+	err := s.db.SelectContext(ctx, &rows, sql, domain, domainId, before, before, sqliteLimit(limit))
+	if err != nil {
+		log.Error().Err(err).Msgf("could not query domain events for domain %s, id %s", domain, domainId)
+		return nil, err
+	}
+	return s.toEvents(rows)
+}
+
+func (s *sqliteRepo) getDomainByTimeRange(ctx context.Context, domain string, domainId string, from int64, to int64, limit int64, direction dedb.Direction) ([]*dedb.Event, error) {
+	log := s.log.With().Str("op", "getDomainByTimeRange").Logger()
+	log.Debug().Msgf("getting domain %s, id %s, from %d to %d, limit %d", domain, domainId, from, to, limit)
+	sql := `
+    SELECT id, domain, domain_id, name, timestamp, trace_id, stream_id, metadata, content_type, schema, data, version, position
+    FROM domain_events
+    WHERE domain = ? AND domain_id = ? AND timestamp >= ? AND timestamp <= ?
+    ORDER BY version ` + sqlOrder(direction) + `
+    LIMIT ?
+    `
+	rows := []eventRow{}
+	err := s.db.SelectContext(ctx, &rows, sql, domain, domainId, from, timeRangeEnd(to), sqliteLimit(limit))
+	if err != nil {
+		log.Error().Err(err).Msgf("could not query domain events for domain %s, id %s", domain, domainId)
+		return nil, err
+	}
+	return s.toEvents(rows)
+}
+
+/*
+readAll pages through the events of every domain id by position. The filter is part of
+the query, so the last position gone through is that of the last event returned.
+*/
+func (s *sqliteRepo) readAll(ctx context.Context, from int64, limit int64, filter eventFilter) ([]*dedb.Event, int64, error) {
+	log := s.log.With().Str("op", "readAll").Logger()
+	log.Debug().Msgf("reading all events from position %d, limit %d", from, limit)
+	sql := `
+    SELECT id, domain, domain_id, name, timestamp, trace_id, stream_id, metadata, content_type, schema, data, version, position
+    FROM domain_events
+    WHERE position > ? AND (? = '' OR domain = ?)
+    `
+	args := []interface{}{from, filter.domain, filter.domain}
+	if names := filter.nameList(); len(names) > 0 {
+		sql += "AND name IN (?" + strings.Repeat(", ?", len(names)-1) + ")\n"
+		for _, name := range names {
+			args = append(args, name)
+		}
+	}
+	sql += "ORDER BY position ASC LIMIT ?"
+	args = append(args, sqliteLimit(limit))
+	rows := []eventRow{}
+	err := s.db.SelectContext(ctx, &rows, sql, args...)
 	if err != nil {
-		s.log.Error().Err(err).Msgf("could not query domain events for domain %s, id %s", domain, domainId)
-		return events, err
+		log.Error().Err(err).Msgf("could not query events from position %d", from)
+		return nil, 0, err
+	}
+	events, err := s.toEvents(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(events) == 0 {
+		return events, from, nil
+	}
+	return events, events[len(events)-1].Position, nil
+}
+
+// sqlOrder is the sort order of the read direction
+func sqlOrder(direction dedb.Direction) string {
+	if direction == dedb.Direction_BACKWARD {
+		return "DESC"
+	}
+	return "ASC"
+}
+
+func (s *sqliteRepo) toEvents(rows []eventRow) ([]*dedb.Event, error) {
+	events := make([]*dedb.Event, 0, len(rows))
+	for _, row := range rows {
+		e, err := row.event()
+		if err != nil {
+			s.log.Error().Err(err).Msgf("could not decode event %s", row.Id)
+			return nil, err
+		}
+		events = append(events, e)
 	}
 	return events, nil
 }
@@ -61,35 +315,262 @@ func (s *sqliteRepo) getDomainIds(ctx context.Context, domain string, offset int
 	log := s.log.With().Str("op", "getDomainIds").Logger()
 	log.Debug().Msgf("getting domain ids for domain %s, offset %d, limit %d", domain, offset, limit)
 
-	sql := "SELECT id FROM domains WHERE domain = ? ORDER BY timestamp ASC LIMIT ?, ?"
+	sql := "SELECT domain_id FROM domains WHERE domain = ? ORDER BY timestamp ASC, domain_id ASC LIMIT ? OFFSET ?"
 	ids := []string{}
-	err := s.db.Select(&ids, sql, domain, limit, offset)
+	err := s.db.SelectContext(ctx, &ids, sql, domain, sqliteLimit(limit), offset)
 	if err != nil {
-		s.log.Error().Err(err).Msgf("could not query domain ids for domain %s", domain)
-		return ids, err
+		log.Error().Err(err).Msgf("could not query domain ids for domain %s", domain)
+		return nil, err
 	}
 	return ids, nil
 }
 
-func (s *sqliteRepo) shutdown() {
-	s.db.Close()
+// sqliteLimit maps a limit of 0, meaning everything, to sqlite's -1
+func sqliteLimit(limit int64) int64 {
+	if limit <= 0 {
+		return -1
+	}
+	return limit
 }
 
-func NewSqliteRepo(config Config) (*sqliteRepo, error) {
-	r := &sqliteRepo{
-		log:    log.With().Str("logger", "sqliteRepo").Logger(),
-		config: config,
+// pending returns the oldest events in the outbox, in position order
+func (s *sqliteRepo) pending(ctx context.Context, limit int64) ([]*dedb.Event, error) {
+	log := s.log.With().Str("op", "pending").Logger()
+	rows := []string{}
+	err := s.db.SelectContext(ctx, &rows, "SELECT event FROM outbox ORDER BY position ASC LIMIT ?", limit)
+	if err != nil {
+		log.Error().Err(err).Msgf("could not read the outbox")
+		return nil, err
+	}
+	events := make([]*dedb.Event, 0, len(rows))
+	for _, je := range rows {
+		e := &dedb.Event{}
+		err := Decode(e, je)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not decode event")
+			return nil, err
+		}
+		events = append(events, e)
 	}
+	return events, nil
+}
 
-	r.log.Info().Msgf("connecting to db at %s", config.SqliteDbConfig.DbUrl)
-	db, err := sqlx.Connect("libsql", config.SqliteDbConfig.DbUrl)
+// published removes the events from the outbox
+func (s *sqliteRepo) published(ctx context.Context, events []*dedb.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	positions := make([]int64, 0, len(events))
+	for _, e := range events {
+		positions = append(positions, e.Position)
+	}
+	sql, args, err := sqlx.In("DELETE FROM outbox WHERE position IN (?)", positions)
 	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, sql, args...)
+	if err != nil {
+		s.log.Error().Err(err).Msgf("could not remove published events from the outbox")
+	}
+	return err
+}
+
+/*
+saveSnapshot stores the snapshot unless one with the same or a higher version exists. The
+snapshot can not cover events that were never saved.
+*/
+func (s *sqliteRepo) saveSnapshot(ctx context.Context, snapshot *dedb.Snapshot) error {
+	log := s.log.With().Str("op", "saveSnapshot").Logger()
+	err := s.transact(ctx, func(conn *sqlx.Conn) error {
+		var current int64
+		err := conn.GetContext(ctx, &current, "SELECT COALESCE(MAX(version), 0) FROM domain_events WHERE domain = ? AND domain_id = ?", snapshot.Domain, snapshot.DomainId)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not get current version of %s", snapshot.DomainId)
+			return err
+		}
+		if snapshot.Version > current {
+			return status.Errorf(codes.FailedPrecondition, "snapshot version %d is ahead of domain id %s at version %d", snapshot.Version, snapshot.DomainId, current)
+		}
+
+		md, err := json.Marshal(snapshot.Metadata)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not encode snapshot metadata")
+			return err
+		}
+		snapshot.Timestamp = time.Now().UnixMicro()
+		sql := `
+        INSERT INTO snapshots (domain, domain_id, version, timestamp, metadata, data)
+        VALUES(?, ?, ?, ?, ?, ?)
+        ON CONFLICT(domain, domain_id) DO UPDATE SET
+            version = excluded.version,
+            timestamp = excluded.timestamp,
+            metadata = excluded.metadata,
+            data = excluded.data
+        WHERE excluded.version > snapshots.version;
+        `
+		_, err = conn.ExecContext(ctx, sql, snapshot.Domain, snapshot.DomainId, snapshot.Version, snapshot.Timestamp, string(md), snapshot.Data)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not save snapshot for %s", snapshot.DomainId)
+		}
+		return err
+	})
+	if _, ok := status.FromError(err); !ok {
+		return fmt.Errorf("Could not save snapshot in dedb")
+	}
+	return err
+}
+
+func (s *sqliteRepo) getSnapshot(ctx context.Context, domain string, domainId string) (*dedb.Snapshot, error) {
+	log := s.log.With().Str("op", "getSnapshot").Logger()
+	sql := "SELECT domain, domain_id, version, timestamp, metadata, data FROM snapshots WHERE domain = ? AND domain_id = ?"
+	rows := []snapshotRow{}
+	err := s.db.SelectContext(ctx, &rows, sql, domain, domainId)
+	if err != nil {
+		log.Error().Err(err).Msgf("could not query snapshot for domain %s, id %s", domain, domainId)
 		return nil, err
 	}
-	r.db = db
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	row := rows[0]
+	snapshot := &dedb.Snapshot{
+		Domain:    row.Domain,
+		DomainId:  row.DomainId,
+		Version:   row.Version,
+		Timestamp: row.Timestamp,
+		Data:      row.Data,
+	}
+	if row.Metadata != "" {
+		err = json.Unmarshal([]byte(row.Metadata), &snapshot.Metadata)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not decode snapshot metadata")
+			return nil, err
+		}
+	}
+	return snapshot, nil
+}
 
-	r.log.Info().Msgf("connected to sqlite")
+/*
+saveSchema registers the schema, taking the next version when it has none. Registering a
+version again is a no op if the definition is the same, and an error if not.
+*/
+func (s *sqliteRepo) saveSchema(ctx context.Context, schema *dedb.Schema) (*dedb.Schema, error) {
+	log := s.log.With().Str("op", "saveSchema").Logger()
+	saved := proto.Clone(schema).(*dedb.Schema)
+	err := s.transact(ctx, func(conn *sqlx.Conn) error {
+		if saved.Version == 0 {
+			err := conn.GetContext(ctx, &saved.Version, "SELECT COALESCE(MAX(version), 0) + 1 FROM schemas WHERE domain = ? AND event_name = ?", saved.Domain, saved.EventName)
+			if err != nil {
+				log.Error().Err(err).Msgf("could not get latest schema version of %s", saved.EventName)
+				return err
+			}
+		}
+		rows := []schemaRow{}
+		err := conn.SelectContext(ctx, &rows, "SELECT * FROM schemas WHERE domain = ? AND event_name = ? AND version = ?", saved.Domain, saved.EventName, saved.Version)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not check for an existing schema")
+			return err
+		}
+		if len(rows) > 0 {
+			existing := rows[0].schema()
+			if !sameSchema(existing, saved) {
+				return schemaExists(saved)
+			}
+			saved = existing
+			return nil
+		}
+		saved.Timestamp = time.Now().UnixMicro()
+		_, err = conn.ExecContext(ctx, "INSERT INTO schemas (domain, event_name, version, type, definition, message_name, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			saved.Domain, saved.EventName, saved.Version, int32(saved.Type), saved.Definition, saved.MessageName, saved.Timestamp)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not save schema")
+		}
+		return err
+	})
+	if _, ok := status.FromError(err); !ok {
+		return nil, fmt.Errorf("Could not save schema in dedb")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+func (s *sqliteRepo) getSchema(ctx context.Context, domain string, eventName string, version int32) (*dedb.Schema, error) {
+	sql := "SELECT * FROM schemas WHERE domain = ? AND event_name = ? AND version = ?"
+	args := []interface{}{domain, eventName, version}
+	if version == 0 {
+		sql = "SELECT * FROM schemas WHERE domain = ? AND event_name = ? ORDER BY version DESC LIMIT 1"
+		args = args[:2]
+	}
+	rows := []schemaRow{}
+	err := s.db.SelectContext(ctx, &rows, sql, args...)
+	if err != nil {
+		s.log.Error().Err(err).Msgf("could not query schema of %s %s", domain, eventName)
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return rows[0].schema(), nil
+}
+
+func (s *sqliteRepo) listSchemas(ctx context.Context, domain string, eventName string) ([]*dedb.Schema, error) {
 	sql := `
+    SELECT * FROM schemas
+    WHERE (? = '' OR domain = ?) AND (? = '' OR event_name = ?)
+    ORDER BY domain, event_name, version
+    `
+	rows := []schemaRow{}
+	err := s.db.SelectContext(ctx, &rows, sql, domain, domain, eventName, eventName)
+	if err != nil {
+		s.log.Error().Err(err).Msgf("could not list schemas")
+		return nil, err
+	}
+	return schemaRows(rows), nil
+}
+
+/*
+transact runs fn inside a transaction on a single connection. The libsql driver does not
+implement database/sql transactions, so BEGIN and COMMIT are issued by hand. BEGIN IMMEDIATE
+takes the write lock up front, so concurrent writers wait instead of interleaving.
+*/
+func (s *sqliteRepo) transact(ctx context.Context, fn func(conn *sqlx.Conn) error) error {
+	conn, err := s.db.Connx(ctx)
+	if err != nil {
+		s.log.Error().Err(err).Msgf("could not get a connection")
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.ExecContext(ctx, "BEGIN IMMEDIATE")
+	if err != nil {
+		s.log.Error().Err(err).Msgf("could not start transaction")
+		return err
+	}
+	err = fn(conn)
+	if err == nil {
+		_, err = conn.ExecContext(ctx, "COMMIT")
+		if err != nil {
+			s.log.Error().Err(err).Msgf("could not commit transaction")
+		}
+	}
+	if err != nil {
+		conn.ExecContext(context.Background(), "ROLLBACK")
+	}
+	return err
+}
+
+func (s *sqliteRepo) shutdown() {
+	s.db.Close()
+}
+
+/*
+the schema is built up by the migrations below, in order, with the number applied kept in
+sqlite's user_version. The first one is the schema from before migrations were tracked, so
+existing databases pick up from there. New migrations are only ever appended.
+*/
+var sqliteMigrations = []string{
+	`
     CREATE TABLE IF NOT EXISTS domain_events  (
         id TEXT,
         name TEXT,
@@ -99,20 +580,146 @@ func NewSqliteRepo(config Config) (*sqliteRepo, error) {
         timestamp NUMBER,
         data TEXT
     );
-    `
-	_, err = r.db.Exec(sql)
-	if err != nil {
-		r.log.Error().Err(err).Msgf("could not create domain_events table")
-	}
-	sql = `
     CREATE TABLE IF NOT EXISTS domains (
         id TEXT,
         domain TEXT
     );
-    `
-	r.db.Exec(sql)
+    `,
+	// events are numbered within their domain id and across the store, existing ones in the
+	// order they were written, and keep their metadata and stream id. domains holds each
+	// domain id once with the timestamp it was first seen at
+	`
+    ALTER TABLE domain_events ADD COLUMN version INTEGER;
+    ALTER TABLE domain_events ADD COLUMN position INTEGER;
+    UPDATE domain_events SET version = numbered.version, position = numbered.position
+        FROM (
+            SELECT rowid AS row,
+                ROW_NUMBER() OVER (PARTITION BY domain, domain_id ORDER BY timestamp, rowid) AS version,
+                ROW_NUMBER() OVER (ORDER BY timestamp, rowid) AS position
+            FROM domain_events
+        ) AS numbered
+        WHERE domain_events.rowid = numbered.row;
+    CREATE TABLE snapshots (
+        domain TEXT,
+        domain_id TEXT,
+        version INTEGER,
+        timestamp INTEGER,
+        metadata TEXT,
+        data BLOB,
+        PRIMARY KEY (domain, domain_id)
+    );
+    CREATE TABLE idempotency (
+        key TEXT PRIMARY KEY,
+        response TEXT,
+        expires INTEGER
+    );
+    CREATE TABLE outbox (
+        position INTEGER PRIMARY KEY,
+        event TEXT
+    );
+    ALTER TABLE domain_events ADD COLUMN stream_id TEXT NOT NULL DEFAULT '';
+    ALTER TABLE domain_events ADD COLUMN metadata TEXT;
+    UPDATE domain_events SET trace_id = '' WHERE trace_id IS NULL;
+    CREATE TABLE domain_ids (
+        domain TEXT NOT NULL,
+        domain_id TEXT NOT NULL,
+        timestamp INTEGER NOT NULL,
+        PRIMARY KEY (domain, domain_id)
+    );
+    INSERT OR IGNORE INTO domain_ids (domain, domain_id, timestamp)
+        SELECT domain, domain_id, MIN(timestamp) FROM domain_events
+        WHERE domain IS NOT NULL AND domain_id IS NOT NULL
+        GROUP BY domain, domain_id;
+    DROP TABLE domains;
+    ALTER TABLE domain_ids RENAME TO domains;
+    CREATE UNIQUE INDEX domain_events_version_idx ON domain_events (domain, domain_id, version);
+    CREATE UNIQUE INDEX domain_events_position_idx ON domain_events (position);
+    CREATE INDEX domains_timestamp_idx ON domains (domain, timestamp, domain_id);
+    CREATE INDEX idempotency_expires_idx ON idempotency (expires);
+    `,
+	// typed payloads
+	`
+    ALTER TABLE domain_events ADD COLUMN content_type TEXT NOT NULL DEFAULT '';
+    ALTER TABLE domain_events ADD COLUMN schema TEXT NOT NULL DEFAULT '';
+    `,
+	`
+    CREATE TABLE schemas (
+        domain TEXT NOT NULL,
+        event_name TEXT NOT NULL,
+        version INTEGER NOT NULL,
+        type INTEGER NOT NULL,
+        definition BLOB,
+        message_name TEXT NOT NULL DEFAULT '',
+        timestamp INTEGER NOT NULL,
+        PRIMARY KEY (domain, event_name, version)
+    );
+    `,
+	`
+    CREATE INDEX domain_events_domain_position_idx ON domain_events (domain, position);
+    `,
+	// idempotency keys are scoped and remember the request they were saved with
+	`
+    DELETE FROM idempotency;
+    ALTER TABLE idempotency ADD COLUMN request_hash TEXT NOT NULL DEFAULT '';
+    `,
+}
+
+// migrate applies the migrations that were not applied yet
+func (s *sqliteRepo) migrate(ctx context.Context) error {
+	var current int
+	err := s.db.GetContext(ctx, &current, "PRAGMA user_version")
 	if err != nil {
-		r.log.Error().Err(err).Msgf("could not create domains table")
+		s.log.Error().Err(err).Msgf("could not get schema version")
+		return err
+	}
+	for i := current; i < len(sqliteMigrations); i++ {
+		s.log.Info().Msgf("applying migration %d", i+1)
+		err = s.transact(ctx, func(conn *sqlx.Conn) error {
+			// libsql only runs the first statement of a query, so they go one by one
+			for _, statement := range strings.Split(sqliteMigrations[i], ";") {
+				if strings.TrimSpace(statement) == "" {
+					continue
+				}
+				_, err := conn.ExecContext(ctx, statement)
+				if err != nil {
+					return err
+				}
+			}
+			_, err := conn.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", i+1))
+			return err
+		})
+		if err != nil {
+			s.log.Error().Err(err).Msgf("could not apply migration %d", i+1)
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+NewSqliteRepo opens the database at SQLITE_DB_URL. sqlite only allows one writer at a time,
+so the pool is kept to a single connection and transactions queue up behind each other
+instead of failing with SQLITE_BUSY.
+*/
+func NewSqliteRepo(config Config) (*sqliteRepo, error) {
+	r := &sqliteRepo{
+		log:    log.With().Str("logger", "sqliteRepo").Logger(),
+		config: config,
+	}
+
+	r.log.Info().Msgf("connecting to db at %s", config.SqliteDbConfig.DbUrl)
+	db, err := openLibsql(config.SqliteDbConfig.DbUrl)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	r.db = db
+
+	r.log.Info().Msgf("connected to sqlite")
+	err = r.migrate(context.Background())
+	if err != nil {
+		db.Close()
+		return nil, err
 	}
 	return r, nil
 }
@@ -0,0 +1,383 @@
+package internal
+
+import (
+	"context"
+	"database/sql/driver"
+	"dedb"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestSqliteRepo(t *testing.T) *sqliteRepo {
+	url := filepath.Join(t.TempDir(), "dedb.db")
+	repo, err := NewSqliteRepo(Config{SqliteDbConfig: SqliteDbConfig{DbUrl: url}})
+	if err != nil {
+		panic(err)
+	}
+	t.Cleanup(repo.shutdown)
+	return repo
+}
+
+func TestSqliteRepoSave(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	repo := newTestSqliteRepo(t)
+	cases := []struct {
+		name     string
+		events   []*dedb.Event
+		expected *dedb.ExpectedVersion
+		versions []int64
+		err      error
+	}{
+		{
+			name: "Simple happy path",
+			events: []*dedb.Event{
+				{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "testid"},
+			},
+			expected: &dedb.ExpectedVersion{Kind: dedb.ExpectedVersion_NO_STREAM},
+			versions: []int64{1},
+		},
+		{
+			name: "Versions continue per domain id",
+			events: []*dedb.Event{
+				{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "testid"},
+				{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "testid2"},
+			},
+			versions: []int64{2, 1},
+		},
+		{
+			name: "Stale expected version",
+			events: []*dedb.Event{
+				{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "testid"},
+			},
+			expected: &dedb.ExpectedVersion{Kind: dedb.ExpectedVersion_EXACT, Version: 1},
+			err:      versionConflict("testid", &dedb.ExpectedVersion{Kind: dedb.ExpectedVersion_EXACT, Version: 1}, 2),
+		},
+		{
+			name:   "Simple error for empty events list",
+			events: []*dedb.Event{},
+			err:    fmt.Errorf("no events were supplied to save"),
+		},
+	}
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			saved, err := repo.save(ctx, tc.events, tc.expected, saveKey{})
+			if tc.err == nil {
+				assert.Nil(t, err)
+				for i, e := range saved {
+					assert.NotEqual(t, "", e.Id)
+					assert.NotEqual(t, int64(0), e.Timestamp)
+					assert.Equal(t, tc.versions[i], e.Version)
+				}
+			} else {
+				assert.Equal(t, tc.err.Error(), err.Error())
+			}
+		})
+	}
+
+	// positions are global and in commit order
+	pending, _ := repo.pending(ctx, 10)
+	assert.Equal(t, 3, len(pending))
+	for i, e := range pending {
+		assert.Equal(t, int64(i+1), e.Position)
+	}
+	repo.published(ctx, pending)
+	pending, _ = repo.pending(ctx, 10)
+	assert.Equal(t, 0, len(pending))
+}
+
+func TestSqliteRepoRoundTrip(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	repo := newTestSqliteRepo(t)
+	event := &dedb.Event{
+		Id:          "client-id",
+		Name:        "CustomerCreated",
+		Domain:      "CUSTOMER",
+		DomainId:    "testid",
+		TraceId:     "trace",
+		StreamId:    "stream",
+		Metadata:    map[string]string{"by": "test"},
+		ContentType: "application/protobuf",
+		Schema:      "dedb.Customer",
+		Data:        []byte{0, 1, 2, 255},
+	}
+
+	// when
+	saved, err := repo.save(ctx, []*dedb.Event{event}, nil, saveKey{})
+	assert.Nil(t, err)
+	events, err := repo.getDomain(ctx, "CUSTOMER", "testid", 0, 0)
+
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, saved[0].String(), events[0].String())
+	assert.Equal(t, "client-id", events[0].Id)
+	assert.Equal(t, "test", events[0].Metadata["by"])
+	assert.Equal(t, []byte{0, 1, 2, 255}, events[0].Data)
+}
+
+func TestSqliteRepoGetDomain(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	repo := newTestSqliteRepo(t)
+	for i := 0; i < 5; i++ {
+		repo.save(ctx, []*dedb.Event{{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "testid"}}, nil, saveKey{})
+		repo.save(ctx, []*dedb.Event{{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "other"}}, nil, saveKey{})
+	}
+	cases := []struct {
+		name     string
+		offset   int64
+		limit    int64
+		versions []int64
+	}{
+		{name: "All events", versions: []int64{1, 2, 3, 4, 5}},
+		{name: "From an offset", offset: 3, versions: []int64{4, 5}},
+		{name: "Limited", offset: 1, limit: 2, versions: []int64{2, 3}},
+		{name: "Past the end", offset: 5, versions: []int64{}},
+	}
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			events, err := repo.getDomain(ctx, "CUSTOMER", "testid", tc.offset, tc.limit)
+			assert.Nil(t, err)
+			versions := []int64{}
+			for _, e := range events {
+				assert.Equal(t, "testid", e.DomainId)
+				versions = append(versions, e.Version)
+			}
+			assert.Equal(t, tc.versions, versions)
+		})
+	}
+}
+
+func TestSqliteRepoGetDomainIds(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	repo := newTestSqliteRepo(t)
+	for _, id := range []string{"a", "b", "a", "c", "b"} {
+		repo.save(ctx, []*dedb.Event{{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: id}}, nil, saveKey{})
+	}
+	repo.save(ctx, []*dedb.Event{{Name: "OrderCreated", Domain: "ORDER", DomainId: "o"}}, nil, saveKey{})
+	cases := []struct {
+		name   string
+		offset int64
+		limit  int64
+		ids    []string
+	}{
+		{name: "All ids once in first seen order", ids: []string{"a", "b", "c"}},
+		{name: "From an offset", offset: 1, ids: []string{"b", "c"}},
+		{name: "Limited", limit: 2, ids: []string{"a", "b"}},
+		{name: "Past the end", offset: 3, ids: []string{}},
+	}
+
+	// when / then
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ids, err := repo.getDomainIds(ctx, "CUSTOMER", tc.offset, tc.limit)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.ids, ids)
+		})
+	}
+}
+
+func TestSqliteRepoConcurrentWriters(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	repo := newTestSqliteRepo(t)
+	writers := 10
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+
+	// when
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			expected := &dedb.ExpectedVersion{Kind: dedb.ExpectedVersion_NO_STREAM}
+			_, err := repo.save(ctx, []*dedb.Event{{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "racer"}}, expected, saveKey{})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	// then
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+		}
+	}
+	assert.Equal(t, 1, succeeded)
+	events, _ := repo.getDomain(ctx, "CUSTOMER", "racer", 0, 0)
+	assert.Equal(t, 1, len(events))
+}
+
+func TestSqliteRepoSaveIdempotent(t *testing.T) {
+	testRepoSaveIdempotent(t, newTestSqliteRepo(t))
+}
+
+func TestSqliteRepoMigratesExistingSchema(t *testing.T) {
+	// setup, a database written before migrations were tracked
+	url := filepath.Join(t.TempDir(), "dedb.db")
+	db, err := openLibsql(url)
+	if err != nil {
+		panic(err)
+	}
+	db.MustExec(`CREATE TABLE IF NOT EXISTS domain_events  (
+        id TEXT,
+        name TEXT,
+        domain TEXT,
+        domain_id TEXT,
+        trace_id TEXT,
+        timestamp NUMBER,
+        data TEXT
+    )`)
+	db.MustExec(`CREATE TABLE IF NOT EXISTS domains (
+        id TEXT,
+        domain TEXT
+    )`)
+	db.MustExec("INSERT INTO domain_events (id, name, domain, domain_id, timestamp) VALUES ('2', 'CustomerUpdated', 'CUSTOMER', 'testid', 30)")
+	db.MustExec("INSERT INTO domain_events (id, name, domain, domain_id, timestamp) VALUES ('1', 'CustomerCreated', 'CUSTOMER', 'testid', 10)")
+	db.MustExec("INSERT INTO domain_events (id, name, domain, domain_id, timestamp) VALUES ('3', 'OrderCreated', 'ORDER', 'testid', 20)")
+	db.MustExec("INSERT INTO domains (id, domain) VALUES ('testid', 'CUSTOMER'), ('testid', 'CUSTOMER'), ('testid', 'ORDER')")
+	db.Close()
+
+	// when
+	repo, err := NewSqliteRepo(Config{SqliteDbConfig: SqliteDbConfig{DbUrl: url}})
+	assert.Nil(t, err)
+	defer repo.shutdown()
+
+	// then
+	ctx := context.Background()
+	ids, err := repo.getDomainIds(ctx, "CUSTOMER", 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"testid"}, ids)
+	events, err := repo.getDomain(ctx, "CUSTOMER", "testid", 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, "1", events[0].Id)
+	assert.Equal(t, int64(1), events[0].Version)
+	assert.Equal(t, int64(1), events[0].Position)
+	assert.Equal(t, "2", events[1].Id)
+	assert.Equal(t, int64(2), events[1].Version)
+	assert.Equal(t, int64(3), events[1].Position)
+	events, err = repo.getDomain(ctx, "ORDER", "testid", 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, int64(1), events[0].Version)
+	assert.Equal(t, int64(2), events[0].Position)
+	saved, err := repo.save(ctx, []*dedb.Event{{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "testid"}}, nil, saveKey{})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), saved[0].Version)
+	assert.Equal(t, int64(4), saved[0].Position)
+}
+
+func TestSqliteRepoSchemas(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	repo := newTestSqliteRepo(t)
+	first, err := repo.saveSchema(ctx, &dedb.Schema{Domain: "CUSTOMER", EventName: "CustomerCreated", Definition: []byte(`{}`)})
+	assert.Nil(t, err)
+
+	// when
+	second, err := repo.saveSchema(ctx, &dedb.Schema{Domain: "CUSTOMER", EventName: "CustomerCreated", Definition: []byte(`{"type":"object"}`)})
+	assert.Nil(t, err)
+	retried, retryErr := repo.saveSchema(ctx, &dedb.Schema{Domain: "CUSTOMER", EventName: "CustomerCreated", Version: 1, Definition: []byte(`{}`)})
+	_, changeErr := repo.saveSchema(ctx, &dedb.Schema{Domain: "CUSTOMER", EventName: "CustomerCreated", Version: 1, Definition: []byte(`{"type":"string"}`)})
+
+	// then
+	assert.Equal(t, int32(1), first.Version)
+	assert.Equal(t, int32(2), second.Version)
+	assert.Nil(t, retryErr)
+	assert.Equal(t, first.Timestamp, retried.Timestamp)
+	assert.Equal(t, codes.AlreadyExists, status.Code(changeErr))
+	latest, _ := repo.getSchema(ctx, "CUSTOMER", "CustomerCreated", 0)
+	assert.Equal(t, int32(2), latest.Version)
+	missing, err := repo.getSchema(ctx, "CUSTOMER", "CustomerDeleted", 0)
+	assert.Nil(t, err)
+	assert.Nil(t, missing)
+	schemas, _ := repo.listSchemas(ctx, "CUSTOMER", "")
+	assert.Equal(t, 2, len(schemas))
+}
+
+func TestSqliteRepoReadAll(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	repo := newTestSqliteRepo(t)
+	_, err := repo.save(ctx, []*dedb.Event{
+		{Name: "CustomerCreated", Domain: "CUSTOMER", DomainId: "one"},
+		{Name: "CustomerUpdated", Domain: "CUSTOMER", DomainId: "one"},
+	}, nil, saveKey{})
+	assert.Nil(t, err)
+	_, err = repo.save(ctx, []*dedb.Event{{Name: "OrderPlaced", Domain: "ORDER", DomainId: "two"}}, nil, saveKey{})
+	assert.Nil(t, err)
+
+	// when
+	all, next, err := repo.readAll(ctx, 0, 0, eventFilter{})
+	assert.Nil(t, err)
+	page, pageNext, _ := repo.readAll(ctx, 1, 1, eventFilter{})
+	filtered, _, _ := repo.readAll(ctx, 0, 0, newEventFilter("CUSTOMER", []string{"CustomerUpdated", "OrderPlaced"}))
+
+	// then
+	assert.Equal(t, 3, len(all))
+	assert.Equal(t, int64(3), next)
+	assert.Equal(t, "OrderPlaced", all[2].Name)
+	assert.Equal(t, int64(2), page[0].Position)
+	assert.Equal(t, int64(2), pageNext)
+	assert.Equal(t, 1, len(filtered))
+	assert.Equal(t, "CustomerUpdated", filtered[0].Name)
+}
+
+func TestSqliteRepoGetDomainByTimeRange(t *testing.T) {
+	testRepoGetDomainByTimeRange(t, newTestSqliteRepo(t))
+}
+
+func TestSqliteRepoGetDomainBackward(t *testing.T) {
+	testRepoGetDomainBackward(t, newTestSqliteRepo(t))
+}
+
+func TestSqliteRepoSaveSharedDomainId(t *testing.T) {
+	testRepoSaveSharedDomainId(t, newTestSqliteRepo(t))
+}
+
+func TestBindLiterals(t *testing.T) {
+	cases := []struct {
+		name     string
+		query    string
+		args     []interface{}
+		expected string
+		err      bool
+	}{
+		{name: "No arguments", query: "SELECT 1", expected: "SELECT 1"},
+		{name: "Each kind of value", query: "VALUES (?, ?, ?, ?, ?)", args: []interface{}{int64(-3), 1.5, true, nil, []byte{0xde, 0xad}}, expected: "VALUES (-3, 1.5, 1, NULL, X'dead')"},
+		{name: "Quotes are doubled", query: "SELECT ? AS a", args: []interface{}{"it's'; DROP TABLE x; --"}, expected: "SELECT 'it''s''; DROP TABLE x; --' AS a"},
+		{name: "Text with a NUL", query: "SELECT ?", args: []interface{}{"a\x00b"}, expected: "SELECT CAST(X'610062' AS TEXT)"},
+		{name: "Placeholders in literals are kept", query: "SELECT '?', \"?\", ?", args: []interface{}{"x"}, expected: "SELECT '?', \"?\", 'x'"},
+		{name: "Too few arguments", query: "SELECT ?, ?", args: []interface{}{int64(1)}, err: true},
+		{name: "Too many arguments", query: "SELECT ?", args: []interface{}{int64(1), int64(2)}, err: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			args := make([]driver.NamedValue, len(tc.args))
+			for i, arg := range tc.args {
+				args[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+			}
+			query, err := bindLiterals(tc.query, args)
+			assert.Equal(t, tc.err, err != nil)
+			if !tc.err {
+				assert.Equal(t, tc.expected, query)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "dedb"
+)
+
+const releaseTimeout = 5 * time.Second
+
+/*
+subscription is a single client connected through the Subscribe stream. It reads
+messages for its consumer group from the subscriber, sends the ones matching the
+requested event names down the stream and tracks what is waiting to be acked.
+*/
+type subscription struct {
+	log      zerolog.Logger
+	sub      subscriber
+	upcasts  *upcasterChain
+	src      api.DeDB_SubscribeServer
+	group    string
+	consumer string
+	domains  []string
+	names    map[string]bool
+
+	mu          sync.Mutex
+	pending     map[string]pendingMessage // event id => message waiting for its ack
+	byTimestamp map[string][]string       // domain:timestamp => ids of the pending events, for acks without an event id
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newSubscription(ctx context.Context, sub subscriber, upcasts *upcasterChain, src api.DeDB_SubscribeServer, r *api.SubscribeRequest, log zerolog.Logger) (*subscription, error) {
+	if r.ConsumerGroup == "" {
+		return nil, status.Error(codes.InvalidArgument, "consumer group is required to connect")
+	}
+	if len(r.Domains) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "at least one domain is required to connect")
+	}
+	if len(r.EventNames) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "at least one event name is required to connect")
+	}
+	id, err := generateId()
+	if err != nil {
+		return nil, err
+	}
+	s := &subscription{
+		sub:         sub,
+		upcasts:     upcasts,
+		src:         src,
+		group:       r.ConsumerGroup,
+		consumer:    r.ConsumerGroup + "-" + id.String(),
+		domains:     r.Domains,
+		names:       make(map[string]bool),
+		pending:     make(map[string]pendingMessage),
+		byTimestamp: make(map[string][]string),
+		done:        make(chan struct{}),
+	}
+	s.log = log.With().Str("consumer", s.consumer).Logger()
+	for _, name := range r.EventNames {
+		s.names[name] = true
+	}
+	for _, domain := range s.domains {
+		err = sub.join(ctx, s.group, domain)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "could not join consumer group %s", s.group)
+		}
+	}
+	return s, nil
+}
+
+/*
+start begins delivering messages to the client. Any error ending the delivery is sent
+to errs.
+*/
+func (s *subscription) start(ctx context.Context, errs chan<- error) {
+	ctx, s.cancel = context.WithCancel(ctx)
+	go func() {
+		defer close(s.done)
+		err := s.deliver(ctx)
+		if err != nil && ctx.Err() == nil {
+			errs <- err
+		}
+	}()
+}
+
+func (s *subscription) deliver(ctx context.Context) error {
+	for ctx.Err() == nil {
+		messages, err := s.sub.read(ctx, s.group, s.consumer, s.domains)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			s.log.Error().Err(err).Msg("could not read from the broker")
+			return status.Error(codes.Unavailable, "could not read from the broker")
+		}
+		for _, m := range messages {
+			if m.event == nil || !s.names[m.event.Name] {
+				// not something this group asked for, so it is acked to keep it off the pending list
+				err = s.sub.ack(ctx, s.group, m.domain, m.id)
+				if err != nil {
+					s.log.Error().Err(err).Msgf("could not ack skipped message %s", m.id)
+				}
+				continue
+			}
+			event, err := s.upcasts.upcastEvent(m.event)
+			if err != nil {
+				s.log.Error().Err(err).Msgf("could not upcast message %s", m.id)
+				return err
+			}
+			s.track(m)
+			err = s.src.Send(&api.SubscribeResponse{Message: &api.SubscribeResponse_Event{Event: event}})
+			if err != nil {
+				s.log.Error().Err(err).Msg("could not send event to client")
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pendingMessage is a message sent to the client and not acked yet
+type pendingMessage struct {
+	domain string
+	id     string // broker message id
+	key    string // domain:timestamp
+}
+
+func (s *subscription) track(m *message) {
+	key := pendingKey(m.domain, m.event.Timestamp)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pending[m.event.Id]; !ok {
+		s.byTimestamp[key] = append(s.byTimestamp[key], m.event.Id)
+	}
+	s.pending[m.event.Id] = pendingMessage{domain: m.domain, id: m.id, key: key}
+}
+
+/*
+ack acks the event with the id to the broker. Clients that only send the domain and
+timestamp get the events sharing them acked one at a time, in the order they were sent.
+*/
+func (s *subscription) ack(ctx context.Context, eventId string, domain string, timestamp int64) error {
+	s.mu.Lock()
+	if eventId == "" {
+		if ids := s.byTimestamp[pendingKey(domain, timestamp)]; len(ids) > 0 {
+			eventId = ids[0]
+		}
+	}
+	m, ok := s.pending[eventId]
+	if ok {
+		delete(s.pending, eventId)
+		ids := s.byTimestamp[m.key][:0]
+		for _, id := range s.byTimestamp[m.key] {
+			if id != eventId {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			delete(s.byTimestamp, m.key)
+		} else {
+			s.byTimestamp[m.key] = ids
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		s.log.Warn().Msgf("ack for unknown event %s %s", eventId, pendingKey(domain, timestamp))
+		return nil
+	}
+	return s.sub.ack(ctx, s.group, m.domain, m.id)
+}
+
+/*
+close stops delivery and releases the consumer from the group. It uses its own context
+as the stream context is usually gone by the time this is called.
+*/
+func (s *subscription) close() {
+	if s.cancel != nil {
+		s.cancel()
+		<-s.done
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+	err := s.sub.release(ctx, s.group, s.consumer, s.domains)
+	if err != nil {
+		s.log.Error().Err(err).Msg("could not release consumer")
+	}
+}
+
+func pendingKey(domain string, timestamp int64) string {
+	return fmt.Sprintf("%s:%d", domain, timestamp)
+}
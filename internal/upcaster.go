@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	api "dedb"
+)
+
+/*
+Upcaster transforms an event written with one schema version of its domain and name into
+the shape of the next version. It gets a copy of the stored event, so it is free to
+change it in place and return it.
+*/
+type Upcaster interface {
+	Upcast(event *api.Event) (*api.Event, error)
+}
+
+// UpcasterFunc lets a plain function be used as an Upcaster
+type UpcasterFunc func(event *api.Event) (*api.Event, error)
+
+func (f UpcasterFunc) Upcast(event *api.Event) (*api.Event, error) {
+	return f(event)
+}
+
+/*
+upcasterChain holds the upcasters registered per domain, event name and schema version.
+Events read from the repository are run through one upcaster after the other, from the
+version they were written with until there is none registered for the version reached,
+so readers only see the latest shape. Its zero value is an empty chain.
+*/
+type upcasterChain struct {
+	mu        sync.RWMutex
+	upcasters map[string]Upcaster // domain:event name:version => upcaster to the next version
+}
+
+func (c *upcasterChain) register(domain string, eventName string, version int32, upcaster Upcaster) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.upcasters == nil {
+		c.upcasters = make(map[string]Upcaster)
+	}
+	c.upcasters[schemaKey(domain, eventName, version)] = upcaster
+}
+
+func (c *upcasterChain) find(event *api.Event) Upcaster {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.upcasters[schemaKey(event.Domain, event.Name, event.SchemaVersion)]
+}
+
+// upcast brings each event up to the latest version, events already there are returned as is
+func (c *upcasterChain) upcast(events []*api.Event) ([]*api.Event, error) {
+	for i, e := range events {
+		upcasted, err := c.upcastEvent(e)
+		if err != nil {
+			return nil, err
+		}
+		events[i] = upcasted
+	}
+	return events, nil
+}
+
+func (c *upcasterChain) upcastEvent(event *api.Event) (*api.Event, error) {
+	upcaster := c.find(event)
+	if upcaster == nil {
+		return event, nil
+	}
+	// the repository may hand out the events it holds, so they are never changed in place
+	event = proto.Clone(event).(*api.Event)
+	for upcaster != nil {
+		version := event.SchemaVersion
+		upcasted, err := upcaster.Upcast(event)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "could not upcast %s event %s from version %d: %v", event.Name, event.Id, version, err)
+		}
+		if upcasted == nil {
+			return nil, status.Errorf(codes.Internal, "upcaster of %s version %d returned no event", event.Name, version)
+		}
+		upcasted.SchemaVersion = version + 1
+		event = upcasted
+		upcaster = c.find(event)
+	}
+	return event, nil
+}
+
+/*
+upcasterRule is an upcaster declared in the UPCASTERS_FILE, so events can be upcast by a
+DeDB run as a server and not only by Go code embedding it. It applies to events whose data
+is a JSON object: the fields listed are removed, then renamed, then the defaults are set
+for fields still missing.
+
+	{"upcasters": [
+		{"domain": "CUSTOMER", "event_name": "CustomerCreated", "version": 1, "rename_fields": {"name": "fullName"}},
+		{"domain": "CUSTOMER", "event_name": "CustomerCreated", "version": 2, "default_fields": {"active": true}, "remove_fields": ["legacy"]}
+	]}
+*/
+type upcasterRule struct {
+	Domain        string                     `json:"domain"`
+	EventName     string                     `json:"event_name"`
+	Version       int32                      `json:"version"` // schema version the events are upcast from
+	RemoveFields  []string                   `json:"remove_fields"`
+	RenameFields  map[string]string          `json:"rename_fields"`  // old name => new name
+	DefaultFields map[string]json.RawMessage `json:"default_fields"` // name => JSON value
+}
+
+func (r upcasterRule) Upcast(event *api.Event) (*api.Event, error) {
+	if event.ContentType != "" && event.ContentType != contentTypeJSON {
+		return nil, fmt.Errorf("data of content type %s can not be upcast by the upcasters file", event.ContentType)
+	}
+	fields := map[string]json.RawMessage{}
+	err := json.Unmarshal(event.Data, &fields)
+	if err != nil {
+		return nil, fmt.Errorf("data is not a JSON object: %w", err)
+	}
+	for _, name := range r.RemoveFields {
+		delete(fields, name)
+	}
+	for from, to := range r.RenameFields {
+		if value, ok := fields[from]; ok {
+			delete(fields, from)
+			fields[to] = value
+		}
+	}
+	for name, value := range r.DefaultFields {
+		if _, ok := fields[name]; !ok {
+			fields[name] = value
+		}
+	}
+	event.Data, err = json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// loadUpcasters reads the upcasters file, see upcasterRule
+func loadUpcasters(file string) ([]upcasterRule, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the upcasters file: %w", err)
+	}
+	config := struct {
+		Upcasters []upcasterRule `json:"upcasters"`
+	}{}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the upcasters file: %w", err)
+	}
+	seen := make(map[string]bool)
+	for i, rule := range config.Upcasters {
+		if rule.Domain == "" || rule.EventName == "" || rule.Version < 1 {
+			return nil, fmt.Errorf("upcaster %d of the upcasters file needs a domain, an event name and a version from 1", i+1)
+		}
+		key := schemaKey(rule.Domain, rule.EventName, rule.Version)
+		if seen[key] {
+			return nil, fmt.Errorf("upcaster %d of the upcasters file is the second one for %s %s version %d", i+1, rule.Domain, rule.EventName, rule.Version)
+		}
+		seen[key] = true
+		for name, value := range rule.DefaultFields {
+			if !json.Valid(value) {
+				return nil, fmt.Errorf("upcaster %d of the upcasters file has a default for %s that is not JSON", i+1, name)
+			}
+		}
+	}
+	return config.Upcasters, nil
+}
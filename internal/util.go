@@ -1,6 +1,10 @@
 package internal
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
 	"strings"
 	"time"
 
@@ -30,7 +34,11 @@ func Decode(entity proto.Message, data string) error {
 	return un.Unmarshal([]byte(data), entity)
 }
 
-func newPool(useSearch bool, baseConfig Config, log *zerolog.Logger) (*redis.Client, error) {
+/*
+newPool connects to Redis as configured. The Redis DB can be a single instance, a master
+found through sentinels or a cluster, all behind the same UniversalClient.
+*/
+func newPool(useSearch bool, baseConfig Config, log *zerolog.Logger) (redis.UniversalClient, error) {
 	type commonConfig struct {
 		DbAddress     string
 		Password      string
@@ -38,6 +46,8 @@ func newPool(useSearch bool, baseConfig Config, log *zerolog.Logger) (*redis.Cli
 		RedisCa       string
 		RedisUserCert string
 		RedisUserKey  string
+		TLS           bool
+		ServerName    string
 		Index         string
 		MinIdle       int
 		MaxActive     int
@@ -45,7 +55,22 @@ func newPool(useSearch bool, baseConfig Config, log *zerolog.Logger) (*redis.Cli
 		DbIndex       int
 	}
 
-	config := commonConfig(baseConfig.RedisDbConfig)
+	db := baseConfig.RedisDbConfig
+	config := commonConfig{
+		DbAddress:     db.DbAddress,
+		Password:      db.Password,
+		Username:      db.Username,
+		RedisCa:       db.RedisCa,
+		RedisUserCert: db.RedisUserCert,
+		RedisUserKey:  db.RedisUserKey,
+		TLS:           db.TLS,
+		ServerName:    db.ServerName,
+		Index:         db.Index,
+		MinIdle:       db.MinIdle,
+		MaxActive:     db.MaxActive,
+		IdleTimeout:   db.IdleTimeout,
+		DbIndex:       db.DbIndex,
+	}
 	if useSearch {
 		config = commonConfig(baseConfig.RedisSearchConfig)
 	}
@@ -59,67 +84,115 @@ func newPool(useSearch bool, baseConfig Config, log *zerolog.Logger) (*redis.Cli
 		config.IdleTimeout = int64(240)
 	}
 	log.Info().Msgf("has ca: %v, has cert: %v, has key: %v", config.RedisCa != "", config.RedisUserCert != "", config.RedisUserKey != "")
-	if config.RedisUserCert != "" {
-		/*
-			log.Info().Msgf("loading X509 cert and key pair")
-			cert, err := tls.X509KeyPair([]byte(config.RedisUserCert), []byte(config.RedisUserKey))
-			if err != nil {
-				log.Error().Err(err).Msg("could not load redis keypair")
-				return nil, err
-			}
-			caCertPool := x509.NewCertPool()
-			caCertPool.AppendCertsFromPEM([]byte(config.RedisCa))
-			tlscfg := &tls.Config{
-				Certificates: []tls.Certificate{cert},
-				RootCAs:      caCertPool,
-			}
-			tlscfg.InsecureSkipVerify = true
-			log.Info().Msgf("setting pool for TLS enabled Redis server: %s, max idle: %d, max active: %d, idle timeout: %d", config.Server, config.MaxIdle, config.MaxActive, config.IdleTimeout)
-			return &redis.Pool{
-				MaxIdle:     config.MaxIdle,
-				MaxActive:   config.MaxActive,
-				IdleTimeout: time.Duration(config.IdleTimeout) * time.Second,
-				Dial: func() (redis.Conn, error) {
-					c, err := redis.Dial("tcp",
-						config.Server,
-						redis.DialPassword(config.Password),
-						redis.DialUseTLS(true),
-						redis.DialTLSConfig(tlscfg),
-						redis.DialTLSSkipVerify(true))
-					if err != nil {
-						log.Error().Err(err).Msgf("error dialing redis")
-					}
+	var tlscfg *tls.Config
+	if config.TLS || config.RedisCa != "" || config.RedisUserCert != "" {
+		var err error
+		tlscfg, err = newTLSConfig(config.RedisCa, config.RedisUserCert, config.RedisUserKey, config.ServerName)
+		if err != nil {
+			log.Error().Err(err).Msg("could not set up TLS for redis")
+			return nil, err
+		}
+	}
 
-					return c, err
-				},
-				TestOnBorrow: func(c redis.Conn, t time.Time) error {
-					_, err := c.Do("PING")
-					return err
-				},
-			}, nil
-		*/
-	} else {
-		log.Info().Msgf("setting pool for non TLS enabled Redis server: %s, min idle: %d, max active: %d, idle timeout: %d", config.DbAddress, config.MinIdle, config.MaxActive, config.IdleTimeout)
-		if strings.Contains(config.DbAddress, "redis://") {
-			log.Info().Msgf("CONNECTING VIA redis:// URL")
-			opt, err := redis.ParseURL(config.DbAddress)
-			if err != nil {
-				log.Error().Err(err).Msgf("could not connect to %s", config.DbAddress)
-				return nil, err
+	if !useSearch && db.Mode == redisCluster {
+		log.Info().Msgf("setting pool for Redis cluster: %v, tls: %v, min idle: %d, max active: %d, idle timeout: %d", db.addresses(), tlscfg != nil, config.MinIdle, config.MaxActive, config.IdleTimeout)
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        db.addresses(),
+			Username:     config.Username,
+			Password:     config.Password,
+			TLSConfig:    tlscfg,
+			MinIdleConns: config.MinIdle,
+			PoolSize:     config.MaxActive,
+			IdleTimeout:  time.Duration(config.IdleTimeout) * time.Second,
+		}), nil
+	} else if !useSearch && db.Mode == redisSentinel {
+		log.Info().Msgf("setting pool for Redis master %s through sentinels: %v, tls: %v, min idle: %d, max active: %d, idle timeout: %d", db.MasterName, db.addresses(), tlscfg != nil, config.MinIdle, config.MaxActive, config.IdleTimeout)
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       db.MasterName,
+			SentinelAddrs:    db.addresses(),
+			SentinelPassword: db.SentinelPassword,
+			Username:         config.Username,
+			Password:         config.Password,
+			DB:               config.DbIndex,
+			TLSConfig:        tlscfg,
+			MinIdleConns:     config.MinIdle,
+			PoolSize:         config.MaxActive,
+			IdleTimeout:      time.Duration(config.IdleTimeout) * time.Second,
+		}), nil
+	}
+
+	log.Info().Msgf("setting pool for Redis server: %s, tls: %v, min idle: %d, max active: %d, idle timeout: %d", config.DbAddress, tlscfg != nil, config.MinIdle, config.MaxActive, config.IdleTimeout)
+	if strings.Contains(config.DbAddress, "redis://") || strings.Contains(config.DbAddress, "rediss://") {
+		log.Info().Msgf("CONNECTING VIA redis:// URL")
+		opt, err := redis.ParseURL(config.DbAddress)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not connect to %s", config.DbAddress)
+			return nil, err
+		}
+		if tlscfg != nil {
+			if tlscfg.ServerName == "" && opt.TLSConfig != nil {
+				tlscfg.ServerName = opt.TLSConfig.ServerName
 			}
-			return redis.NewClient(opt), nil
-		} else {
-			return redis.NewClient(&redis.Options{
-				Addr:         config.DbAddress,
-				Password:     config.Password,
-				MinIdleConns: config.MinIdle,
-				PoolSize:     config.MaxActive,
-				DB:           config.DbIndex,
-				IdleTimeout:  time.Duration(config.IdleTimeout) * time.Second,
-			}), nil
+			opt.TLSConfig = tlscfg
 		}
+		return redis.NewClient(opt), nil
+	}
+	return redis.NewClient(&redis.Options{
+		Addr:         config.DbAddress,
+		Username:     config.Username,
+		Password:     config.Password,
+		TLSConfig:    tlscfg,
+		MinIdleConns: config.MinIdle,
+		PoolSize:     config.MaxActive,
+		DB:           config.DbIndex,
+		IdleTimeout:  time.Duration(config.IdleTimeout) * time.Second,
+	}), nil
+}
+
+/*
+newTLSConfig verifies the server against the CA, or the system roots without one, and
+presents the client certificate when there is one. The server name defaults to the host
+dialed, so every node of a cluster is checked against its own name.
+*/
+func newTLSConfig(ca string, cert string, key string, serverName string) (*tls.Config, error) {
+	tlscfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+	if ca != "" {
+		caPEM, err := loadPEM(ca)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the CA: %w", err)
+		}
+		tlscfg.RootCAs = x509.NewCertPool()
+		if !tlscfg.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in the CA")
+		}
+	}
+	if cert != "" {
+		certPEM, err := loadPEM(cert)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the client certificate: %w", err)
+		}
+		keyPEM, err := loadPEM(key)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the client key: %w", err)
+		}
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the client key pair: %w", err)
+		}
+		tlscfg.Certificates = []tls.Certificate{pair}
+	}
+	return tlscfg, nil
+}
+
+// loadPEM returns the value when it holds PEM itself, otherwise the content of the file it names
+func loadPEM(value string) ([]byte, error) {
+	if strings.Contains(value, "-----BEGIN") {
+		return []byte(value), nil
 	}
-	return nil, nil
+	return os.ReadFile(value)
 }
 
 /*
@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"dedb"
+)
+
+const (
+	maxSaveAttempts        = 50 // how many times a save is retried when a concurrent writer got in first
+	wrongExpectedVersion   = "WRONG_EXPECTED_VERSION"
+	currentVersionMetadata = "current_version"
+)
+
+/*
+checkExpectedVersion returns an error if the current version of the domain instance does
+not satisfy the expected version of the save. A nil expected version matches anything.
+*/
+func checkExpectedVersion(domainId string, expected *dedb.ExpectedVersion, current int64) error {
+	switch expected.GetKind() {
+	case dedb.ExpectedVersion_NO_STREAM:
+		if current != 0 {
+			return versionConflict(domainId, expected, current)
+		}
+	case dedb.ExpectedVersion_EXACT:
+		if current != expected.Version {
+			return versionConflict(domainId, expected, current)
+		}
+	}
+	return nil
+}
+
+/*
+versionConflict builds the Aborted status returned when another writer got to the domain
+instance first. The actual current version is set in the ErrorInfo details so callers
+can reload and retry without parsing the message.
+*/
+func versionConflict(domainId string, expected *dedb.ExpectedVersion, current int64) error {
+	msg := fmt.Sprintf("domain id %s is at version %d, expected %d", domainId, current, expected.GetVersion())
+	if expected.GetKind() == dedb.ExpectedVersion_NO_STREAM {
+		msg = fmt.Sprintf("domain id %s is at version %d, expected no stream", domainId, current)
+	}
+	st, err := status.New(codes.Aborted, msg).WithDetails(&errdetails.ErrorInfo{
+		Reason:   wrongExpectedVersion,
+		Domain:   "dedb",
+		Metadata: map[string]string{currentVersionMetadata: strconv.FormatInt(current, 10)},
+	})
+	if err != nil {
+		return status.Error(codes.Aborted, msg)
+	}
+	return st.Err()
+}
+
+/*
+validateExpectedVersion makes sure a save guarded by an expected version only targets a
+single domain instance, as the version is per domain id.
+*/
+func validateExpectedVersion(request *dedb.SaveRequest) error {
+	expected := request.ExpectedVersion
+	if expected.GetKind() == dedb.ExpectedVersion_ANY {
+		return nil
+	}
+	if expected.GetKind() == dedb.ExpectedVersion_EXACT && expected.Version < 0 {
+		return status.Error(codes.InvalidArgument, "expected version can not be negative")
+	}
+	for _, e := range request.Events {
+		if e.Domain != request.Events[0].Domain || e.DomainId != request.Events[0].DomainId {
+			return status.Error(codes.InvalidArgument, "events saved with an expected version must all be for the same domain id")
+		}
+	}
+	return nil
+}
+
+// saveBackoff spreads out retries of writers that lost a race, growing with each attempt
+func saveBackoff(attempt int) time.Duration {
+	return time.Duration(rand.Int63n(int64(attempt+1)*int64(time.Millisecond))) + time.Millisecond
+}